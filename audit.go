@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+	rollbar "github.com/rollbar/rollbar-go"
+	"github.com/spf13/cast"
+)
+
+var auditConnection = "audit_log"
+
+// echo context keys set by auth0Middleware
+const (
+	actorSubjectKey = "actorSubject"
+	actorEmailKey   = "actorEmail"
+)
+
+// fields whose values never go into the audit log, only the fact they changed
+var auditRedacted = map[string]bool{
+	"sin":       true,
+	"clientDOB": true,
+	"babyDOB":   true,
+}
+
+// Actor - who made a change: a staff member from their token or a named system process
+type Actor struct {
+	Subject string `json:"subject" bson:"subject"`
+	Email   string `json:"email,omitempty" bson:"email,omitempty"`
+}
+
+// systemActor - changes that do not come from a staff member, such as a scheduling provider's webhook
+func systemActor(name string) Actor {
+	return Actor{Subject: "system:" + name}
+}
+
+// actorFrom - the authenticated staff member behind the request
+func actorFrom(ctx echo.Context) Actor {
+	return Actor{
+		Subject: cast.ToString(ctx.Get(actorSubjectKey)),
+		Email:   cast.ToString(ctx.Get(actorEmailKey)),
+	}
+}
+
+// AuditEntry - one immutable record of a change to a client
+type AuditEntry struct {
+	ID        bson.ObjectId          `json:"_id" bson:"_id"`
+	ClientID  bson.ObjectId          `json:"clientID" bson:"clientID"`
+	Actor     Actor                  `json:"actor" bson:"actor"`
+	Action    string                 `json:"action" bson:"action"`
+	Changes   map[string]auditChange `json:"changes" bson:"changes"`
+	Timestamp time.Time              `json:"timestamp" bson:"timestamp"`
+}
+
+// auditChange - a field's value before and after the change
+type auditChange struct {
+	Before interface{} `json:"before" bson:"before"`
+	After  interface{} `json:"after" bson:"after"`
+}
+
+// AuditStore - append-only persistence for audit entries; there is deliberately no update or delete
+type AuditStore interface {
+	Append(entry AuditEntry) error
+	FindByClientID(clientID string) ([]AuditEntry, error)
+}
+
+// auditDiff - the fields that differ between two versions of a document, using their json names
+func auditDiff(before interface{}, after interface{}) map[string]auditChange {
+	b := auditFields(before)
+	a := auditFields(after)
+	keys := map[string]bool{}
+	for k := range b {
+		keys[k] = true
+	}
+	for k := range a {
+		keys[k] = true
+	}
+	changes := map[string]auditChange{}
+	for k := range keys {
+		if reflect.DeepEqual(b[k], a[k]) {
+			continue
+		}
+		change := auditChange{Before: b[k], After: a[k]}
+		if auditRedacted[k] {
+			change = auditChange{Before: "[redacted]", After: "[redacted]"}
+		}
+		changes[k] = change
+	}
+	return changes
+}
+
+func auditFields(doc interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if doc == nil {
+		return fields
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fields
+	}
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// audit - record a change to a client; the write already happened so failures are reported, not returned
+func (s *server) audit(actor Actor, action string, clientID bson.ObjectId, before interface{}, after interface{}) {
+	entry := AuditEntry{
+		ID:        bson.NewObjectId(),
+		ClientID:  clientID,
+		Actor:     actor,
+		Action:    action,
+		Changes:   auditDiff(before, after),
+		Timestamp: time.Now(),
+	}
+	err := s.auditLog.Append(entry)
+	if err != nil {
+		rollbar.Error(err)
+	}
+}
+
+func (s *server) clientHistory(ctx echo.Context) error {
+	// history carries before and after values of every field
+	if !policyFor(ctx).sensitive() {
+		m := echo.Map{}
+		m["error"] = "client history is only available to caseworkers and admins"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	entries, err := s.auditLog.FindByClientID(ctx.Param("id"))
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp.Before(entries[j].Timestamp) })
+	return ctx.JSON(200, entries)
+}
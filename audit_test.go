@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuditDiff(t *testing.T) {
+	before := Client{ClientName: "Ann Smith", ClientDOB: "07-13-1995", Status: StatusPending}
+	after := before
+	after.ClientName = "Ann Jones"
+	after.ClientDOB = "07-14-1995"
+
+	changes := auditDiff(before, after)
+	if len(changes) != 2 {
+		t.Fatalf("expected two changes, got %v", changes)
+	}
+	if changes["clientName"].Before != "Ann Smith" || changes["clientName"].After != "Ann Jones" {
+		t.Errorf("unexpected name change %+v", changes["clientName"])
+	}
+	// the change is recorded, the dates are not
+	if changes["clientDOB"].Before != "[redacted]" || changes["clientDOB"].After != "[redacted]" {
+		t.Errorf("date of birth was not redacted: %+v", changes["clientDOB"])
+	}
+
+	created := auditDiff(nil, before)
+	if created["clientName"].After != "Ann Smith" || created["clientName"].Before != nil {
+		t.Errorf("a create should record every field as new, got %+v", created["clientName"])
+	}
+}
+
+func TestClientHistory(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	rec := api.call("PATCH", "/clients/"+c.ID.Hex(), `{"status":"APPROVED"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = api.call("GET", "/clients/"+c.ID.Hex()+"/history", "", RoleCaseworker)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("history: %d %s", rec.Code, rec.Body)
+	}
+	var entries []AuditEntry
+	decode(t, rec, &entries)
+	if len(entries) != 2 || entries[0].Action != "client.create" || entries[1].Action != "client.status" {
+		t.Fatalf("expected the create then the status change, got %+v", entries)
+	}
+	status := entries[1].Changes["status"]
+	if status.Before != StatusPending || status.After != StatusApproved || entries[1].Actor.Subject != "auth0|staff" {
+		t.Errorf("unexpected status entry %+v", entries[1])
+	}
+
+	rec = api.call("GET", "/clients/"+c.ID.Hex()+"/history", "", RoleVolunteer)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("volunteer history: got %d", rec.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// cal.com webhook trigger events
+const (
+	calcomBookingCreated     = "BOOKING_CREATED"
+	calcomBookingRescheduled = "BOOKING_RESCHEDULED"
+	calcomBookingCancelled   = "BOOKING_CANCELLED"
+)
+
+// booking form fields cal.com always asks for, which already have a place on the appointment
+var calcomSystemResponses = map[string]bool{
+	"name":             true,
+	"email":            true,
+	"guests":           true,
+	"location":         true,
+	"rescheduleReason": true,
+}
+
+// calcomProvider - bookings made through a self-hosted cal.com
+type calcomProvider struct{}
+
+func (calcomProvider) Name() string {
+	return providerCalcom
+}
+
+func (calcomProvider) Verify(header http.Header, body []byte, now time.Time) error {
+	return verifyCalcomSignature(header.Get(calcomSignatureHeader), body, calcomWebhookConfig())
+}
+
+// Parse - cal.com has one uid per booking so it stands in for both the event and invitee uuid
+func (calcomProvider) Parse(body []byte) (bookingEvent, error) {
+	if !gjson.ValidBytes(body) {
+		return bookingEvent{}, permanentError{errors.New("cal.com delivery is not valid json")}
+	}
+	r := gjson.ParseBytes(body)
+	p := r.Get("payload")
+	ev := bookingEvent{Name: r.Get("triggerEvent").String()}
+	uid := p.Get("uid").String()
+	if uid == "" {
+		return ev, permanentError{errors.New("cal.com delivery has no booking uid")}
+	}
+	switch ev.Name {
+	case calcomBookingCreated, calcomBookingRescheduled:
+		apt, err := parseCalcomAppointment(body, p)
+		if err != nil {
+			return ev, err
+		}
+		ev.Kind = bookingCreated
+		ev.Appointment = apt
+		if ev.Name == calcomBookingRescheduled {
+			// cal.com sends no cancel for the booking a reschedule replaces
+			ev.ReplacesInvitee = p.Get("rescheduleUid").String()
+			if ev.ReplacesInvitee == "" {
+				ev.ReplacesInvitee = p.Get("fromReschedule").String()
+			}
+			ev.CancelsReplaced = true
+		}
+	case calcomBookingCancelled:
+		ev.Kind = bookingCanceled
+		ev.Appointment = Appointment{
+			EventUUID:    uid,
+			InviteeUUID:  uid,
+			CancelReason: p.Get("cancellationReason").String(),
+			CancelerName: p.Get("cancelledBy").String(),
+		}
+	}
+	return ev, nil
+}
+
+// parseCalcomAppointment - the appointment described by a cal.com booking, with times in UTC
+func parseCalcomAppointment(body []byte, p gjson.Result) (Appointment, error) {
+	attendee := p.Get("attendees.0")
+	apt := Appointment{
+		Status:        AppointmentActive,
+		Provider:      providerCalcom,
+		EventTypeSlug: p.Get("type").String(),
+		EventTypeName: p.Get("eventTitle").String(),
+		Timezone:      attendee.Get("timeZone").String(),
+		AssignedTo:    make([]AppointmentStaff, 0),
+		Location:      p.Get("location").String(),
+		InviteeName:   attendee.Get("name").String(),
+		InviteeEmail:  strings.ToLower(strings.TrimSpace(attendee.Get("email").String())),
+		EventUUID:     p.Get("uid").String(),
+		InviteeUUID:   p.Get("uid").String(),
+	}
+	if apt.EventTypeName == "" {
+		apt.EventTypeName = p.Get("title").String()
+	}
+	errs := ValidationErrors{}
+	start, err := time.Parse(time.RFC3339, p.Get("startTime").String())
+	if err != nil {
+		errs["startTime"] = "is not an RFC3339 time"
+	}
+	end, err := time.Parse(time.RFC3339, p.Get("endTime").String())
+	if err != nil {
+		errs["endTime"] = "is not an RFC3339 time"
+	}
+	if len(errs) > 0 {
+		return Appointment{}, permanentError{errs}
+	}
+	apt.StartTime = start.UTC()
+	apt.EndTime = end.UTC()
+
+	if organizer := p.Get("organizer"); organizer.Exists() {
+		apt.AssignedTo = append(apt.AssignedTo, AppointmentStaff{
+			Name:    organizer.Get("name").String(),
+			Email:   organizer.Get("email").String(),
+			Primary: true,
+		})
+	}
+	for _, member := range p.Get("team.members").Array() {
+		apt.AssignedTo = append(apt.AssignedTo, AppointmentStaff{
+			Name:  member.Get("name").String(),
+			Email: member.Get("email").String(),
+		})
+	}
+
+	p.Get("responses").ForEach(func(key, response gjson.Result) bool {
+		if calcomSystemResponses[key.String()] {
+			return true
+		}
+		question := response.Get("label").String()
+		if question == "" {
+			question = key.String()
+		}
+		answer := strings.TrimSpace(response.Get("value").String())
+		if answer == "" {
+			return true
+		}
+		for _, q := range appointmentQuestions {
+			if strings.Contains(strings.ToLower(question), q.keyword) {
+				q.set(&apt, answer)
+				return true
+			}
+		}
+		apt.OtherAnswers = append(apt.OtherAnswers, AppointmentAnswer{Question: question, Answer: answer})
+		return true
+	})
+
+	err = json.Unmarshal(body, &apt.Raw)
+	if err != nil {
+		return Appointment{}, err
+	}
+	return apt, nil
+}
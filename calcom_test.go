@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// calcomBooking - a cal.com delivery for the booking uid, rescheduled from another uid when from is set
+func calcomBooking(trigger string, uid string, from string, start time.Time) []byte {
+	reschedule := ""
+	if from != "" {
+		reschedule = `"rescheduleUid":"` + from + `",`
+	}
+	return []byte(`{"triggerEvent":"` + trigger + `","payload":{"uid":"` + uid + `",` + reschedule +
+		`"type":"pickup","title":"Pickup between Ann Smith and Sam","eventTitle":"Pickup",` +
+		`"startTime":"` + start.Format(time.RFC3339) + `","endTime":"` + start.Add(30*time.Minute).Format(time.RFC3339) + `",` +
+		`"location":"Warehouse","organizer":{"name":"Sam","email":"sam@modernbaby.online"},` +
+		`"attendees":[{"name":"Ann Smith","email":"Ann@Example.com","timeZone":"America/Vancouver"}],` +
+		`"responses":{"name":{"label":"Your name","value":"Ann Smith"},"phone":{"label":"Phone number","value":"604 555 1234"},` +
+		`"notes":{"label":"Anything else?","value":"twins"}},"cancellationReason":"moving away"}}`)
+}
+
+func TestParseCalcomBooking(t *testing.T) {
+	start := time.Date(2019, 3, 1, 10, 0, 0, 0, time.FixedZone("PST", -8*3600))
+	ev, err := calcomProvider{}.Parse(calcomBooking(calcomBookingCreated, "uid1", "", start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apt := ev.Appointment
+	if ev.Kind != bookingCreated || apt.InviteeUUID != "uid1" || apt.EventUUID != "uid1" || apt.InviteeEmail != "ann@example.com" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if !apt.StartTime.Equal(start) || apt.StartTime.Location() != time.UTC || apt.EventTypeName != "Pickup" {
+		t.Errorf("unexpected appointment %+v", apt)
+	}
+	if len(apt.AssignedTo) != 1 || !apt.AssignedTo[0].Primary || apt.AssignedTo[0].Email != "sam@modernbaby.online" {
+		t.Errorf("unexpected staff %+v", apt.AssignedTo)
+	}
+	// the name is already on the appointment, the phone has its own field
+	if apt.Phone != "604 555 1234" || len(apt.OtherAnswers) != 1 || apt.OtherAnswers[0].Answer != "twins" {
+		t.Errorf("phone %q, other answers %+v", apt.Phone, apt.OtherAnswers)
+	}
+
+	ev, err = calcomProvider{}.Parse(calcomBooking(calcomBookingRescheduled, "uid2", "uid1", start))
+	if err != nil || ev.ReplacesInvitee != "uid1" || !ev.CancelsReplaced {
+		t.Errorf("a reschedule should cancel the booking it replaces: %+v %v", ev, err)
+	}
+
+	_, err = calcomProvider{}.Parse([]byte(`{"triggerEvent":"BOOKING_CREATED","payload":{}}`))
+	if !isPermanent(err) {
+		t.Errorf("no uid: expected a permanent error, got %v", err)
+	}
+}
+
+func TestCalcomBookingLifecycle(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	c, err := api.transition(Actor{}, c, StatusApproved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Minute)
+	status := func() string {
+		saved, _ := api.clients.FindByID(c.ID.Hex())
+		return saved.Status
+	}
+
+	err = api.processBooking(calcomProvider{}, calcomBooking(calcomBookingCreated, "uid1", "", start))
+	if err != nil || status() != StatusScheduled {
+		t.Fatalf("booking: %v, client %s", err, status())
+	}
+
+	// cal.com sends only the new booking, so the old one is canceled by the reschedule itself
+	err = api.processBooking(calcomProvider{}, calcomBooking(calcomBookingRescheduled, "uid2", "uid1", start.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := api.appointments.FindByInviteeUUID("uid1")
+	replacement, _ := api.appointments.FindByInviteeUUID("uid2")
+	if old.Status != AppointmentCanceled || old.ReplacedByID != replacement.ID || replacement.Status != AppointmentActive {
+		t.Errorf("reschedule: old %+v, replacement %+v", old, replacement)
+	}
+	if status() != StatusScheduled {
+		t.Errorf("a reschedule should keep the client scheduled, got %s", status())
+	}
+
+	err = api.processBooking(calcomProvider{}, calcomBooking(calcomBookingCancelled, "uid2", "", start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	canceled, _ := api.appointments.FindByInviteeUUID("uid2")
+	if canceled.Status != AppointmentCanceled || canceled.CancelReason != "moving away" || status() != StatusApproved {
+		t.Errorf("cancel: %+v, client %s", canceled, status())
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+	"github.com/spf13/cast"
+)
+
+var calendarFeedsConnection = "calendar_feeds"
+
+// what a calendar feed shows
+const (
+	FeedAll      = "all"
+	FeedStaff    = "staff"
+	FeedLocation = "location"
+)
+
+// how far back and ahead of today a feed reaches
+const (
+	feedHistory = 30 * 24 * time.Hour
+	feedAhead   = 180 * 24 * time.Hour
+)
+
+// CalendarFeed - a subscribable ICS url; the token in it is the only credential, so it is revoked by deleting the feed
+type CalendarFeed struct {
+	ID        bson.ObjectId `json:"_id" bson:"_id"`
+	Token     string        `json:"token" bson:"token"`
+	Kind      string        `json:"kind" bson:"kind"`
+	Value     string        `json:"value,omitempty" bson:"value,omitempty"`
+	CreatedBy Actor         `json:"createdBy" bson:"createdBy"`
+	CreatedAt time.Time     `json:"createdAt" bson:"createdAt"`
+}
+
+// CalendarFeedStore - persistence for calendar feeds
+type CalendarFeedStore interface {
+	Save(f CalendarFeed) error
+	Delete(id string) error
+	FindByID(id string) (CalendarFeed, error)
+	FindByToken(token string) (CalendarFeed, error)
+	List() ([]CalendarFeed, error)
+}
+
+// includes - whether the appointment belongs in the feed
+func (f CalendarFeed) includes(apt Appointment) bool {
+	switch f.Kind {
+	case FeedStaff:
+		for _, staff := range apt.AssignedTo {
+			if strings.EqualFold(staff.Email, f.Value) {
+				return true
+			}
+		}
+		return false
+	case FeedLocation:
+		return apt.LocationID.Hex() == f.Value
+	}
+	return true
+}
+
+func newFeedToken() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// feedURL - the address calendar apps subscribe to
+func feedURL(ctx echo.Context, f CalendarFeed) string {
+	return ctx.Scheme() + "://" + ctx.Request().Host + "/calendar/" + f.Token + ".ics"
+}
+
+func (s *server) createCalendarFeed(ctx echo.Context) error {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(ctx.Request().Body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	var body echo.Map
+	err = json.Unmarshal(buf.Bytes(), &body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	f := CalendarFeed{
+		ID:        bson.NewObjectId(),
+		Kind:      cast.ToString(body["kind"]),
+		Value:     strings.TrimSpace(cast.ToString(body["value"])),
+		CreatedBy: actorFrom(ctx),
+		CreatedAt: time.Now(),
+	}
+	switch f.Kind {
+	case FeedAll:
+		f.Value = ""
+	case FeedStaff:
+		if f.Value == "" {
+			// a staff member's own appointments
+			f.Value = f.CreatedBy.Email
+		}
+		if f.Value == "" {
+			return validationError(ctx, ValidationErrors{"value": "is required for a staff feed"})
+		}
+		f.Value = strings.ToLower(f.Value)
+	case FeedLocation:
+		_, err = s.scheduling.FindLocation(f.Value)
+		if err != nil {
+			return validationError(ctx, ValidationErrors{"value": "is not a pickup location"})
+		}
+	default:
+		return validationError(ctx, ValidationErrors{"kind": "must be all, staff or location"})
+	}
+	f.Token, err = newFeedToken()
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	err = s.feeds.Save(f)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(http.StatusCreated, echo.Map{"feed": f, "url": feedURL(ctx, f)})
+}
+
+// calendarFeeds - admins see every feed, everyone else the feeds they made
+func (s *server) calendarFeeds(ctx echo.Context) error {
+	feeds, err := s.feeds.List()
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	actor := actorFrom(ctx)
+	visible := make([]echo.Map, 0)
+	for _, f := range feeds {
+		if hasRole(ctx, RoleAdmin) || f.CreatedBy.Subject == actor.Subject {
+			visible = append(visible, echo.Map{"feed": f, "url": feedURL(ctx, f)})
+		}
+	}
+	return ctx.JSON(http.StatusOK, visible)
+}
+
+func (s *server) deleteCalendarFeed(ctx echo.Context) error {
+	f, err := s.feeds.FindByID(ctx.Param("id"))
+	if err == mgo.ErrNotFound {
+		m := echo.Map{}
+		m["error"] = "calendar feed not found"
+		return ctx.JSON(404, m)
+	}
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	if !hasRole(ctx, RoleAdmin) && f.CreatedBy.Subject != actorFrom(ctx).Subject {
+		m := echo.Map{}
+		m["error"] = "only admins can revoke another staff member's feed"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	err = s.feeds.Delete(f.ID.Hex())
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+// calendarICS - the feed itself; calendar apps cannot log in, so the token in the url is checked instead
+func (s *server) calendarICS(ctx echo.Context) error {
+	token := strings.TrimSuffix(ctx.Param("token"), ".ics")
+	f, err := s.feeds.FindByToken(token)
+	if err != nil {
+		return ctx.String(http.StatusNotFound, "calendar not found")
+	}
+	now := time.Now()
+	appointments, err := s.appointments.FindBetween(now.Add(-feedHistory), now.Add(feedAhead))
+	if err != nil {
+		return ctx.String(500, err.Error())
+	}
+
+	name := "Modern Baby appointments"
+	switch f.Kind {
+	case FeedStaff:
+		name += " - " + f.Value
+	case FeedLocation:
+		if l, err := s.scheduling.FindLocation(f.Value); err == nil {
+			name += " - " + l.Name
+		}
+	}
+	cal := newICS(name)
+	clients := map[bson.ObjectId]Client{}
+	for _, apt := range appointments {
+		if !f.includes(apt) {
+			continue
+		}
+		client, ok := clients[apt.ClientID]
+		if !ok {
+			client, _ = s.clients.FindByID(apt.ClientID.Hex())
+			clients[apt.ClientID] = client
+		}
+		cal.event(apt, client, now)
+	}
+	ctx.Response().Header().Set("Cache-Control", "no-store")
+	return ctx.Blob(http.StatusOK, "text/calendar; charset=utf-8", cal.bytes())
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// calendly webhook event types
+const (
+	calendlyInviteeCreated  = "invitee.created"
+	calendlyInviteeCanceled = "invitee.canceled"
+)
+
+// calendlyProvider - bookings made through calendly.com
+type calendlyProvider struct{}
+
+func (calendlyProvider) Name() string {
+	return providerCalendly
+}
+
+func (calendlyProvider) Verify(header http.Header, body []byte, now time.Time) error {
+	key, tolerance := calendlyWebhookConfig()
+	return verifyCalendlySignature(header.Get(calendlySignatureHeader), body, key, tolerance, now)
+}
+
+func (calendlyProvider) Parse(body []byte) (bookingEvent, error) {
+	r := gjson.ParseBytes(body)
+	ev := bookingEvent{Name: r.Get("event").String()}
+	if r.Get("payload.invitee.uuid").String() == "" {
+		return ev, errNoInvitee
+	}
+	switch ev.Name {
+	case calendlyInviteeCreated:
+		apt, err := parseCalendlyAppointment(body)
+		if err != nil {
+			return ev, err
+		}
+		ev.Kind = bookingCreated
+		ev.Appointment = apt
+		ev.ReplacesInvitee = r.Get("payload.old_invitee.uuid").String()
+	case calendlyInviteeCanceled:
+		ev.Kind = bookingCanceled
+		ev.Appointment = Appointment{
+			EventUUID:    r.Get("payload.event.uuid").String(),
+			InviteeUUID:  r.Get("payload.invitee.uuid").String(),
+			CancelReason: r.Get("payload.invitee.cancel_reason").String(),
+			CancelerName: r.Get("payload.invitee.canceler_name").String(),
+		}
+		if at, err := time.Parse(time.RFC3339, r.Get("payload.invitee.canceled_at").String()); err == nil {
+			ev.Appointment.CanceledAt = at
+		}
+		ev.ReplacedByInvitee = r.Get("payload.new_invitee.uuid").String()
+	}
+	return ev, nil
+}
+
+// errNoInvitee - a calendly delivery without the invitee we key appointments on
+var errNoInvitee = permanentError{errors.New("calendly delivery has no invitee uuid")}
+
+// appointmentQuestions - booking questions that fill a named appointment field, matched on a word in the question
+var appointmentQuestions = []struct {
+	keyword string
+	set     func(apt *Appointment, answer string)
+}{
+	{"phone", func(apt *Appointment, answer string) { apt.Phone = answer }},
+}
+
+// parseCalendlyAppointment - the appointment described by a calendly delivery, with times in UTC
+func parseCalendlyAppointment(data []byte) (Appointment, error) {
+	if !gjson.ValidBytes(data) {
+		return Appointment{}, permanentError{errors.New("calendly delivery is not valid json")}
+	}
+	r := gjson.ParseBytes(data)
+	p := r.Get("payload")
+	apt := Appointment{
+		Status:        AppointmentActive,
+		Provider:      providerCalendly,
+		EventTypeSlug: p.Get("event_type.slug").String(),
+		EventTypeName: p.Get("event_type.name").String(),
+		Timezone:      p.Get("invitee.timezone").String(),
+		AssignedTo:    make([]AppointmentStaff, 0),
+		Location:      calendlyLocation(p.Get("event.location")),
+		InviteeName:   p.Get("invitee.name").String(),
+		InviteeEmail:  strings.ToLower(strings.TrimSpace(p.Get("invitee.email").String())),
+		EventUUID:     p.Get("event.uuid").String(),
+		InviteeUUID:   p.Get("invitee.uuid").String(),
+	}
+	errs := ValidationErrors{}
+	start, err := time.Parse(time.RFC3339, p.Get("event.start_time").String())
+	if err != nil {
+		errs["startTime"] = "is not an RFC3339 time"
+	}
+	end, err := time.Parse(time.RFC3339, p.Get("event.end_time").String())
+	if err != nil {
+		errs["endTime"] = "is not an RFC3339 time"
+	}
+	if len(errs) > 0 {
+		return Appointment{}, permanentError{errs}
+	}
+	apt.StartTime = start.UTC()
+	apt.EndTime = end.UTC()
+
+	for _, staff := range p.Get("event.extended_assigned_to").Array() {
+		apt.AssignedTo = append(apt.AssignedTo, AppointmentStaff{
+			Name:    staff.Get("name").String(),
+			Email:   staff.Get("email").String(),
+			Primary: staff.Get("primary").Bool(),
+		})
+	}
+	if len(apt.AssignedTo) == 0 {
+		// older deliveries only carry the names
+		for _, name := range p.Get("event.assigned_to").Array() {
+			apt.AssignedTo = append(apt.AssignedTo, AppointmentStaff{Name: name.String()})
+		}
+	}
+
+	for _, qa := range p.Get("questions_and_answers").Array() {
+		question := qa.Get("question").String()
+		answer := strings.TrimSpace(qa.Get("answer").String())
+		named := false
+		for _, q := range appointmentQuestions {
+			if strings.Contains(strings.ToLower(question), q.keyword) {
+				q.set(&apt, answer)
+				named = true
+				break
+			}
+		}
+		if !named {
+			apt.OtherAnswers = append(apt.OtherAnswers, AppointmentAnswer{Question: question, Answer: answer})
+		}
+	}
+
+	if p.Get("event.canceled").Bool() || p.Get("invitee.canceled").Bool() {
+		apt.Status = AppointmentCanceled
+	}
+
+	err = json.Unmarshal(data, &apt.Raw)
+	if err != nil {
+		return Appointment{}, err
+	}
+	return apt, nil
+}
+
+// calendlyLocation - the event location, which calendly sends as null, a string or an object
+func calendlyLocation(location gjson.Result) string {
+	if !location.IsObject() {
+		return location.String()
+	}
+	for _, key := range []string{"location", "join_url", "type"} {
+		if v := location.Get(key).String(); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestParseCalendlyAppointment(t *testing.T) {
+	body, err := ioutil.ReadFile("webhook_fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apt, err := parseCalendlyAppointment(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2018, 10, 9, 18, 30, 0, 0, time.UTC)
+	if !apt.StartTime.Equal(start) || apt.StartTime.Location() != time.UTC || !apt.EndTime.Equal(start.Add(30*time.Minute)) {
+		t.Errorf("times should be in UTC: %s - %s", apt.StartTime, apt.EndTime)
+	}
+	if apt.Status != AppointmentActive || apt.Provider != providerCalendly || apt.EventTypeSlug != "intake-meeting" ||
+		apt.InviteeEmail != "bevan@bevanhunt.com" || apt.InviteeUUID != "FGFXPRFA7FRJR3SQ" || apt.EventUUID != "GBDUFZETWLK3Y2R7" {
+		t.Errorf("unexpected appointment %+v", apt)
+	}
+	if len(apt.AssignedTo) != 1 || apt.AssignedTo[0].Email != "bevan@bevanhunt.com" || !apt.AssignedTo[0].Primary {
+		t.Errorf("unexpected staff %+v", apt.AssignedTo)
+	}
+	// the phone question fills the phone field rather than the other answers
+	if apt.Phone != "+16045551234" || len(apt.OtherAnswers) != 0 {
+		t.Errorf("phone %q, other answers %+v", apt.Phone, apt.OtherAnswers)
+	}
+	if apt.Raw["event"] != "invitee.created" {
+		t.Errorf("the delivery was not kept under raw: %v", apt.Raw["event"])
+	}
+
+	// older deliveries only have staff names, and answers we have no field for are kept as they were asked
+	older := strings.Replace(string(body), `"extended_assigned_to"`, `"unused"`, 1)
+	older = strings.Replace(older, "What is your phone number?\",\n                \"answer\"", "Due date?\",\n                \"answer\"", 1)
+	apt, err = parseCalendlyAppointment([]byte(older))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apt.AssignedTo) != 1 || apt.AssignedTo[0].Name != "Bevan Hunt" || apt.AssignedTo[0].Email != "" {
+		t.Errorf("unexpected staff %+v", apt.AssignedTo)
+	}
+	if apt.Phone != "" || len(apt.OtherAnswers) != 1 || apt.OtherAnswers[0].Question != "Due date?" {
+		t.Errorf("phone %q, other answers %+v", apt.Phone, apt.OtherAnswers)
+	}
+}
+
+func TestParseCalendlyAppointmentRejectsBadDeliveries(t *testing.T) {
+	for name, body := range map[string]string{
+		"not json":  `{"event":`,
+		"no times":  `{"event":"invitee.created","payload":{"invitee":{"uuid":"X"}}}`,
+		"bad start": `{"payload":{"event":{"start_time":"tuesday","end_time":"2018-10-09T12:00:00-07:00"}}}`,
+	} {
+		_, err := parseCalendlyAppointment([]byte(body))
+		if !isPermanent(err) {
+			t.Errorf("%s: expected a permanent error, got %v", name, err)
+		}
+	}
+}
+
+func TestCalendlyLocation(t *testing.T) {
+	for raw, want := range map[string]string{
+		`null`:        "",
+		`"1 Main St"`: "1 Main St",
+		`{"type":"physical","location":"1 Main St"}`:       "1 Main St",
+		`{"type":"zoom","join_url":"https://zoom.us/j/1"}`: "https://zoom.us/j/1",
+		`{"type":"outbound_call"}`:                         "outbound_call",
+	} {
+		if got := calendlyLocation(gjson.Parse(raw)); got != want {
+			t.Errorf("%s: got %q, want %q", raw, got, want)
+		}
+	}
+}
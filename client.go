@@ -0,0 +1,226 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/globalsign/mgo/bson"
+)
+
+// dates coming from the intake form are month-day-year (e.g. 07-13-1995)
+const dateLayout = "01-02-2006"
+
+// demographic checkboxes offered on the intake form
+var knownDemographics = map[string]bool{
+	"indigenous":      true,
+	"immigrant":       true,
+	"refugee":         true,
+	"singleParent":    true,
+	"youngParent":     true,
+	"disability":      true,
+	"visibleMinority": true,
+	"lgbtq":           true,
+}
+
+// Client - a family referred to the program
+type Client struct {
+	ID               bson.ObjectId   `json:"_id" bson:"_id"`
+	DateCreated      time.Time       `json:"dateCreated" bson:"dateCreated"`
+	Status           string          `json:"status" bson:"status"`
+	StatusReason     string          `json:"statusReason,omitempty" bson:"statusReason,omitempty"`
+	ClientName       string          `json:"clientName" bson:"clientName"`
+	ClientEmail      string          `json:"clientEmail" bson:"clientEmail"`
+	EmailAliases     []string        `json:"emailAliases,omitempty" bson:"emailAliases,omitempty"`
+	EmailIssue       string          `json:"emailIssue,omitempty" bson:"emailIssue,omitempty"`
+	EmailIssueAt     time.Time       `json:"emailIssueAt,omitempty" bson:"emailIssueAt,omitempty"`
+	ClientPhone      string          `json:"clientPhone" bson:"clientPhone"`
+	SIN              string          `json:"sin,omitempty" bson:"sin,omitempty"`
+	SINHash          string          `json:"-" bson:"sinHash,omitempty"`
+	ClientDOB        string          `json:"clientDOB" bson:"clientDOB"`
+	BabyDOB          string          `json:"babyDOB" bson:"babyDOB"`
+	BabyName         string          `json:"babyName,omitempty" bson:"babyName,omitempty"`
+	DemographicInfo  map[string]bool `json:"demographicInfo" bson:"demographicInfo"`
+	DemographicOther string          `json:"demographicOther" bson:"demographicOther"`
+	ClientIncome     int64           `json:"clientIncome" bson:"clientIncome"`
+	AgencyName       string          `json:"agencyName" bson:"agencyName"`
+	ReferrerName     string          `json:"referrerName" bson:"referrerName"`
+	ReferrerEmail    string          `json:"referrerEmail" bson:"referrerEmail"`
+	SearchTokens     []string        `json:"-" bson:"searchTokens"`
+}
+
+// Appointment - a booking parsed from the scheduling webhook; Raw keeps the delivery it came from
+type Appointment struct {
+	ID            bson.ObjectId          `json:"_id" bson:"_id"`
+	ClientID      bson.ObjectId          `json:"clientID" bson:"clientid"`
+	Status        string                 `json:"status" bson:"status"`
+	Provider      string                 `json:"provider,omitempty" bson:"provider,omitempty"`
+	EventTypeSlug string                 `json:"eventTypeSlug" bson:"eventTypeSlug"`
+	EventTypeName string                 `json:"eventTypeName" bson:"eventTypeName"`
+	StartTime     time.Time              `json:"startTime" bson:"startTime"`
+	EndTime       time.Time              `json:"endTime" bson:"endTime"`
+	Timezone      string                 `json:"timezone,omitempty" bson:"timezone,omitempty"`
+	AssignedTo    []AppointmentStaff     `json:"assignedTo" bson:"assignedTo"`
+	Location      string                 `json:"location,omitempty" bson:"location,omitempty"`
+	LocationID    bson.ObjectId          `json:"locationID,omitempty" bson:"locationID,omitempty"`
+	InviteeName   string                 `json:"inviteeName" bson:"inviteeName"`
+	InviteeEmail  string                 `json:"inviteeEmail" bson:"inviteeEmail"`
+	Phone         string                 `json:"phone,omitempty" bson:"phone,omitempty"`
+	OtherAnswers  []AppointmentAnswer    `json:"otherAnswers,omitempty" bson:"otherAnswers,omitempty"`
+	EventUUID     string                 `json:"eventUUID" bson:"eventUUID"`
+	InviteeUUID   string                 `json:"inviteeUUID" bson:"inviteeUUID"`
+	CancelReason  string                 `json:"cancelReason,omitempty" bson:"cancelReason,omitempty"`
+	CancelerName  string                 `json:"cancelerName,omitempty" bson:"cancelerName,omitempty"`
+	CanceledAt    time.Time              `json:"canceledAt,omitempty" bson:"canceledAt,omitempty"`
+	ReplacesID    bson.ObjectId          `json:"replacesID,omitempty" bson:"replacesID,omitempty"`
+	ReplacedByID  bson.ObjectId          `json:"replacedByID,omitempty" bson:"replacedByID,omitempty"`
+	RemindersSent []string               `json:"remindersSent,omitempty" bson:"remindersSent,omitempty"`
+	Attendance    string                 `json:"attendance,omitempty" bson:"attendance,omitempty"`
+	AttendanceAt  time.Time              `json:"attendanceAt,omitempty" bson:"attendanceAt,omitempty"`
+	Raw           map[string]interface{} `json:"raw,omitempty" bson:"raw,omitempty"`
+}
+
+// AppointmentStaff - a staff member the booking is assigned to
+type AppointmentStaff struct {
+	Name    string `json:"name" bson:"name"`
+	Email   string `json:"email,omitempty" bson:"email,omitempty"`
+	Primary bool   `json:"primary" bson:"primary"`
+}
+
+// AppointmentAnswer - a booking question with no named field of its own
+type AppointmentAnswer struct {
+	Question string `json:"question" bson:"question"`
+	Answer   string `json:"answer" bson:"answer"`
+}
+
+// ValidationErrors - field-level validation failures keyed by json field name
+type ValidationErrors map[string]string
+
+func (v ValidationErrors) Error() string {
+	fields := make([]string, 0, len(v))
+	for field := range v {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	msgs := make([]string, 0, len(fields))
+	for _, field := range fields {
+		msgs = append(msgs, field+": "+v[field])
+	}
+	return "validation failed: " + strings.Join(msgs, ", ")
+}
+
+// clearServerFields - drop everything only the api sets, so a create request cannot give itself another
+// family's email as an alias, an email issue, a status reason or a place in the lifecycle
+func (c *Client) clearServerFields() {
+	c.ID = ""
+	c.DateCreated = time.Time{}
+	c.Status = ""
+	c.StatusReason = ""
+	c.EmailAliases = nil
+	c.EmailIssue = ""
+	c.EmailIssueAt = time.Time{}
+	c.SINHash = ""
+	c.SearchTokens = nil
+}
+
+// normalize trims whitespace and lowercases the email before validation and storage
+func (c *Client) normalize() {
+	c.ClientName = strings.TrimSpace(c.ClientName)
+	c.ClientEmail = strings.ToLower(strings.TrimSpace(c.ClientEmail))
+	c.ClientPhone = strings.TrimSpace(c.ClientPhone)
+	// SINs are often typed with spaces or dashes (e.g. 046-454-286)
+	c.SIN = strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(c.SIN))
+	c.ClientDOB = strings.TrimSpace(c.ClientDOB)
+	c.BabyDOB = strings.TrimSpace(c.BabyDOB)
+	c.ReferrerEmail = strings.ToLower(strings.TrimSpace(c.ReferrerEmail))
+}
+
+// Validate - check every field of the client and report all failures at once
+func (c *Client) Validate() error {
+	errs := ValidationErrors{}
+	if c.Status != "" && !knownStatus(c.Status) {
+		errs["status"] = "unknown status " + c.Status
+	}
+	if c.ClientName == "" {
+		errs["clientName"] = "is required"
+	}
+	if c.ClientEmail == "" {
+		errs["clientEmail"] = "is required"
+	} else if !govalidator.IsEmail(c.ClientEmail) {
+		errs["clientEmail"] = "is not a valid email address"
+	}
+	if c.SIN != "" && !validSIN(c.SIN) {
+		errs["sin"] = "is not a valid social insurance number"
+	}
+	if c.ClientDOB == "" {
+		errs["clientDOB"] = "is required"
+	} else if dob, err := time.Parse(dateLayout, c.ClientDOB); err != nil {
+		errs["clientDOB"] = "must be formatted as MM-DD-YYYY"
+	} else if dob.After(time.Now()) {
+		errs["clientDOB"] = "cannot be in the future"
+	}
+	// babyDOB may be an expected due date so future dates are allowed
+	if c.BabyDOB != "" {
+		if _, err := time.Parse(dateLayout, c.BabyDOB); err != nil {
+			errs["babyDOB"] = "must be formatted as MM-DD-YYYY"
+		}
+	}
+	if c.ClientIncome < 0 {
+		errs["clientIncome"] = "cannot be negative"
+	}
+	for key := range c.DemographicInfo {
+		if !knownDemographics[key] {
+			errs["demographicInfo"] = "unknown key " + key
+			break
+		}
+	}
+	if c.ReferrerEmail != "" && !govalidator.IsEmail(c.ReferrerEmail) {
+		errs["referrerEmail"] = "is not a valid email address"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate - check the appointment is attached to a client and came from a known event
+func (a *Appointment) Validate() error {
+	errs := ValidationErrors{}
+	if !a.ClientID.Valid() {
+		errs["clientID"] = "is not a valid mongo ID"
+	}
+	if a.StartTime.IsZero() {
+		errs["startTime"] = "is required"
+	}
+	if a.EndTime.Before(a.StartTime) {
+		errs["endTime"] = "must not be before startTime"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validSIN - a SIN is nine digits passing the Luhn checksum
+func validSIN(sin string) bool {
+	if len(sin) != 9 {
+		return false
+	}
+	sum := 0
+	for i, r := range sin {
+		if r < '0' || r > '9' {
+			return false
+		}
+		d := int(r - '0')
+		// double every second digit and add the digits of the product
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidSIN(t *testing.T) {
+	cases := map[string]bool{
+		"046454286":  true,
+		"130692544":  true,
+		"046454287":  false,
+		"04645428":   false,
+		"0464542860": false,
+		"04645428a":  false,
+		"":           false,
+	}
+	for sin, want := range cases {
+		if got := validSIN(sin); got != want {
+			t.Errorf("validSIN(%q) = %v, want %v", sin, got, want)
+		}
+	}
+}
+
+func TestClientNormalize(t *testing.T) {
+	c := Client{
+		ClientName:    "  Ann Smith ",
+		ClientEmail:   " Ann@Example.COM ",
+		SIN:           "046-454 286",
+		ReferrerEmail: " Rita@Agency.ORG",
+	}
+	c.normalize()
+	if c.ClientName != "Ann Smith" {
+		t.Errorf("clientName = %q", c.ClientName)
+	}
+	if c.ClientEmail != "ann@example.com" {
+		t.Errorf("clientEmail = %q", c.ClientEmail)
+	}
+	if c.SIN != "046454286" {
+		t.Errorf("sin = %q", c.SIN)
+	}
+	if c.ReferrerEmail != "rita@agency.org" {
+		t.Errorf("referrerEmail = %q", c.ReferrerEmail)
+	}
+}
+
+func TestClientValidate(t *testing.T) {
+	valid := func() Client {
+		return Client{
+			ClientName:  "Ann Smith",
+			ClientEmail: "ann@example.com",
+			ClientDOB:   "07-13-1995",
+		}
+	}
+	c := valid()
+	if err := c.Validate(); err != nil {
+		t.Fatalf("valid client failed validation: %v", err)
+	}
+
+	cases := []struct {
+		field  string
+		mutate func(c *Client)
+	}{
+		{"clientName", func(c *Client) { c.ClientName = "" }},
+		{"clientEmail", func(c *Client) { c.ClientEmail = "" }},
+		{"clientEmail", func(c *Client) { c.ClientEmail = "not an email" }},
+		{"sin", func(c *Client) { c.SIN = "123456789" }},
+		{"clientDOB", func(c *Client) { c.ClientDOB = "" }},
+		{"clientDOB", func(c *Client) { c.ClientDOB = "1995-07-13" }},
+		{"clientDOB", func(c *Client) { c.ClientDOB = time.Now().AddDate(1, 0, 0).Format(dateLayout) }},
+		{"babyDOB", func(c *Client) { c.BabyDOB = "13-07-2019" }},
+		{"clientIncome", func(c *Client) { c.ClientIncome = -1 }},
+		{"demographicInfo", func(c *Client) { c.DemographicInfo = map[string]bool{"unknown": true} }},
+		{"referrerEmail", func(c *Client) { c.ReferrerEmail = "rita" }},
+		{"status", func(c *Client) { c.Status = "LOST" }},
+	}
+	for _, tc := range cases {
+		c := valid()
+		tc.mutate(&c)
+		err := c.Validate()
+		errs, ok := err.(ValidationErrors)
+		if !ok {
+			t.Errorf("%s: expected ValidationErrors, got %v", tc.field, err)
+			continue
+		}
+		if _, ok := errs[tc.field]; !ok || len(errs) != 1 {
+			t.Errorf("%s: expected only that field to fail, got %v", tc.field, errs)
+		}
+	}
+
+	// a due date in the future is allowed for babyDOB
+	c = valid()
+	c.BabyDOB = time.Now().AddDate(0, 3, 0).Format(dateLayout)
+	if err := c.Validate(); err != nil {
+		t.Errorf("future babyDOB rejected: %v", err)
+	}
+}
+
+func TestClientValidateReportsEveryField(t *testing.T) {
+	c := Client{}
+	errs, ok := c.Validate().(ValidationErrors)
+	if !ok {
+		t.Fatal("expected ValidationErrors")
+	}
+	for _, field := range []string{"clientName", "clientEmail", "clientDOB"} {
+		if _, ok := errs[field]; !ok {
+			t.Errorf("missing %s in %v", field, errs)
+		}
+	}
+}
+
+func TestAppointmentValidate(t *testing.T) {
+	now := time.Now()
+	apt := Appointment{StartTime: now, EndTime: now.Add(-time.Minute)}
+	errs, ok := apt.Validate().(ValidationErrors)
+	if !ok {
+		t.Fatal("expected ValidationErrors")
+	}
+	for _, field := range []string{"clientID", "endTime"} {
+		if _, ok := errs[field]; !ok {
+			t.Errorf("missing %s in %v", field, errs)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// encrypted values look like enc:v1:<key id>:<base64 nonce+ciphertext>
+const encryptedPrefix = "enc:v1:"
+
+// client fields encrypted at rest
+var encryptedClientFields = []string{"sin", "clientDOB", "babyDOB"}
+
+// fieldCipher - AES-GCM encryption of single field values plus a keyed blind index for lookups
+type fieldCipher struct {
+	primary  string
+	keys     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+// loadFieldCipher - read ENCRYPTION_KEYS ("id:base64key,..." newest first) and BLIND_INDEX_KEY (base64)
+func loadFieldCipher() (*fieldCipher, error) {
+	viper.AutomaticEnv()
+	keyList := cast.ToString(viper.Get("encryption_keys"))
+	if keyList == "" {
+		return nil, errors.New("encryption_keys is not configured")
+	}
+	fc := &fieldCipher{keys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(keyList, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("encryption_keys entries must be id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %s must be 32 bytes base64 encoded", parts[0])
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		// the first key encrypts new values, the rest only decrypt old ones
+		if fc.primary == "" {
+			fc.primary = parts[0]
+		}
+		fc.keys[parts[0]] = aead
+	}
+	indexKey, err := base64.StdEncoding.DecodeString(cast.ToString(viper.Get("blind_index_key")))
+	if err != nil || len(indexKey) < 32 {
+		return nil, errors.New("blind_index_key must be at least 32 bytes base64 encoded")
+	}
+	fc.indexKey = indexKey
+	return fc, nil
+}
+
+// Encrypt - seal a value with the primary key; empty values stay empty
+func (f *fieldCipher) Encrypt(plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	aead := f.keys[f.primary]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(f.primary))
+	return encryptedPrefix + f.primary + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt - open a value sealed by any configured key; values stored before encryption pass through
+func (f *fieldCipher) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("malformed encrypted value")
+	}
+	aead, ok := f.keys[parts[0]]
+	if !ok {
+		return "", errors.New("no encryption key configured with id " + parts[0])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(parts[0]))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// needsRekey - whether a stored value is plaintext or sealed with a key other than the primary
+func (f *fieldCipher) needsRekey(value string) bool {
+	return value != "" && !strings.HasPrefix(value, encryptedPrefix+f.primary+":")
+}
+
+// BlindIndex - a keyed hash so equal values can be found without storing them in the clear
+func (f *fieldCipher) BlindIndex(field string, value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, f.indexKey)
+	mac.Write([]byte(field + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sealClient - the client as stored: sensitive fields encrypted and the SIN blind index set
+func (f *fieldCipher) sealClient(c Client) (Client, error) {
+	var err error
+	c.SINHash = f.BlindIndex("sin", c.SIN)
+	c.SIN, err = f.Encrypt(c.SIN)
+	if err != nil {
+		return c, err
+	}
+	c.ClientDOB, err = f.Encrypt(c.ClientDOB)
+	if err != nil {
+		return c, err
+	}
+	c.BabyDOB, err = f.Encrypt(c.BabyDOB)
+	return c, err
+}
+
+// openClient - the client as the API sees it, with sensitive fields decrypted
+func (f *fieldCipher) openClient(c Client) (Client, error) {
+	var err error
+	c.SIN, err = f.Decrypt(c.SIN)
+	if err != nil {
+		return c, err
+	}
+	c.ClientDOB, err = f.Decrypt(c.ClientDOB)
+	if err != nil {
+		return c, err
+	}
+	c.BabyDOB, err = f.Decrypt(c.BabyDOB)
+	return c, err
+}
+
+// rekeyClients - re-encrypt every sensitive field not already sealed with the primary key
+// and refresh the SIN blind index; plaintext left over from before encryption is sealed too
+func rekeyClients(db *mgo.Database, f *fieldCipher) (int, error) {
+	updated := 0
+	iter := db.C(clientsConnection).Find(nil).Iter()
+	for {
+		var doc bson.M
+		if !iter.Next(&doc) {
+			break
+		}
+		set := bson.M{}
+		for _, field := range encryptedClientFields {
+			value := cast.ToString(doc[field])
+			plain, err := f.Decrypt(value)
+			if err != nil {
+				iter.Close()
+				return updated, fmt.Errorf("client %v %s: %v", doc["_id"], field, err)
+			}
+			if field == "sin" {
+				hash := f.BlindIndex("sin", plain)
+				if hash != cast.ToString(doc["sinHash"]) && hash != "" {
+					set["sinHash"] = hash
+				}
+			}
+			if !f.needsRekey(value) {
+				continue
+			}
+			sealed, err := f.Encrypt(plain)
+			if err != nil {
+				iter.Close()
+				return updated, err
+			}
+			set[field] = sealed
+		}
+		if len(set) == 0 {
+			continue
+		}
+		err := db.C(clientsConnection).UpdateId(doc["_id"], bson.M{"$set": set})
+		if err != nil {
+			iter.Close()
+			return updated, err
+		}
+		updated++
+	}
+	return updated, iter.Close()
+}
+
+// runRekey - the `api rekey` subcommand, run after putting a new key first in ENCRYPTION_KEYS
+func runRekey() error {
+	f, err := loadFieldCipher()
+	if err != nil {
+		return err
+	}
+	conn, err := dialMongo()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	session := conn.session.Copy()
+	defer session.Close()
+	updated, err := rekeyClients(session.DB(conn.database), f)
+	fmt.Printf("re-encrypted %d clients with key %s\n", updated, f.primary)
+	return err
+}
+
+// decryptClients - write every sensitive field back as plaintext, used to roll back encryption
+func decryptClients(db *mgo.Database, f *fieldCipher) error {
+	iter := db.C(clientsConnection).Find(nil).Iter()
+	for {
+		var doc bson.M
+		if !iter.Next(&doc) {
+			break
+		}
+		set := bson.M{}
+		for _, field := range encryptedClientFields {
+			value := cast.ToString(doc[field])
+			if !strings.HasPrefix(value, encryptedPrefix) {
+				continue
+			}
+			plain, err := f.Decrypt(value)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			set[field] = plain
+		}
+		if len(set) == 0 {
+			continue
+		}
+		err := db.C(clientsConnection).UpdateId(doc["_id"], bson.M{"$set": set})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+)
+
+var (
+	oldTestKey   = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("o", 32)))
+	newTestKey   = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("n", 32)))
+	testIndexKey = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("i", 32)))
+)
+
+// testCipher - a field cipher loaded from the environment the way the api loads it
+func testCipher(t *testing.T, keys string) *fieldCipher {
+	t.Helper()
+	os.Setenv("ENCRYPTION_KEYS", keys)
+	os.Setenv("BLIND_INDEX_KEY", testIndexKey)
+	defer os.Unsetenv("ENCRYPTION_KEYS")
+	defer os.Unsetenv("BLIND_INDEX_KEY")
+	f, err := loadFieldCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestLoadFieldCipherRejectsBadKeys(t *testing.T) {
+	defer os.Unsetenv("ENCRYPTION_KEYS")
+	defer os.Unsetenv("BLIND_INDEX_KEY")
+	os.Setenv("BLIND_INDEX_KEY", testIndexKey)
+	for _, keys := range []string{"", "k1", "k1:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		os.Setenv("ENCRYPTION_KEYS", keys)
+		if _, err := loadFieldCipher(); err == nil {
+			t.Errorf("accepted ENCRYPTION_KEYS %q", keys)
+		}
+	}
+	os.Setenv("ENCRYPTION_KEYS", "k1:"+newTestKey)
+	os.Setenv("BLIND_INDEX_KEY", "")
+	if _, err := loadFieldCipher(); err == nil {
+		t.Error("accepted a missing blind index key")
+	}
+}
+
+func TestFieldCipherRoundTrip(t *testing.T) {
+	f := testCipher(t, "k1:"+newTestKey)
+	a, err := f.Encrypt("046 454 286")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := f.Encrypt("046 454 286")
+	if !strings.HasPrefix(a, "enc:v1:k1:") || strings.Contains(a, "046") || a == b {
+		t.Errorf("expected distinct sealed values, got %s and %s", a, b)
+	}
+	plain, err := f.Decrypt(a)
+	if err != nil || plain != "046 454 286" {
+		t.Errorf("decrypted to %q %v", plain, err)
+	}
+	if empty, _ := f.Encrypt(""); empty != "" {
+		t.Errorf("an empty value should stay empty, got %s", empty)
+	}
+	// values stored before encryption was turned on are read as they are
+	if plain, _ := f.Decrypt("07-13-1995"); plain != "07-13-1995" {
+		t.Errorf("plaintext came back as %s", plain)
+	}
+
+	tampered := a[:len(a)-4] + "AAA="
+	if _, err := f.Decrypt(tampered); err == nil {
+		t.Error("a tampered value decrypted")
+	}
+}
+
+func TestFieldCipherKeyRotation(t *testing.T) {
+	old := testCipher(t, "k1:"+oldTestKey)
+	sealed, _ := old.Encrypt("07-13-1995")
+
+	rotated := testCipher(t, "k2:"+newTestKey+",k1:"+oldTestKey)
+	plain, err := rotated.Decrypt(sealed)
+	if err != nil || plain != "07-13-1995" {
+		t.Fatalf("the old key no longer decrypts: %q %v", plain, err)
+	}
+	if !rotated.needsRekey(sealed) || !rotated.needsRekey("07-13-1995") || rotated.needsRekey("") {
+		t.Error("values sealed with an old key or not at all should need a rekey")
+	}
+	resealed, _ := rotated.Encrypt(plain)
+	if rotated.needsRekey(resealed) {
+		t.Error("a value sealed with the primary key should not need a rekey")
+	}
+
+	dropped := testCipher(t, "k2:"+newTestKey)
+	if _, err := dropped.Decrypt(sealed); err == nil {
+		t.Error("decrypted with a key that is no longer configured")
+	}
+}
+
+func TestSealClient(t *testing.T) {
+	f := testCipher(t, "k1:"+newTestKey)
+	c := Client{ClientName: "Ann Smith", SIN: "046454286", ClientDOB: "07-13-1995"}
+	sealed, err := f.sealClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.SIN == c.SIN || sealed.ClientDOB == c.ClientDOB || sealed.ClientName != c.ClientName {
+		t.Errorf("unexpected sealed client %+v", sealed)
+	}
+	// the blind index finds the same sin again without the key that encrypts it, and is specific to the field
+	if sealed.SINHash == "" || sealed.SINHash != f.BlindIndex("sin", "046454286") || sealed.SINHash == f.BlindIndex("clientDOB", "046454286") {
+		t.Errorf("unexpected blind index %s", sealed.SINHash)
+	}
+	opened, err := f.openClient(sealed)
+	if err != nil || opened.SIN != c.SIN || opened.ClientDOB != c.ClientDOB {
+		t.Errorf("opened to %+v %v", opened, err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+	"github.com/spf13/cast"
+)
+
+// server - the HTTP handlers and the stores they read and write
+type server struct {
+	stores
+	// inboxWake - nudges the inbox worker when a delivery arrives
+	inboxWake chan struct{}
+	// outboxWake - nudges the outbox worker when an email is queued
+	outboxWake chan struct{}
+	mailer     Mailer
+}
+
+func newServer(st stores, mailer Mailer) *server {
+	return &server{
+		stores:     st,
+		inboxWake:  make(chan struct{}, 1),
+		outboxWake: make(chan struct{}, 1),
+		mailer:     mailer,
+	}
+}
+
+// routes - register every endpoint on the echo app
+func (s *server) routes(app *echo.Echo, auth echo.MiddlewareFunc) {
+	// calendly keeps the original route its subscription points at
+	app.POST("/appointment_webhook", s.providerWebhook(calendlyProvider{}))
+	app.POST("/calcom_webhook", s.providerWebhook(calcomProvider{}))
+	app.POST("/mailgun_webhook", s.mailgunWebhook)
+	app.POST("/clients", s.createClient, auth)
+	app.PATCH("/clients/:id", s.updateClient, auth)
+	app.GET("/clients_by_status/:status", s.clientsByStatus, auth)
+	app.GET("/clients/:id", s.getClient, auth)
+	app.GET("/clients/:id/history", s.clientHistory, auth)
+	app.GET("/clients/:id/messages", s.clientMessages, auth)
+	app.GET("/appointments_by_clientid/:clientID", s.appointmentsByClientID, auth)
+	app.GET("/appointments/:id", s.getAppointment, auth)
+	app.POST("/appointments/:id/attendance", s.markAttendance, auth)
+	app.GET("/search", s.search, auth)
+	app.GET("/unmatched_appointments", s.unmatchedAppointments, auth)
+	app.POST("/unmatched_appointments/:id/attach", s.attachUnmatchedAppointment, auth)
+	app.GET("/webhook_deliveries", s.webhookDeliveries, auth)
+	app.POST("/webhook_deliveries/:id/replay", s.replayWebhookDelivery, auth)
+	app.GET("/messages", s.outboxMessages, auth)
+	app.POST("/messages/:id/retry", s.retryMessage, auth)
+	app.GET("/pickup_locations", s.pickupLocations, auth)
+	app.POST("/pickup_locations", s.savePickupLocation, auth)
+	app.PUT("/pickup_locations/:id", s.savePickupLocation, auth)
+	app.GET("/calendar_feeds", s.calendarFeeds, auth)
+	app.POST("/calendar_feeds", s.createCalendarFeed, auth)
+	app.DELETE("/calendar_feeds/:id", s.deleteCalendarFeed, auth)
+	app.GET("/email_templates", s.emailTemplates, auth)
+	app.POST("/email_templates/:name", s.saveEmailTemplate, auth)
+	app.GET("/notification_settings", s.notificationSettings, auth)
+	app.PUT("/notification_settings", s.saveNotificationSettings, auth)
+	// calendar apps subscribe with the token in the url
+	app.GET("/calendar/:token", s.calendarICS)
+	// families book with the token from their approval email instead of an auth0 login
+	app.GET("/booking/slots", s.bookingSlots, s.bookingAuth)
+	app.GET("/booking/appointments", s.bookingAppointments, s.bookingAuth)
+	app.POST("/booking/appointments", s.bookAppointment, s.bookingAuth)
+	app.POST("/booking/appointments/:id/reschedule", s.rescheduleAppointment, s.bookingAuth)
+	app.DELETE("/booking/appointments/:id", s.cancelBooking, s.bookingAuth)
+}
+
+func (s *server) createClient(ctx echo.Context) error {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(ctx.Request().Body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	data := buf.Bytes()
+
+	var c Client
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+
+	c.clearServerFields()
+	c.normalize()
+	err = c.Validate()
+	if err != nil {
+		return validationError(ctx, err)
+	}
+
+	_, err = s.clients.FindByEmail(c.ClientEmail)
+	if err == nil {
+		m := echo.Map{}
+		m["error"] = "cannot add client as already exists"
+		return ctx.JSON(400, m)
+	}
+	if c.SIN != "" {
+		_, err = s.clients.FindBySIN(c.SIN)
+		if err == nil {
+			m := echo.Map{}
+			m["error"] = "cannot add client as already exists"
+			return ctx.JSON(400, m)
+		}
+	}
+
+	c.ID = bson.NewObjectId()
+	c.DateCreated = time.Now()
+	c.Status = StatusPending
+
+	staged, err := s.stageNotifications(c, "", EventReceived, "")
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	err = s.clients.Save(c)
+	if err != nil {
+		s.discardEmails(staged)
+	}
+	if mgo.IsDup(err) {
+		// a concurrent request inserted the same email or sin first
+		m := echo.Map{}
+		m["error"] = "cannot add client as already exists"
+		return ctx.JSON(400, m)
+	}
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	s.audit(actorFrom(ctx), "client.create", c.ID, nil, c)
+	s.releaseEmails(staged)
+	return ctx.JSON(http.StatusOK, policyFor(ctx).client(c))
+}
+
+func (s *server) updateClient(ctx echo.Context) error {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(ctx.Request().Body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	data := buf.Bytes()
+
+	var c echo.Map
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+
+	id := ctx.Param("id")
+	client, err := s.clients.FindByID(id)
+	if err == mgo.ErrNotFound {
+		m := echo.Map{}
+		m["error"] = "client not found"
+		return ctx.JSON(404, m)
+	}
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+
+	// only handle status changes for now, with the reason staff gave for the decision if any
+	status := cast.ToString(c["status"])
+	reason := strings.TrimSpace(cast.ToString(c["reason"]))
+	client, err = s.transitionBecause(actorFrom(ctx), client, status, reason)
+	switch err.(type) {
+	case nil:
+		return ctx.JSON(200, policyFor(ctx).client(client))
+	case ValidationErrors:
+		return validationError(ctx, err)
+	case TransitionError:
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(http.StatusConflict, m)
+	}
+	if err == errStatusChanged {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(http.StatusConflict, m)
+	}
+	m := echo.Map{}
+	m["error"] = err.Error()
+	return ctx.JSON(500, m)
+}
+
+func (s *server) clientsByStatus(ctx echo.Context) error {
+	q, err := parseClientQuery(ctx)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	q.Status = ctx.Param("status")
+	page, err := s.clients.List(q)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	return ctx.JSON(http.StatusOK, policyFor(ctx).page(page.Data, page.NextCursor))
+}
+
+func (s *server) getClient(ctx echo.Context) error {
+	id := ctx.Param("id")
+	c, err := s.clients.FindByID(id)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	return ctx.JSON(http.StatusOK, policyFor(ctx).client(c))
+}
+
+func (s *server) appointmentsByClientID(ctx echo.Context) error {
+	clientID := ctx.Param("clientID")
+	apt, err := s.appointments.FindByClientID(clientID)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	return ctx.JSON(http.StatusOK, policyFor(ctx).appointments(apt))
+}
+
+func (s *server) getAppointment(ctx echo.Context) error {
+	id := ctx.Param("id")
+	apt, err := s.appointments.FindByID(id)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(http.StatusOK, policyFor(ctx).appointment(apt))
+}
+
+func (s *server) search(ctx echo.Context) error {
+	q, err := parseSearchQuery(ctx)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	results, err := s.clients.Search(q)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(http.StatusOK, policyFor(ctx).page(results.Data, results.NextCursor))
+}
+
+// validationError - respond with 422 and the failing fields so forms can highlight them
+func validationError(ctx echo.Context, err error) error {
+	m := echo.Map{}
+	m["error"] = err.Error()
+	if fields, ok := err.(ValidationErrors); ok {
+		m["error"] = "validation failed"
+		m["fields"] = fields
+	}
+	return ctx.JSON(http.StatusUnprocessableEntity, m)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+)
+
+// recordingMailer - a Mailer that keeps every email instead of sending it
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []outgoingEmail
+	err  error
+}
+
+func (m *recordingMailer) Send(e outgoingEmail) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return "", m.err
+	}
+	m.sent = append(m.sent, e)
+	return "<" + bson.NewObjectId().Hex() + "@test>", nil
+}
+
+func (m *recordingMailer) emails() []outgoingEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]outgoingEmail{}, m.sent...)
+}
+
+// testAPI - a server on the memory stores with every route registered; requests carry the roles in X-Roles
+type testAPI struct {
+	*server
+	app    *echo.Echo
+	mailer *recordingMailer
+}
+
+func newTestAPI() *testAPI {
+	mailer := &recordingMailer{}
+	s := newServer(newMemoryStores(), mailer)
+	app := echo.New()
+	s.routes(app, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			ctx.Set(actorSubjectKey, "auth0|staff")
+			ctx.Set(actorRolesKey, strings.Split(ctx.Request().Header.Get("X-Roles"), ","))
+			return next(ctx)
+		}
+	})
+	return &testAPI{server: s, app: app, mailer: mailer}
+}
+
+// call - make a request as an admin unless roles are given
+func (a *testAPI) call(method string, path string, body string, roles ...string) *httptest.ResponseRecorder {
+	if len(roles) == 0 {
+		roles = []string{RoleAdmin}
+	}
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("X-Roles", strings.Join(roles, ","))
+	rec := httptest.NewRecorder()
+	a.app.ServeHTTP(rec, req)
+	return rec
+}
+
+// createClient - post a valid client and return it as the api saw it
+func (a *testAPI) createClient(t *testing.T, name string, email string) Client {
+	t.Helper()
+	rec := a.call("POST", "/clients", `{"clientName":"`+name+`","clientEmail":"`+email+`","clientDOB":"07-13-1995","referrerName":"Rita","referrerEmail":"rita@agency.org"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create %s: %d %s", name, rec.Code, rec.Body)
+	}
+	var c Client
+	decode(t, rec, &c)
+	return c
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	err := json.Unmarshal(rec.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body, err)
+	}
+}
+
+func TestCreateClient(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", " Ann@Example.com ")
+	if !c.ID.Valid() || c.Status != StatusPending || c.ClientEmail != "ann@example.com" {
+		t.Fatalf("unexpected client %+v", c)
+	}
+	saved, err := api.clients.FindByID(c.ID.Hex())
+	if err != nil || saved.ClientName != "Ann Smith" {
+		t.Fatalf("client not saved: %+v %v", saved, err)
+	}
+
+	rec := api.call("POST", "/clients", `{"clientName":"Ann Again","clientEmail":"ann@example.com","clientDOB":"07-13-1995"}`)
+	if rec.Code != 400 {
+		t.Errorf("duplicate email: got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = api.call("POST", "/clients", `{"clientEmail":"nobody"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid client: got %d %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Fields map[string]string `json:"fields"`
+	}
+	decode(t, rec, &body)
+	for _, field := range []string{"clientName", "clientEmail", "clientDOB"} {
+		if body.Fields[field] == "" {
+			t.Errorf("no error for %s in %s", field, rec.Body)
+		}
+	}
+
+	entries, err := api.auditLog.FindByClientID(c.ID.Hex())
+	if err != nil || len(entries) != 1 || entries[0].Action != "client.create" {
+		t.Errorf("expected one client.create audit entry, got %+v %v", entries, err)
+	}
+}
+
+func TestUpdateClientStatus(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+
+	rec := api.call("PATCH", "/clients/"+c.ID.Hex(), `{"status":"APPROVED"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", rec.Code, rec.Body)
+	}
+	saved, _ := api.clients.FindByID(c.ID.Hex())
+	if saved.Status != StatusApproved {
+		t.Errorf("status = %s", saved.Status)
+	}
+
+	rec = api.call("PATCH", "/clients/"+c.ID.Hex(), `{"status":"DECLINED"}`)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("APPROVED to DECLINED: got %d %s", rec.Code, rec.Body)
+	}
+	rec = api.call("PATCH", "/clients/"+c.ID.Hex(), `{"status":"LOST"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unknown status: got %d %s", rec.Code, rec.Body)
+	}
+	rec = api.call("PATCH", "/clients/not-an-id", `{"status":"APPROVED"}`)
+	if rec.Code != 400 {
+		t.Errorf("bad id: got %d %s", rec.Code, rec.Body)
+	}
+
+	saved, _ = api.clients.FindByID(c.ID.Hex())
+	if saved.Status != StatusApproved {
+		t.Errorf("rejected changes moved the client to %s", saved.Status)
+	}
+}
+
+func TestListClientsByStatus(t *testing.T) {
+	api := newTestAPI()
+	ann := api.createClient(t, "Ann Smith", "ann@example.com")
+	api.createClient(t, "Bea Jones", "bea@example.com")
+	api.createClient(t, "Cal Brown", "cal@example.com")
+	api.call("PATCH", "/clients/"+ann.ID.Hex(), `{"status":"APPROVED"}`)
+
+	var page struct {
+		Data       []map[string]interface{} `json:"data"`
+		NextCursor string                   `json:"nextCursor"`
+	}
+	rec := api.call("GET", "/clients_by_status/PENDING", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list: %d %s", rec.Code, rec.Body)
+	}
+	decode(t, rec, &page)
+	if len(page.Data) != 2 || page.NextCursor != "" {
+		t.Fatalf("expected the two pending clients on one page, got %s", rec.Body)
+	}
+	for _, c := range page.Data {
+		if c["status"] != StatusPending {
+			t.Errorf("listed a %v client", c["status"])
+		}
+	}
+
+	// volunteers only get the fields their policy allows
+	rec = api.call("GET", "/clients_by_status/APPROVED", "", RoleVolunteer)
+	page.Data = nil
+	decode(t, rec, &page)
+	if len(page.Data) != 1 {
+		t.Fatalf("expected one approved client, got %s", rec.Body)
+	}
+	if _, ok := page.Data[0]["clientEmail"]; ok {
+		t.Errorf("volunteer saw clientEmail: %s", rec.Body)
+	}
+	if page.Data[0]["clientName"] != "Ann Smith" {
+		t.Errorf("volunteer did not get clientName: %s", rec.Body)
+	}
+}
+
+func TestGetClient(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	var got Client
+	rec := api.call("GET", "/clients/"+c.ID.Hex(), "")
+	decode(t, rec, &got)
+	if rec.Code != http.StatusOK || got.ID != c.ID || got.ClientName != "Ann Smith" {
+		t.Errorf("get: %d %s", rec.Code, rec.Body)
+	}
+	rec = api.call("GET", "/clients/not-an-id", "")
+	if rec.Code != 400 {
+		t.Errorf("bad id: got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCreateClientIgnoresServerFields(t *testing.T) {
+	api := newTestAPI()
+	other := api.createClient(t, "Bea Jones", "bea@example.com")
+	rec := api.call("POST", "/clients", `{
+		"_id": "5c1b7a5e8f1e4a2b3c4d5e6f",
+		"dateCreated": "2001-01-01T00:00:00Z",
+		"status": "APPROVED",
+		"statusReason": "preapproved",
+		"clientName": "Ann Smith",
+		"clientEmail": "ann@example.com",
+		"emailAliases": ["bea@example.com"],
+		"emailIssue": "bounced",
+		"emailIssueAt": "2001-01-01T00:00:00Z",
+		"clientDOB": "07-13-1995"
+	}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	var c Client
+	decode(t, rec, &c)
+	saved, err := api.clients.FindByID(c.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.ID.Hex() == "5c1b7a5e8f1e4a2b3c4d5e6f" || saved.DateCreated.Year() == 2001 {
+		t.Errorf("caller chose the id or creation date: %+v", saved)
+	}
+	if saved.Status != StatusPending || saved.StatusReason != "" {
+		t.Errorf("caller chose the status: %s %q", saved.Status, saved.StatusReason)
+	}
+	if len(saved.EmailAliases) != 0 || saved.EmailIssue != "" || !saved.EmailIssueAt.IsZero() {
+		t.Errorf("caller set server fields: %+v", saved)
+	}
+	found, err := api.clients.FindByEmail("bea@example.com")
+	if err != nil || found.ID != other.ID {
+		t.Errorf("bea@example.com now finds %+v %v", found, err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const icsTimeLayout = "20060102T150405Z"
+
+// icsCalendar - an RFC 5545 calendar built up one event at a time
+type icsCalendar struct {
+	buf bytes.Buffer
+}
+
+func newICS(name string) *icsCalendar {
+	cal := &icsCalendar{}
+	cal.line("BEGIN:VCALENDAR")
+	cal.line("VERSION:2.0")
+	cal.line("PRODID:-//Modern Baby//api//EN")
+	cal.line("CALSCALE:GREGORIAN")
+	cal.line("METHOD:PUBLISH")
+	cal.line("X-WR-CALNAME:" + icsEscape(name))
+	return cal
+}
+
+// event - the appointment as a VEVENT; its id is the uid so calendar apps update rather than duplicate it
+func (cal *icsCalendar) event(apt Appointment, client Client, now time.Time) {
+	name := client.ClientName
+	if name == "" {
+		name = apt.InviteeName
+	}
+	phone := apt.Phone
+	if phone == "" {
+		phone = client.ClientPhone
+	}
+	summary := name
+	if apt.EventTypeName != "" {
+		summary += " - " + apt.EventTypeName
+	}
+	description := []string{"Client: " + name}
+	if phone != "" {
+		description = append(description, "Phone: "+phone)
+	}
+	for _, a := range apt.OtherAnswers {
+		description = append(description, a.Question+": "+a.Answer)
+	}
+	if apt.Status == AppointmentCanceled && apt.CancelReason != "" {
+		description = append(description, "Canceled: "+apt.CancelReason)
+	}
+
+	cal.line("BEGIN:VEVENT")
+	cal.line("UID:" + apt.ID.Hex() + "@modernbaby.online")
+	cal.line("DTSTAMP:" + now.UTC().Format(icsTimeLayout))
+	cal.line("DTSTART:" + apt.StartTime.UTC().Format(icsTimeLayout))
+	cal.line("DTEND:" + apt.EndTime.UTC().Format(icsTimeLayout))
+	cal.line("SUMMARY:" + icsEscape(summary))
+	if apt.Location != "" {
+		cal.line("LOCATION:" + icsEscape(apt.Location))
+	}
+	cal.line("DESCRIPTION:" + icsEscape(strings.Join(description, "\n")))
+	if apt.Status == AppointmentCanceled {
+		cal.line("STATUS:CANCELLED")
+		// a higher sequence tells subscribers the cancellation supersedes the booking they already have
+		cal.line("SEQUENCE:1")
+	} else {
+		cal.line("STATUS:CONFIRMED")
+		cal.line("SEQUENCE:0")
+	}
+	cal.line("END:VEVENT")
+}
+
+func (cal *icsCalendar) bytes() []byte {
+	cal.line("END:VCALENDAR")
+	return cal.buf.Bytes()
+}
+
+// line - write a content line folded at 75 octets without splitting a utf-8 character
+func (cal *icsCalendar) line(s string) {
+	width := 75
+	for len(s) > width {
+		cut := width
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		cal.buf.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+		// continuation lines lose one octet to the leading space
+		width = 74
+	}
+	cal.buf.WriteString(s + "\r\n")
+}
+
+// icsEscape - escape a TEXT value
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// unfold - undo RFC 5545 line folding
+func unfold(ics string) string {
+	return strings.Replace(ics, "\r\n ", "", -1)
+}
+
+func TestICSLineFolding(t *testing.T) {
+	long := "DESCRIPTION:" + strings.Repeat("a", 200)
+	accented := "SUMMARY:" + strings.Repeat("é", 100)
+	cal := &icsCalendar{}
+	cal.line("UID:short")
+	cal.line(long)
+	cal.line(accented)
+	out := cal.buf.String()
+
+	if !strings.HasSuffix(out, "\r\n") {
+		t.Fatalf("content lines must end in CRLF: %q", out)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line is %d octets: %q", len(line), line)
+		}
+		if !utf8.ValidString(line) {
+			t.Errorf("fold split a character: %q", line)
+		}
+	}
+	want := "UID:short\r\n" + long + "\r\n" + accented + "\r\n"
+	if unfold(out) != want {
+		t.Errorf("unfolded to %q", unfold(out))
+	}
+	if strings.Count(cal.buf.String(), "\r\n") != 3+2+2 {
+		t.Errorf("expected the long lines to fold twice each: %q", out)
+	}
+}
+
+func TestICSEscape(t *testing.T) {
+	got := icsEscape("Pickup; bring ID, car seat\\stroller\nthanks")
+	want := `Pickup\; bring ID\, car seat\\stroller\nthanks`
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCalendarFeed(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	start := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Minute)
+	mine := Appointment{ID: bson.NewObjectId(), ClientID: c.ID, Status: AppointmentActive, EventTypeName: "Pickup",
+		StartTime: start, EndTime: start.Add(30 * time.Minute), Location: "Warehouse, 1 Main St",
+		AssignedTo: []AppointmentStaff{{Name: "Sam", Email: "sam@modernbaby.online"}}}
+	other := mine
+	other.ID = bson.NewObjectId()
+	other.AssignedTo = []AppointmentStaff{{Name: "Kim", Email: "kim@modernbaby.online"}}
+	for _, apt := range []Appointment{mine, other} {
+		err := api.appointments.Save(apt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := api.call("POST", "/calendar_feeds", `{"kind":"staff","value":"Sam@ModernBaby.online"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create feed: %d %s", rec.Code, rec.Body)
+	}
+	var created struct {
+		Feed CalendarFeed `json:"feed"`
+		URL  string       `json:"url"`
+	}
+	decode(t, rec, &created)
+	if !strings.HasSuffix(created.URL, "/calendar/"+created.Feed.Token+".ics") {
+		t.Errorf("unexpected url %s", created.URL)
+	}
+
+	rec = api.call("GET", "/calendar/"+created.Feed.Token+".ics", "", "")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/calendar") {
+		t.Fatalf("feed: %d %s", rec.Code, rec.Header())
+	}
+	ics := unfold(rec.Body.String())
+	if !strings.Contains(ics, "UID:"+mine.ID.Hex()+"@modernbaby.online\r\n") {
+		t.Errorf("feed is missing Sam's appointment:\n%s", ics)
+	}
+	if strings.Contains(ics, other.ID.Hex()) {
+		t.Errorf("feed has another staff member's appointment:\n%s", ics)
+	}
+	if !strings.Contains(ics, "SUMMARY:Ann Smith - Pickup\r\n") || !strings.Contains(ics, `LOCATION:Warehouse\, 1 Main St`) {
+		t.Errorf("unexpected event:\n%s", ics)
+	}
+
+	rec = api.call("GET", "/calendar/"+strings.Repeat("0", 48)+".ics", "", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown token: got %d", rec.Code)
+	}
+}
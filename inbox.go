@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+	rollbar "github.com/rollbar/rollbar-go"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+var inboxConnection = "webhook_inbox"
+
+// delivery states: pending and processing ones are picked up by the worker, dead ones wait for a replay
+const (
+	DeliveryPending    = "pending"
+	DeliveryProcessing = "processing"
+	DeliveryDone       = "done"
+	DeliveryDead       = "dead"
+)
+
+// webhook providers a delivery can come from
+const (
+	providerCalendly = "calendly"
+	providerCalcom   = "calcom"
+)
+
+// WebhookDelivery - one raw webhook body, stored before anything is done with it
+type WebhookDelivery struct {
+	ID            bson.ObjectId `json:"_id" bson:"_id"`
+	Provider      string        `json:"provider" bson:"provider"`
+	Body          string        `json:"body" bson:"body"`
+	Status        string        `json:"status" bson:"status"`
+	Attempts      int           `json:"attempts" bson:"attempts"`
+	LastError     string        `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	ReceivedAt    time.Time     `json:"receivedAt" bson:"receivedAt"`
+	NextAttemptAt time.Time     `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	ProcessedAt   time.Time     `json:"processedAt,omitempty" bson:"processedAt,omitempty"`
+}
+
+// InboxStore - persistence for webhook deliveries
+type InboxStore interface {
+	Save(d WebhookDelivery) error
+	Update(d WebhookDelivery) error
+	FindByID(id string) (WebhookDelivery, error)
+	FindByStatus(status string) ([]WebhookDelivery, error)
+	// Claim - take the oldest due delivery and lease it until now+lease so a crashed worker's claim expires
+	Claim(now time.Time, lease time.Duration) (WebhookDelivery, error)
+}
+
+// retrySettings - how a background worker polls, backs off and gives up
+type retrySettings struct {
+	PollInterval time.Duration
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+	MaxAttempts  int
+	Lease        time.Duration
+}
+
+func inboxConfig() retrySettings {
+	viper.AutomaticEnv()
+	viper.SetDefault("inbox_poll_interval", "5s")
+	viper.SetDefault("inbox_backoff", "30s")
+	viper.SetDefault("inbox_max_backoff", "1h")
+	viper.SetDefault("inbox_max_attempts", 8)
+	viper.SetDefault("inbox_lease", "5m")
+	return retrySettings{
+		PollInterval: cast.ToDuration(viper.Get("inbox_poll_interval")),
+		Backoff:      cast.ToDuration(viper.Get("inbox_backoff")),
+		MaxBackoff:   cast.ToDuration(viper.Get("inbox_max_backoff")),
+		MaxAttempts:  cast.ToInt(viper.Get("inbox_max_attempts")),
+		Lease:        cast.ToDuration(viper.Get("inbox_lease")),
+	}
+}
+
+// backoff - the wait before the next attempt, doubling from Backoff up to MaxBackoff
+func (cfg retrySettings) backoff(attempts int) time.Duration {
+	wait := cfg.Backoff
+	for i := 1; i < attempts && wait < cfg.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > cfg.MaxBackoff {
+		wait = cfg.MaxBackoff
+	}
+	return wait
+}
+
+// permanentError - a delivery that retrying can never fix, so it goes straight to the dead letters
+type permanentError struct {
+	error
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// newDelivery - a pending delivery due immediately
+func newDelivery(provider string, body []byte) WebhookDelivery {
+	now := time.Now()
+	return WebhookDelivery{
+		ID:            bson.NewObjectId(),
+		Provider:      provider,
+		Body:          string(body),
+		Status:        DeliveryPending,
+		ReceivedAt:    now,
+		NextAttemptAt: now,
+	}
+}
+
+// enqueue - persist a verified delivery and nudge the worker; only a failed save is an error for the sender
+func (s *server) enqueue(provider string, body []byte) (WebhookDelivery, error) {
+	d := newDelivery(provider, body)
+	err := s.inbox.Save(d)
+	if err != nil {
+		return d, err
+	}
+	select {
+	case s.inboxWake <- struct{}{}:
+	default:
+	}
+	return d, nil
+}
+
+// dispatch - hand a delivery body to its provider's processing
+func (s *server) dispatch(d WebhookDelivery) error {
+	p, ok := schedulingProviders[d.Provider]
+	if !ok {
+		return permanentError{errors.New("unknown webhook provider " + d.Provider)}
+	}
+	return s.processBooking(p, []byte(d.Body))
+}
+
+// deliver - one processing attempt; failures are retried with backoff until they go to the dead letters
+func (s *server) deliver(cfg retrySettings, d WebhookDelivery) WebhookDelivery {
+	d.Attempts++
+	err := s.dispatch(d)
+	now := time.Now()
+	switch {
+	case err == nil:
+		d.Status = DeliveryDone
+		d.LastError = ""
+		d.ProcessedAt = now
+	case isPermanent(err) || d.Attempts >= cfg.MaxAttempts:
+		// a body that can never be processed, or one that has used up its retries
+		d.Status = DeliveryDead
+		d.LastError = err.Error()
+		rollbar.Error(errors.New("webhook delivery " + d.ID.Hex() + " dead-lettered: " + err.Error()))
+	default:
+		d.Status = DeliveryPending
+		d.LastError = err.Error()
+		d.NextAttemptAt = now.Add(cfg.backoff(d.Attempts))
+	}
+	err = s.inbox.Update(d)
+	if err != nil {
+		// the lease runs out and the delivery is claimed again; processing is idempotent
+		rollbar.Error(err)
+	}
+	return d
+}
+
+// drainInbox - process every delivery that is due
+func (s *server) drainInbox(cfg retrySettings) {
+	for {
+		d, err := s.inbox.Claim(time.Now(), cfg.Lease)
+		if err == mgo.ErrNotFound {
+			return
+		}
+		if err != nil {
+			rollbar.Error(err)
+			return
+		}
+		s.deliver(cfg, d)
+	}
+}
+
+// runInbox - the worker: drain on every poll and whenever a delivery arrives
+func (s *server) runInbox() {
+	cfg := inboxConfig()
+	ticker := time.NewTicker(cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		s.drainInbox(cfg)
+		select {
+		case <-ticker.C:
+		case <-s.inboxWake:
+		}
+	}
+}
+
+// replay - put a delivery back to its first attempt and process it now
+func (s *server) replay(d WebhookDelivery) WebhookDelivery {
+	d.Attempts = 0
+	d.NextAttemptAt = time.Now()
+	return s.deliver(inboxConfig(), d)
+}
+
+func (s *server) webhookDeliveries(ctx echo.Context) error {
+	if !hasRole(ctx, RoleAdmin) {
+		m := echo.Map{}
+		m["error"] = "webhook deliveries are only available to admins"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	status := ctx.QueryParam("status")
+	if status == "" {
+		status = DeliveryDead
+	}
+	deliveries, err := s.inbox.FindByStatus(status)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(http.StatusOK, deliveries)
+}
+
+func (s *server) replayWebhookDelivery(ctx echo.Context) error {
+	if !hasRole(ctx, RoleAdmin) {
+		m := echo.Map{}
+		m["error"] = "webhook deliveries are only available to admins"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	d, err := s.inbox.FindByID(ctx.Param("id"))
+	if err == mgo.ErrNotFound {
+		m := echo.Map{}
+		m["error"] = "webhook delivery not found"
+		return ctx.JSON(404, m)
+	}
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	if d.Status == DeliveryDone {
+		m := echo.Map{}
+		m["error"] = "webhook delivery was already processed"
+		return ctx.JSON(http.StatusConflict, m)
+	}
+	return ctx.JSON(http.StatusOK, s.replay(d))
+}
+
+// runInboxCommand - the `api inbox` subcommand for looking at and replaying deliveries
+func runInboxCommand(args []string) error {
+	usage := errors.New("usage: api inbox list [status] | replay <id>... | replay-file <provider> <file>...")
+	if len(args) == 0 {
+		return usage
+	}
+	fields, err := loadFieldCipher()
+	if err != nil {
+		return err
+	}
+	conn, err := dialMongo()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	mailer, err := newMailer(mailerConfig())
+	if err != nil {
+		return err
+	}
+	s := newServer(newMongoStores(conn, fields), mailer)
+
+	switch args[0] {
+	case "list":
+		status := DeliveryDead
+		if len(args) > 1 {
+			status = args[1]
+		}
+		deliveries, err := s.inbox.FindByStatus(status)
+		if err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			fmt.Printf("%s %s %s attempts=%d %s\n", d.ID.Hex(), d.Provider, d.ReceivedAt.Format(time.RFC3339), d.Attempts, d.LastError)
+		}
+		return nil
+	case "replay":
+		for _, id := range args[1:] {
+			d, err := s.inbox.FindByID(id)
+			if err != nil {
+				return errors.New(id + ": " + err.Error())
+			}
+			printDelivery(s.replay(d))
+		}
+		return nil
+	case "replay-file":
+		// a body captured elsewhere, e.g. webhook_fixture.json, goes through the inbox like a real delivery
+		if len(args) < 3 {
+			return usage
+		}
+		for _, path := range args[2:] {
+			body, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			d := newDelivery(args[1], body)
+			err = s.inbox.Save(d)
+			if err != nil {
+				return err
+			}
+			printDelivery(s.replay(d))
+		}
+		return nil
+	}
+	return usage
+}
+
+func printDelivery(d WebhookDelivery) {
+	out := os.Stdout
+	if d.Status != DeliveryDone {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, "%s %s %s\n", d.ID.Hex(), d.Status, d.LastError)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// flakyClients - a ClientStore whose email lookups fail, as they would with the database unreachable
+type flakyClients struct {
+	ClientStore
+}
+
+func (flakyClients) FindByEmail(email string) (Client, error) {
+	return Client{}, errors.New("no reachable servers")
+}
+
+func TestDeliverRetriesThenDeadLetters(t *testing.T) {
+	api := newTestAPI()
+	body, _, c := calendlyFixture(t, api)
+	clients := api.clients
+	api.clients = flakyClients{clients}
+
+	d, err := api.enqueue(providerCalendly, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	d = api.deliver(testRetries, d)
+	if d.Status != DeliveryPending || d.Attempts != 1 || d.LastError != "no reachable servers" {
+		t.Fatalf("a failed delivery should be retried, got %+v", d)
+	}
+	if d.NextAttemptAt.Before(before.Add(testRetries.Backoff)) {
+		t.Errorf("retried without backing off: %s", d.NextAttemptAt)
+	}
+	// not due yet, so the worker leaves it
+	api.drainInbox(testRetries)
+	saved, _ := api.inbox.FindByID(d.ID.Hex())
+	if saved.Attempts != 1 {
+		t.Errorf("a delivery was retried before it was due: %+v", saved)
+	}
+
+	d = api.deliver(testRetries, d)
+	d = api.deliver(testRetries, d)
+	if d.Status != DeliveryDead || d.Attempts != 3 {
+		t.Fatalf("expected a dead letter after the last attempt, got %+v", d)
+	}
+	rec := api.call("GET", "/webhook_deliveries", "")
+	var dead []WebhookDelivery
+	decode(t, rec, &dead)
+	if len(dead) != 1 || dead[0].ID != d.ID {
+		t.Errorf("dead letters: %s", rec.Body)
+	}
+
+	// once the database is back an admin replays it
+	api.clients = clients
+	rec = api.call("POST", "/webhook_deliveries/"+d.ID.Hex()+"/replay", "", RoleCaseworker)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("caseworker replay: got %d", rec.Code)
+	}
+	rec = api.call("POST", "/webhook_deliveries/"+d.ID.Hex()+"/replay", "")
+	var replayed WebhookDelivery
+	decode(t, rec, &replayed)
+	if replayed.Status != DeliveryDone || replayed.Attempts != 1 {
+		t.Fatalf("replay: %d %s", rec.Code, rec.Body)
+	}
+	booked, _ := api.clients.FindByID(c.ID.Hex())
+	if booked.Status != StatusScheduled {
+		t.Errorf("the replayed booking left the client %s", booked.Status)
+	}
+	rec = api.call("POST", "/webhook_deliveries/"+d.ID.Hex()+"/replay", "")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("replaying a processed delivery: got %d", rec.Code)
+	}
+}
+
+func TestDeliverPermanentFailures(t *testing.T) {
+	api := newTestAPI()
+	body, err := ioutil.ReadFile("webhook_fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, d := range map[string]WebhookDelivery{
+		"no invitee":       newDelivery(providerCalendly, []byte(`{"event":"invitee.created","payload":{}}`)),
+		"unknown provider": newDelivery("acuity", body),
+	} {
+		err := api.inbox.Save(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d = api.deliver(testRetries, d)
+		if d.Status != DeliveryDead || d.Attempts != 1 {
+			t.Errorf("%s: should go straight to the dead letters, got %+v", name, d)
+		}
+	}
+}
+
+func TestDrainInbox(t *testing.T) {
+	api := newTestAPI()
+	body, _, c := calendlyFixture(t, api)
+	d, err := api.enqueue(providerCalendly, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.drainInbox(testRetries)
+	saved, _ := api.inbox.FindByID(d.ID.Hex())
+	if saved.Status != DeliveryDone || saved.ProcessedAt.IsZero() {
+		t.Errorf("delivery not processed: %+v", saved)
+	}
+	booked, _ := api.clients.FindByID(c.ID.Hex())
+	if booked.Status != StatusScheduled {
+		t.Errorf("client is %s, want SCHEDULED", booked.Status)
+	}
+}
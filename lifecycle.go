@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// client lifecycle states
+const (
+	StatusPending    = "PENDING"
+	StatusApproved   = "APPROVED"
+	StatusDeclined   = "DECLINED"
+	StatusWaitlisted = "WAITLISTED"
+	StatusScheduled  = "SCHEDULED"
+	StatusFulfilled  = "FULFILLED"
+	StatusInactive   = "INACTIVE"
+	// StatusFollowUp - missed too many pickups; staff get in touch before the client can book again
+	StatusFollowUp = "FOLLOW_UP"
+)
+
+// transitions - the states each state may move to; every state may also move to INACTIVE
+var transitions = map[string][]string{
+	StatusPending:    {StatusApproved, StatusDeclined, StatusWaitlisted},
+	StatusWaitlisted: {StatusApproved, StatusDeclined},
+	StatusApproved:   {StatusScheduled},
+	// a canceled booking sends the client back to approved so they can book again
+	StatusScheduled: {StatusFulfilled, StatusApproved, StatusFollowUp},
+	StatusFollowUp:  {StatusApproved, StatusDeclined},
+	StatusDeclined:  {},
+	StatusFulfilled: {},
+	StatusInactive:  {},
+}
+
+// errStatusChanged - the client's status moved underneath us between read and write
+var errStatusChanged = errors.New("client status changed by another request, reload and try again")
+
+// TransitionError - a requested status change the lifecycle does not allow
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e TransitionError) Error() string {
+	return fmt.Sprintf("cannot change status from %s to %s", e.From, e.To)
+}
+
+func knownStatus(status string) bool {
+	_, ok := transitions[status]
+	return ok
+}
+
+// canTransition - whether the lifecycle allows moving from one state to another
+func canTransition(from string, to string) bool {
+	if !knownStatus(to) || from == to {
+		return false
+	}
+	if to == StatusInactive {
+		return true
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition - move the client to a new state and queue the notifications that go with entering it
+func (s *server) transition(actor Actor, c Client, to string) (Client, error) {
+	return s.transitionBecause(actor, c, to, "")
+}
+
+// transitionBecause - transition with the reason staff gave, such as why a referral was declined; the reason is
+// kept on the client until its next status change and can be included in the notifications
+func (s *server) transitionBecause(actor Actor, c Client, to string, reason string) (Client, error) {
+	if !knownStatus(to) {
+		return c, ValidationErrors{"status": "unknown status " + to}
+	}
+	from := c.Status
+	if !canTransition(from, to) {
+		return c, TransitionError{From: from, To: to}
+	}
+	// notifications are staged with the status change and sent by the outbox worker, so a failed send never
+	// fails or undoes the change
+	staged, err := s.stageNotifications(c, from, to, reason)
+	if err != nil {
+		return c, err
+	}
+	err = s.clients.UpdateStatus(c.ID.Hex(), from, to, reason)
+	if err != nil {
+		s.discardEmails(staged)
+		return c, err
+	}
+	before := c
+	c.Status = to
+	c.StatusReason = reason
+	s.audit(actor, "client.status", c.ID, before, c)
+	s.releaseEmails(staged)
+	return c, nil
+}
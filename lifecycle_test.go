@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[string][]string{
+		StatusPending:    {StatusApproved, StatusDeclined, StatusWaitlisted, StatusInactive},
+		StatusWaitlisted: {StatusApproved, StatusDeclined, StatusInactive},
+		StatusApproved:   {StatusScheduled, StatusInactive},
+		StatusScheduled:  {StatusFulfilled, StatusApproved, StatusFollowUp, StatusInactive},
+		StatusFollowUp:   {StatusApproved, StatusDeclined, StatusInactive},
+		StatusDeclined:   {StatusInactive},
+		StatusFulfilled:  {StatusInactive},
+		StatusInactive:   {},
+	}
+	for from, targets := range allowed {
+		ok := map[string]bool{}
+		for _, to := range targets {
+			ok[to] = true
+		}
+		for to := range transitions {
+			if got := canTransition(from, to); got != ok[to] {
+				t.Errorf("canTransition(%s, %s) = %v, want %v", from, to, got, ok[to])
+			}
+		}
+		if canTransition(from, "LOST") {
+			t.Errorf("canTransition(%s, LOST) allowed an unknown status", from)
+		}
+	}
+}
+
+func TestTransition(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	actor := Actor{Subject: "auth0|staff"}
+
+	_, err := api.transition(actor, c, "LOST")
+	if _, ok := err.(ValidationErrors); !ok {
+		t.Errorf("unknown status: got %v", err)
+	}
+	_, err = api.transition(actor, c, StatusScheduled)
+	if _, ok := err.(TransitionError); !ok {
+		t.Errorf("PENDING to SCHEDULED: got %v", err)
+	}
+
+	approved, err := api.transitionBecause(actor, c, StatusApproved, "")
+	if err != nil || approved.Status != StatusApproved {
+		t.Fatalf("approve: %+v %v", approved, err)
+	}
+	entries, _ := api.auditLog.FindByClientID(c.ID.Hex())
+	last := entries[len(entries)-1]
+	if last.Action != "client.status" || last.Actor.Subject != actor.Subject {
+		t.Errorf("expected a client.status entry by the actor, got %+v", last)
+	}
+
+	// the change was made from a stale copy, so it loses and nothing is left queued for it
+	before, _ := api.messages.FindByClientID(c.ID.Hex())
+	_, err = api.transition(actor, c, StatusDeclined)
+	if err != errStatusChanged {
+		t.Errorf("stale transition: got %v", err)
+	}
+	after, _ := api.messages.FindByClientID(c.ID.Hex())
+	if len(after) != len(before) {
+		t.Errorf("stale transition left %d messages behind", len(after)-len(before))
+	}
+}
+
+func TestTransitionKeepsReason(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	c, err := api.transitionBecause(Actor{}, c, StatusWaitlisted, "No stock until spring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := api.clients.FindByID(c.ID.Hex())
+	if saved.StatusReason != "No stock until spring" {
+		t.Errorf("statusReason = %q", saved.StatusReason)
+	}
+	// the reason belongs to the decision it was given for
+	_, err = api.transition(Actor{}, saved, StatusApproved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ = api.clients.FindByID(c.ID.Hex())
+	if saved.StatusReason != "" {
+		t.Errorf("statusReason kept after the next change: %q", saved.StatusReason)
+	}
+}
+
+func TestTransitionUnknownClient(t *testing.T) {
+	api := newTestAPI()
+	c := Client{ID: bson.NewObjectId(), Status: StatusPending, ClientName: "Ann", ClientEmail: "ann@example.com"}
+	_, err := api.transition(Actor{}, c, StatusDeclined)
+	if err == nil {
+		t.Error("transition of a client that was never saved succeeded")
+	}
+}
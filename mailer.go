@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Mailer - delivers one email, returning the id the backend knows the message by
+type Mailer interface {
+	Send(e outgoingEmail) (string, error)
+}
+
+// outgoingEmail - a rendered email ready to go to one recipient
+type outgoingEmail struct {
+	From    string
+	To      string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// mailerSettings - which backend sends email and how to reach it
+type mailerSettings struct {
+	Backend string
+	From    string
+	// mailgun
+	MailgunDomain    string
+	MailgunAPIKey    string
+	MailgunPublicKey string
+	// smtp
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	// file
+	Dir string
+}
+
+func mailerConfig() mailerSettings {
+	viper.AutomaticEnv()
+	viper.SetDefault("mailer", "mailgun")
+	viper.SetDefault("mail_from", "BabyGoRound <booking@mail.modernbaby.online>")
+	viper.SetDefault("mailgun_domain", "mail.modernbaby.online")
+	viper.SetDefault("smtp_host", "localhost")
+	viper.SetDefault("smtp_port", 25)
+	viper.SetDefault("mail_dir", "mail")
+	return mailerSettings{
+		Backend:          strings.ToLower(cast.ToString(viper.Get("mailer"))),
+		From:             cast.ToString(viper.Get("mail_from")),
+		MailgunDomain:    cast.ToString(viper.Get("mailgun_domain")),
+		MailgunAPIKey:    cast.ToString(viper.Get("mailgun_api_key")),
+		MailgunPublicKey: cast.ToString(viper.Get("mailgun_public_key")),
+		SMTPHost:         cast.ToString(viper.Get("smtp_host")),
+		SMTPPort:         cast.ToInt(viper.Get("smtp_port")),
+		SMTPUsername:     cast.ToString(viper.Get("smtp_username")),
+		SMTPPassword:     cast.ToString(viper.Get("smtp_password")),
+		Dir:              cast.ToString(viper.Get("mail_dir")),
+	}
+}
+
+// newMailer - the backend MAILER names: mailgun, smtp or file
+func newMailer(cfg mailerSettings) (Mailer, error) {
+	_, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, errors.New("MAIL_FROM is not an email address: " + err.Error())
+	}
+	switch cfg.Backend {
+	case "mailgun":
+		return newMailgunMailer(cfg), nil
+	case "smtp":
+		return smtpMailer{
+			addr:     net.JoinHostPort(cfg.SMTPHost, cast.ToString(cfg.SMTPPort)),
+			host:     cfg.SMTPHost,
+			username: cfg.SMTPUsername,
+			password: cfg.SMTPPassword,
+		}, nil
+	case "file":
+		err = os.MkdirAll(cfg.Dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		return fileMailer{dir: cfg.Dir}, nil
+	}
+	return nil, errors.New("unknown MAILER " + cfg.Backend + ", expected mailgun, smtp or file")
+}
+
+// messageID - a unique Message-ID on the sender's domain
+func messageID(from string) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(addr.Address, "@"); at >= 0 {
+			domain = addr.Address[at+1:]
+		}
+	}
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">", nil
+}
+
+// mimeMessage - the email as RFC 5322 text with html and plain-text alternatives
+func mimeMessage(e outgoingEmail, id string, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	header := func(k string, v string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+	}
+	// addresses are re-formatted so a name outside ascii is encoded
+	address := func(v string) string {
+		addr, err := mail.ParseAddress(v)
+		if err != nil {
+			return v
+		}
+		return addr.String()
+	}
+	header("From", address(e.From))
+	header("To", address(e.To))
+	header("Subject", mime.QEncoding.Encode("utf-8", e.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", id)
+	header("MIME-Version", "1.0")
+	header("Content-Type", `multipart/alternative; boundary="`+w.Boundary()+`"`)
+	buf.WriteString("\r\n")
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain", e.Text},
+		{"text/html", e.HTML},
+	}
+	for _, p := range parts {
+		// mail clients show the last alternative they understand, so html goes after the plain text
+		if p.body == "" {
+			continue
+		}
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(part)
+		_, err = qp.Write([]byte(p.body))
+		if err != nil {
+			return nil, err
+		}
+		err = qp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// smtpMailer - sends through any smtp server, such as MailHog in docker-compose
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+}
+
+func (m smtpMailer) Send(e outgoingEmail) (string, error) {
+	from, err := mail.ParseAddress(e.From)
+	if err != nil {
+		return "", permanentError{err}
+	}
+	to, err := mail.ParseAddress(e.To)
+	if err != nil {
+		return "", permanentError{err}
+	}
+	id, err := messageID(e.From)
+	if err != nil {
+		return "", err
+	}
+	msg, err := mimeMessage(e, id, time.Now())
+	if err != nil {
+		return "", err
+	}
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	err = smtp.SendMail(m.addr, auth, from.Address, []string{to.Address}, msg)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// fileMailer - writes each email to an .eml file instead of sending it, for tests and offline development
+type fileMailer struct {
+	dir string
+}
+
+func (m fileMailer) Send(e outgoingEmail) (string, error) {
+	id, err := messageID(e.From)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	msg, err := mimeMessage(e, id, now)
+	if err != nil {
+		return "", err
+	}
+	// named so a directory listing is in the order the emails were sent
+	name := now.UTC().Format("20060102T150405.000000000") + "-" + strings.Trim(id, "<>") + ".eml"
+	path := filepath.Join(m.dir, name)
+	err = ioutil.WriteFile(path, msg, 0600)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("mail to %s %q written to %s", e.To, e.Subject, path)
+	return id, nil
+}
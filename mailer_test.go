@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := mailerSettings{From: "Modern Baby <booking@mail.modernbaby.online>", Dir: dir, SMTPHost: "localhost", SMTPPort: 1025}
+	for backend, ok := range map[string]bool{"mailgun": true, "smtp": true, "file": true, "pigeon": false} {
+		cfg.Backend = backend
+		_, err := newMailer(cfg)
+		if (err == nil) != ok {
+			t.Errorf("%s: got %v", backend, err)
+		}
+	}
+	cfg.Backend = "file"
+	cfg.From = "not an address"
+	if _, err := newMailer(cfg); err == nil {
+		t.Error("accepted a MAIL_FROM that is not an address")
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := fileMailer{dir: dir}
+	id, err := m.Send(outgoingEmail{
+		From:    "Modern Baby <booking@mail.modernbaby.online>",
+		To:      "Zoë Smith <zoe@example.com>",
+		Subject: "Your pickup is confirmed – see you soon",
+		HTML:    "<p>Hi Zoë, " + strings.Repeat("see you at the warehouse ", 5) + "</p>",
+		Text:    "Hi Zoë",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@mail.modernbaby.online>") {
+		t.Errorf("unexpected message id %s", id)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected one .eml file, got %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Your pickup is confirmed – see you soon" {
+		t.Errorf("subject decoded to %q %v", subject, err)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || to[0].Name != "Zoë Smith" || to[0].Address != "zoe@example.com" {
+		t.Errorf("to parsed as %v %v", to, err)
+	}
+	if msg.Header.Get("Message-ID") != id {
+		t.Errorf("Message-ID %s, want %s", msg.Header.Get("Message-ID"), id)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("content type %s %v", mediaType, err)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		// the reader undoes the quoted-printable encoding
+		body, _ := ioutil.ReadAll(part)
+		types = append(types, part.Header.Get("Content-Type"))
+		if !strings.Contains(string(body), "Hi Zoë") {
+			t.Errorf("%s part is %q", part.Header.Get("Content-Type"), body)
+		}
+	}
+	// html last, as clients show the last alternative they understand
+	if len(types) != 2 || !strings.HasPrefix(types[0], "text/plain") || !strings.HasPrefix(types[1], "text/html") {
+		t.Errorf("unexpected parts %v", types)
+	}
+}
+
+func TestSMTPMailerRejectsBadAddresses(t *testing.T) {
+	m := smtpMailer{addr: "localhost:1", host: "localhost"}
+	_, err := m.Send(outgoingEmail{From: "booking@mail.modernbaby.online", To: "nobody"})
+	if !isPermanent(err) {
+		t.Errorf("a bad recipient should not be retried, got %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/labstack/echo"
+	rollbar "github.com/rollbar/rollbar-go"
+	"github.com/tidwall/gjson"
+)
+
+// mailgun event types
+const (
+	mailEventDelivered  = "delivered"
+	mailEventOpened     = "opened"
+	mailEventFailed     = "failed"
+	mailEventComplained = "complained"
+)
+
+// what we know of a sent message; later states only replace earlier ones, so out of order events are harmless
+const (
+	DeliveryDeferred   = "deferred"
+	DeliveryDelivered  = "delivered"
+	DeliveryOpened     = "opened"
+	DeliveryBounced    = "bounced"
+	DeliveryComplained = "complained"
+)
+
+var deliveryRank = map[string]int{
+	"":                 0,
+	DeliveryDeferred:   1,
+	DeliveryDelivered:  2,
+	DeliveryOpened:     3,
+	DeliveryBounced:    4,
+	DeliveryComplained: 5,
+}
+
+// problems with a client's email address, shown on the client so staff phone them instead
+const (
+	EmailBounced    = "bounced"
+	EmailComplained = "complained"
+)
+
+// MessageEvent - something mailgun reported about a message after sending it
+type MessageEvent struct {
+	ID        string    `json:"id" bson:"id"`
+	Event     string    `json:"event" bson:"event"`
+	Severity  string    `json:"severity,omitempty" bson:"severity,omitempty"`
+	Reason    string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	Detail    string    `json:"detail,omitempty" bson:"detail,omitempty"`
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+}
+
+// delivery - the delivery state the event stands for, or "" for events such as clicks that say nothing about it
+func (ev MessageEvent) delivery() string {
+	switch ev.Event {
+	case mailEventDelivered:
+		return DeliveryDelivered
+	case mailEventOpened:
+		return DeliveryOpened
+	case mailEventComplained:
+		return DeliveryComplained
+	case mailEventFailed:
+		if ev.Severity == "permanent" {
+			return DeliveryBounced
+		}
+		// mailgun keeps retrying a temporary failure
+		return DeliveryDeferred
+	}
+	return ""
+}
+
+// normalizeMessageID - mailgun events carry the Message-ID without the angle brackets it was sent with
+func normalizeMessageID(id string) string {
+	return "<" + strings.Trim(strings.TrimSpace(id), "<>") + ">"
+}
+
+// parseMailgunEvent - the message id and event from a mailgun webhook body
+func parseMailgunEvent(r gjson.Result) (string, MessageEvent) {
+	data := r.Get("event-data")
+	sec, frac := math.Modf(data.Get("timestamp").Float())
+	ev := MessageEvent{
+		ID:        data.Get("id").String(),
+		Event:     data.Get("event").String(),
+		Severity:  data.Get("severity").String(),
+		Reason:    data.Get("reason").String(),
+		Timestamp: time.Unix(int64(sec), int64(frac*1e9)).UTC(),
+	}
+	if ev.Timestamp.Unix() == 0 {
+		ev.Timestamp = time.Now().UTC()
+	}
+	ev.Detail = data.Get("delivery-status.description").String()
+	if ev.Detail == "" {
+		ev.Detail = data.Get("delivery-status.message").String()
+	}
+	return data.Get("message.headers.message-id").String(), ev
+}
+
+// mailgunWebhook - delivery events for the emails we sent; mailgun retries anything but a 2xx, so only
+// a failure to store the event is an error
+func (s *server) mailgunWebhook(ctx echo.Context) error {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(ctx.Request().Body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	if !gjson.ValidBytes(buf.Bytes()) {
+		m := echo.Map{}
+		m["error"] = "mailgun event is not valid json"
+		return ctx.JSON(400, m)
+	}
+	r := gjson.ParseBytes(buf.Bytes())
+	key, tolerance := mailgunWebhookConfig()
+	err = verifyMailgunSignature(
+		r.Get("signature.timestamp").String(),
+		r.Get("signature.token").String(),
+		r.Get("signature.signature").String(),
+		key, tolerance, time.Now(),
+	)
+	if err != nil {
+		rollbar.RequestError(rollbar.WARN, ctx.Request(), errors.New("rejected mailgun webhook: "+err.Error()))
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(http.StatusUnauthorized, m)
+	}
+	messageID, ev := parseMailgunEvent(r)
+	err = s.recordMailEvent(messageID, ev)
+	if err != nil {
+		rollbar.Error(err)
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(200, "")
+}
+
+// recordMailEvent - add the event to its message and flag or clear a problem with the client's address
+func (s *server) recordMailEvent(messageID string, ev MessageEvent) error {
+	if messageID == "" {
+		return nil
+	}
+	msg, err := s.messages.FindByProviderID(normalizeMessageID(messageID))
+	if err == mgo.ErrNotFound {
+		// not an email this api sent
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	delivery := msg.Delivery
+	if deliveryRank[ev.delivery()] > deliveryRank[delivery] {
+		delivery = ev.delivery()
+	}
+	err = s.messages.AddEvent(msg.ID, ev, delivery)
+	if err == mgo.ErrNotFound {
+		// mailgun sent the same event again
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !msg.ClientID.Valid() {
+		return nil
+	}
+	client, err := s.clients.FindByID(msg.ClientID.Hex())
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(client.ClientEmail, msg.Recipient) {
+		// a booking email can go to another address, which says nothing about the one on file
+		return nil
+	}
+	issue := client.EmailIssue
+	switch ev.delivery() {
+	case DeliveryBounced:
+		issue = EmailBounced
+	case DeliveryComplained:
+		issue = EmailComplained
+	case DeliveryDelivered, DeliveryOpened:
+		// a bounce can be temporary in all but name, such as a full mailbox; a complaint stands, and so does
+		// a bounce newer than the delivery
+		if issue == EmailBounced && ev.Timestamp.After(client.EmailIssueAt) {
+			issue = ""
+		}
+	}
+	if issue == client.EmailIssue {
+		return nil
+	}
+	before := client
+	client.EmailIssue = issue
+	client.EmailIssueAt = ev.Timestamp
+	err = s.clients.SetEmailIssue(client.ID.Hex(), issue, ev.Timestamp)
+	if err != nil {
+		return err
+	}
+	s.audit(systemActor("mailgun"), "client.emailIssue", client.ID, before, client)
+	return nil
+}
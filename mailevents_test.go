@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestVerifyMailgunSignature(t *testing.T) {
+	now := time.Unix(1550000000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+	cases := []struct {
+		name      string
+		timestamp string
+		token     string
+		signature string
+		key       string
+		ok        bool
+	}{
+		{"valid", ts, "tok", hmacHex("secret", ts, "tok"), "secret", true},
+		{"token changed", ts, "other", hmacHex("secret", ts, "tok"), "secret", false},
+		{"wrong key", ts, "tok", hmacHex("other", ts, "tok"), "secret", false},
+		{"no key configured", ts, "tok", hmacHex("secret", ts, "tok"), "", false},
+		{"no signature", ts, "tok", "", "secret", false},
+		{"not hex", ts, "tok", "zz", "secret", false},
+		{"bad timestamp", "soon", "tok", hmacHex("secret", "soon", "tok"), "secret", false},
+		{"stale", stale, "tok", hmacHex("secret", stale, "tok"), "secret", false},
+	}
+	for _, tc := range cases {
+		err := verifyMailgunSignature(tc.timestamp, tc.token, tc.signature, tc.key, 5*time.Minute, now)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
+
+// mailgunEvent - a signed webhook body for an event about the message
+func mailgunEvent(key string, id string, event string, severity string, messageID string, at time.Time) string {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	token := "token-" + id
+	return `{"signature":{"timestamp":"` + ts + `","token":"` + token + `","signature":"` + hmacHex(key, ts, token) + `"},` +
+		`"event-data":{"id":"` + id + `","event":"` + event + `","severity":"` + severity + `","timestamp":` +
+		strconv.FormatInt(at.Unix(), 10) + `,"message":{"headers":{"message-id":"` + strings.Trim(messageID, "<>") + `"}}}}`
+}
+
+func TestMailgunWebhook(t *testing.T) {
+	viper.Set("mailgun_webhook_signing_key", "secret")
+	defer viper.Set("mailgun_webhook_signing_key", "")
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	err := api.queueEmail(templateReminder, c.ClientEmail, clientEmailData(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.drainOutbox(testRetries)
+	var msg Message
+	messages, _ := api.messages.FindByClientID(c.ID.Hex())
+	for _, m := range messages {
+		if m.Recipient == c.ClientEmail {
+			msg = m
+		}
+	}
+	if msg.ProviderID == "" {
+		t.Fatalf("the email was not sent: %+v", msg)
+	}
+
+	post := func(body string) int {
+		req := httptest.NewRequest("POST", "/mailgun_webhook", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		api.app.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := post(mailgunEvent("forged", "ev0", "delivered", "", msg.ProviderID, time.Now())); code != http.StatusUnauthorized {
+		t.Errorf("forged event: got %d", code)
+	}
+
+	bounced := time.Now().Add(-time.Hour)
+	for _, body := range []string{
+		mailgunEvent("secret", "ev1", "failed", "temporary", msg.ProviderID, bounced.Add(-time.Minute)),
+		mailgunEvent("secret", "ev2", "failed", "permanent", msg.ProviderID, bounced),
+		// mailgun retries a delivery it did not get a 2xx for
+		mailgunEvent("secret", "ev2", "failed", "permanent", msg.ProviderID, bounced),
+	} {
+		if code := post(body); code != http.StatusOK {
+			t.Fatalf("event: got %d", code)
+		}
+	}
+	saved, _ := api.messages.FindByID(msg.ID.Hex())
+	if saved.Delivery != DeliveryBounced || len(saved.Events) != 2 {
+		t.Errorf("expected a bounce from two events, got %s %+v", saved.Delivery, saved.Events)
+	}
+	client, _ := api.clients.FindByID(c.ID.Hex())
+	if client.EmailIssue != EmailBounced {
+		t.Fatalf("the client's email should be flagged, got %q", client.EmailIssue)
+	}
+
+	// a later delivery shows the address works again, without undoing the message's own bounce
+	post(mailgunEvent("secret", "ev3", "delivered", "", msg.ProviderID, time.Now()))
+	client, _ = api.clients.FindByID(c.ID.Hex())
+	saved, _ = api.messages.FindByID(msg.ID.Hex())
+	if client.EmailIssue != "" || saved.Delivery != DeliveryBounced {
+		t.Errorf("issue %q, delivery %s", client.EmailIssue, saved.Delivery)
+	}
+
+	if code := post(mailgunEvent("secret", "ev4", "delivered", "", "<someone-else@example.com>", time.Now())); code != http.StatusOK {
+		t.Errorf("an event for an email we did not send: got %d", code)
+	}
+}
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
-	"net/http"
+	"fmt"
 	"os"
 	"strings"
 
@@ -17,7 +15,6 @@ import (
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	rollbar "github.com/rollbar/rollbar-go"
-	"github.com/tidwall/gjson"
 )
 
 func getBaseURLPath(URL string) string {
@@ -69,192 +66,85 @@ func auth0Middleware(next echo.HandlerFunc) echo.HandlerFunc {
 			m["error"] = errs.Error()
 			return c.JSON(401, m)
 		}
+		// keep who is making the request for the audit log
+		subject, _ := token.Get(jwt.SubjectKey)
+		c.Set(actorSubjectKey, cast.ToString(subject))
+		email, _ := auth0.GetEmail(token, audience)
+		c.Set(actorEmailKey, email)
+		// roles decide which client fields the response may include
+		claimRoles, _ := token.Get(audience + "roles")
+		scopes, _ := auth0.GetScopes(token)
+		c.Set(actorRolesKey, tokenRoles(claimRoles, scopes))
 		return next(c)
 	}
 }
 
 func main() {
-	app := echo.New()
-	app.Use(middleware.Logger())
-	app.Use(middleware.CORS())
 	viper.AutomaticEnv()
 	rollbar.SetToken(cast.ToString(viper.Get("rollbar_access_token")))
 	rollbar.SetEnvironment(cast.ToString(viper.Get("environment")))
 
-	app.POST("/appointment_webhook", func(ctx echo.Context) error {
-		buf := new(bytes.Buffer)
-		_, err := buf.ReadFrom(ctx.Request().Body)
-		if err != nil {
-			rollbar.Error(err)
-			return ctx.JSON(200, "")
-		}
-		body := buf.String()
-		r := gjson.Parse(body)
-		data := []byte(body)
-
-		var c echo.Map
-		err = json.Unmarshal(data, &c)
-		if err != nil {
-			rollbar.Error(err)
-			return ctx.JSON(200, "")
-		}
-
-		clientEmail := r.Get("payload.invitee.email").String()
-		client, err := findClientByEmail(clientEmail)
-		if err != nil {
-			rollbar.Error(err)
-			return ctx.JSON(200, "")
-		}
-
-		c["clientID"] = client["_id"]
-
-		err = saveAppointment(c)
-		if err != nil {
-			rollbar.Error(err)
-			return ctx.JSON(200, "")
-		}
-		return ctx.JSON(200, "")
-	})
-
-	app.POST("/clients", func(ctx echo.Context) error {
-		buf := new(bytes.Buffer)
-		_, err := buf.ReadFrom(ctx.Request().Body)
-		if err != nil {
-			m := echo.Map{}
-			m["error"] = err.Error
-			return ctx.JSON(500, m)
-		}
-		data := buf.Bytes()
-
-		var c echo.Map
-		err = json.Unmarshal(data, &c)
+	// subcommands run instead of the server
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "migrate":
+			err = runMigrate(os.Args[2:])
+		case "rekey":
+			err = runRekey()
+		case "inbox":
+			err = runInboxCommand(os.Args[2:])
+		case "seed":
+			err = runSeed()
+		default:
+			err = errors.New("unknown command " + os.Args[1])
+		}
+		// send anything a subcommand reported before exiting
+		rollbar.Wait()
 		if err != nil {
-			m := echo.Map{}
-			m["error"] = err.Error()
-			return ctx.JSON(400, m)
-		}
-
-		_, err = findClientByEmail(cast.ToString(c["clientEmail"]))
-		if err == nil {
-			m := echo.Map{}
-			m["error"] = "cannot add client as already exists"
-			return ctx.JSON(400, m)
-		}
-		_, err = findClientBySIN(cast.ToString(c["sin"]))
-		if err == nil {
-			m := echo.Map{}
-			m["error"] = "cannot add client as already exists"
-			return ctx.JSON(400, m)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		return
+	}
 
-		c["status"] = "PENDING"
-
-		err = saveClient(c)
-		if err != nil {
-			m := echo.Map{}
-			m["error"] = err.Error
-			return ctx.JSON(500, m)
-		}
-		return ctx.JSON(http.StatusOK, c)
-	}, auth0Middleware)
-
-	app.PATCH("/clients/:id", func(ctx echo.Context) error {
-		buf := new(bytes.Buffer)
-		_, err := buf.ReadFrom(ctx.Request().Body)
-		if err != nil {
-			m := echo.Map{}
-			m["error"] = err.Error
-			return ctx.JSON(500, m)
-		}
-		data := buf.Bytes()
-
-		var c echo.Map
-		err = json.Unmarshal(data, &c)
-		if err != nil {
-			m := echo.Map{}
-			m["error"] = err.Error()
-			return ctx.JSON(400, m)
-		}
-
-		id := ctx.Param("id")
-
-		// only handle status changes for now
-		status := cast.ToString(c["status"])
-		err = updateClientStatus(id, status)
-		if err != nil {
-			m := echo.Map{}
-			m["error"] = err.Error
-			return ctx.JSON(500, m)
-		}
-		return ctx.JSON(200, "")
-	}, auth0Middleware)
-
-	app.GET("/clients_by_status/:status", func(ctx echo.Context) error {
-		status := ctx.Param("status")
-		clientInfo, err := findClientsByApprovedStatus(status)
-		if err != nil {
-			m := echo.Map{}
-			m["error"] = err.Error
-			return ctx.JSON(400, m)
-		}
-		return ctx.JSON(http.StatusOK, clientInfo)
-	}, auth0Middleware)
+	app := echo.New()
+	app.Use(middleware.Logger())
+	app.Use(middleware.CORS())
 
-	app.GET("/clients/:id", func(ctx echo.Context) error {
-		id := ctx.Param("id")
-		c, err := findClientByID(id)
-		if err != nil {
-			m := echo.Map{}
-			m["error"] = err.Error
-			return ctx.JSON(400, m)
-		}
-		return ctx.JSON(http.StatusOK, c)
-	}, auth0Middleware)
+	mailer, err := newMailer(mailerConfig())
+	if err != nil {
+		app.Logger.Fatal(err)
+	}
+	err = reminderConfig().validate()
+	if err != nil {
+		app.Logger.Fatal(err)
+	}
+	err = bookingConfigError()
+	if err != nil {
+		app.Logger.Fatal(err)
+	}
 
-	app.GET("/appointments_by_clientid/:clientID", func(ctx echo.Context) error {
-		clientID := ctx.Param("clientID")
-		apt, err := findAppointmentsByClientID(clientID)
+	// STORE=memory runs the API without MongoDB (local development and tests)
+	var srv *server
+	if cast.ToString(viper.Get("store")) == "memory" {
+		srv = newServer(newMemoryStores(), mailer)
+	} else {
+		fields, err := loadFieldCipher()
 		if err != nil {
-			m := echo.Map{}
-			m["error"] = err.Error
-			return ctx.JSON(400, m)
+			app.Logger.Fatal(err)
 		}
-		return ctx.JSON(http.StatusOK, apt)
-	}, auth0Middleware)
-
-	app.GET("/appointments/:id", func(ctx echo.Context) error {
-		id := ctx.Param("id")
-		apt, err := findAppointmentByID(id)
+		conn, err := dialMongo()
 		if err != nil {
-			m := echo.Map{}
-			m["error"] = err.Error
-			return ctx.JSON(500, m)
-		}
-		return ctx.JSON(http.StatusOK, apt)
-	}, auth0Middleware)
-
-	app.GET("/search", func(ctx echo.Context) error {
-		name := ctx.QueryParam("name")
-		email := ctx.QueryParam("email")
-		if name != "" {
-			clientInfo, err := findClientsByPartialName(name)
-			if err != nil {
-				m := echo.Map{}
-				m["error"] = err.Error
-				return ctx.JSON(500, m)
-			}
-			return ctx.JSON(http.StatusOK, clientInfo)
-		} else if email != "" {
-			clientInfo, err := findClientByEmail(email)
-			if err != nil {
-				m := echo.Map{}
-				m["error"] = err.Error
-				return ctx.JSON(500, m)
-			}
-			return ctx.JSON(http.StatusOK, clientInfo)
+			app.Logger.Fatal(err)
 		}
-		return ctx.JSON(400, "")
-	}, auth0Middleware)
+		defer conn.Close()
+		srv = newServer(newMongoStores(conn, fields), mailer)
+	}
+	srv.routes(app, auth0Middleware)
+	go srv.runInbox()
+	go srv.runReminders()
+	go srv.runOutbox()
 
 	port := os.Getenv("PORT")
 
@@ -0,0 +1,899 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// memoryClientStore - ClientStore kept in process memory, for tests and running without MongoDB
+type memoryClientStore struct {
+	mu      sync.RWMutex
+	clients []Client
+}
+
+func newMemoryClientStore() *memoryClientStore {
+	return &memoryClientStore{}
+}
+
+func (m *memoryClientStore) Save(client Client) error {
+	err := client.Validate()
+	if err != nil {
+		return err
+	}
+	client.SearchTokens = searchTokens(client)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// mirror the unique indexes created by the migrations
+	for _, c := range m.clients {
+		if c.ID == client.ID || c.ClientEmail == client.ClientEmail || (client.SIN != "" && c.SIN == client.SIN) {
+			return &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error collection: clients"}
+		}
+	}
+	m.clients = append(m.clients, client)
+	return nil
+}
+
+func (m *memoryClientStore) SetEmailIssue(id string, issue string, at time.Time) error {
+	if !govalidator.IsMongoID(id) {
+		return errors.New("requested clientID is not a valid mongo ID")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.clients {
+		if m.clients[i].ID == bson.ObjectIdHex(id) {
+			m.clients[i].EmailIssue = issue
+			m.clients[i].EmailIssueAt = at
+			if issue == "" {
+				m.clients[i].EmailIssueAt = time.Time{}
+			}
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryClientStore) UpdateStatus(id string, from string, to string, reason string) error {
+	if !govalidator.IsMongoID(id) {
+		return errors.New("requested clientID is not a valid mongo ID")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.clients {
+		if m.clients[i].ID == bson.ObjectIdHex(id) {
+			if m.clients[i].Status != from {
+				return errStatusChanged
+			}
+			m.clients[i].Status = to
+			m.clients[i].StatusReason = reason
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryClientStore) FindByID(id string) (Client, error) {
+	if !govalidator.IsMongoID(id) {
+		return Client{}, errors.New("requested clientID is not a valid mongo ID")
+	}
+	return m.findOne(func(c Client) bool { return c.ID == bson.ObjectIdHex(id) })
+}
+
+func (m *memoryClientStore) FindByEmail(email string) (Client, error) {
+	return m.findOne(func(c Client) bool {
+		if c.ClientEmail == email {
+			return true
+		}
+		for _, alias := range c.EmailAliases {
+			if alias == email {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m *memoryClientStore) AddEmailAlias(id string, email string) error {
+	if !govalidator.IsMongoID(id) {
+		return errors.New("requested clientID is not a valid mongo ID")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.clients {
+		if m.clients[i].ID != bson.ObjectIdHex(id) {
+			continue
+		}
+		for _, alias := range m.clients[i].EmailAliases {
+			if alias == email {
+				return nil
+			}
+		}
+		m.clients[i].EmailAliases = append(m.clients[i].EmailAliases, email)
+		m.clients[i].SearchTokens = searchTokens(m.clients[i])
+		return nil
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryClientStore) FindBySIN(sin string) (Client, error) {
+	return m.findOne(func(c Client) bool { return c.SIN == sin })
+}
+
+func (m *memoryClientStore) List(q ClientQuery) (ClientPage, error) {
+	clients := m.findAll(q.matches)
+	sort.SliceStable(clients, func(i, j int) bool { return q.less(clients[i], clients[j]) })
+	if len(clients) > q.Limit+1 {
+		clients = clients[:q.Limit+1]
+	}
+	return q.page(clients), nil
+}
+
+func (m *memoryClientStore) Search(q SearchQuery) (SearchResults, error) {
+	return q.rank(m.findAll(q.matches)), nil
+}
+
+func (m *memoryClientStore) findOne(match func(Client) bool) (Client, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, c := range m.clients {
+		if match(c) {
+			return c, nil
+		}
+	}
+	return Client{}, mgo.ErrNotFound
+}
+
+func (m *memoryClientStore) findAll(match func(Client) bool) []Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	clients := make([]Client, 0)
+	for _, c := range m.clients {
+		if match(c) {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// memoryAppointmentStore - AppointmentStore kept in process memory
+type memoryAppointmentStore struct {
+	mu           sync.RWMutex
+	appointments []Appointment
+}
+
+func newMemoryAppointmentStore() *memoryAppointmentStore {
+	return &memoryAppointmentStore{}
+}
+
+func (m *memoryAppointmentStore) Save(apt Appointment) error {
+	err := apt.Validate()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// mirror the unique booking uuid index
+	for _, a := range m.appointments {
+		if a.ID == apt.ID || (apt.InviteeUUID != "" && a.EventUUID == apt.EventUUID && a.InviteeUUID == apt.InviteeUUID) {
+			return &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error collection: appointments"}
+		}
+	}
+	m.appointments = append(m.appointments, apt)
+	return nil
+}
+
+// set - change one appointment in place, the way the mongo store's $set does
+func (m *memoryAppointmentStore) set(id bson.ObjectId, change func(apt *Appointment)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.appointments {
+		if m.appointments[i].ID == id {
+			change(&m.appointments[i])
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryAppointmentStore) SetAttendance(id bson.ObjectId, attendance string, at time.Time) error {
+	return m.set(id, func(apt *Appointment) {
+		apt.Attendance = attendance
+		apt.AttendanceAt = at
+	})
+}
+
+func (m *memoryAppointmentStore) Cancel(id bson.ObjectId, reason string, canceler string, at time.Time) error {
+	return m.set(id, func(apt *Appointment) {
+		apt.Status = AppointmentCanceled
+		apt.CanceledAt = at
+		if reason != "" {
+			apt.CancelReason = reason
+		}
+		if canceler != "" {
+			apt.CancelerName = canceler
+		}
+	})
+}
+
+func (m *memoryAppointmentStore) SetReplacedBy(id bson.ObjectId, replacedByID bson.ObjectId) error {
+	return m.set(id, func(apt *Appointment) { apt.ReplacedByID = replacedByID })
+}
+
+func (m *memoryAppointmentStore) SetReplaces(id bson.ObjectId, replacesID bson.ObjectId) error {
+	return m.set(id, func(apt *Appointment) { apt.ReplacesID = replacesID })
+}
+
+func (m *memoryAppointmentStore) FindByInviteeUUID(uuid string) (Appointment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, apt := range m.appointments {
+		if apt.InviteeUUID == uuid {
+			return apt, nil
+		}
+	}
+	return Appointment{}, mgo.ErrNotFound
+}
+
+func (m *memoryAppointmentStore) FindByBookingUUIDs(eventUUID string, inviteeUUID string) (Appointment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, apt := range m.appointments {
+		if apt.EventUUID == eventUUID && apt.InviteeUUID == inviteeUUID {
+			return apt, nil
+		}
+	}
+	return Appointment{}, mgo.ErrNotFound
+}
+
+func (m *memoryAppointmentStore) FindByID(id string) (Appointment, error) {
+	if !govalidator.IsMongoID(id) {
+		return Appointment{}, errors.New("requested appointmentID is not a valid mongo ID")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, apt := range m.appointments {
+		if apt.ID == bson.ObjectIdHex(id) {
+			return apt, nil
+		}
+	}
+	return Appointment{}, mgo.ErrNotFound
+}
+
+func (m *memoryAppointmentStore) FindByClientID(clientID string) ([]Appointment, error) {
+	if !govalidator.IsMongoID(clientID) {
+		return []Appointment{}, errors.New("requested clientID is not a valid mongo ID")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	appointments := make([]Appointment, 0)
+	for _, apt := range m.appointments {
+		if apt.ClientID == bson.ObjectIdHex(clientID) {
+			appointments = append(appointments, apt)
+		}
+	}
+	return appointments, nil
+}
+
+func (m *memoryAppointmentStore) FindBetween(from time.Time, to time.Time) ([]Appointment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	appointments := make([]Appointment, 0)
+	for _, apt := range m.appointments {
+		if !apt.StartTime.Before(from) && apt.StartTime.Before(to) {
+			appointments = append(appointments, apt)
+		}
+	}
+	sort.SliceStable(appointments, func(i, j int) bool { return appointments[i].StartTime.Before(appointments[j].StartTime) })
+	return appointments, nil
+}
+
+func (m *memoryAppointmentStore) DueForReminder(reminder string, from time.Time, to time.Time) ([]Appointment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	appointments := make([]Appointment, 0)
+	for _, apt := range m.appointments {
+		if apt.Status == AppointmentActive && apt.StartTime.After(from) && !apt.StartTime.After(to) && !containsString(apt.RemindersSent, reminder) {
+			appointments = append(appointments, apt)
+		}
+	}
+	return appointments, nil
+}
+
+func (m *memoryAppointmentStore) MarkReminded(id bson.ObjectId, reminders []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.appointments {
+		if m.appointments[i].ID != id {
+			continue
+		}
+		if containsString(m.appointments[i].RemindersSent, reminders[0]) {
+			return mgo.ErrNotFound
+		}
+		for _, r := range reminders {
+			if !containsString(m.appointments[i].RemindersSent, r) {
+				m.appointments[i].RemindersSent = append(m.appointments[i].RemindersSent, r)
+			}
+		}
+		return nil
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryAppointmentStore) UnmarkReminded(id bson.ObjectId, reminders []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.appointments {
+		if m.appointments[i].ID != id {
+			continue
+		}
+		kept := make([]string, 0)
+		for _, r := range m.appointments[i].RemindersSent {
+			if !containsString(reminders, r) {
+				kept = append(kept, r)
+			}
+		}
+		m.appointments[i].RemindersSent = kept
+		return nil
+	}
+	return mgo.ErrNotFound
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// memoryAuditStore - AuditStore kept in process memory
+type memoryAuditStore struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+}
+
+func newMemoryAuditStore() *memoryAuditStore {
+	return &memoryAuditStore{}
+}
+
+func (m *memoryAuditStore) Append(entry AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+func (m *memoryAuditStore) FindByClientID(clientID string) ([]AuditEntry, error) {
+	if !govalidator.IsMongoID(clientID) {
+		return []AuditEntry{}, errors.New("requested clientID is not a valid mongo ID")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := make([]AuditEntry, 0)
+	for _, e := range m.entries {
+		if e.ClientID == bson.ObjectIdHex(clientID) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// memoryUnmatchedStore - UnmatchedStore kept in process memory
+type memoryUnmatchedStore struct {
+	mu       sync.RWMutex
+	bookings []UnmatchedBooking
+}
+
+func newMemoryUnmatchedStore() *memoryUnmatchedStore {
+	return &memoryUnmatchedStore{}
+}
+
+func (m *memoryUnmatchedStore) Save(b UnmatchedBooking) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, other := range m.bookings {
+		if other.ID == b.ID || (b.InviteeUUID != "" && other.InviteeUUID == b.InviteeUUID) {
+			return &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error collection: unmatched_appointments"}
+		}
+	}
+	m.bookings = append(m.bookings, b)
+	return nil
+}
+
+func (m *memoryUnmatchedStore) Update(b UnmatchedBooking) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.bookings {
+		if m.bookings[i].ID == b.ID {
+			m.bookings[i] = b
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryUnmatchedStore) FindByID(id string) (UnmatchedBooking, error) {
+	if !govalidator.IsMongoID(id) {
+		return UnmatchedBooking{}, errors.New("requested unmatched appointment ID is not a valid mongo ID")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, b := range m.bookings {
+		if b.ID == bson.ObjectIdHex(id) {
+			return b, nil
+		}
+	}
+	return UnmatchedBooking{}, mgo.ErrNotFound
+}
+
+func (m *memoryUnmatchedStore) FindByInviteeUUID(uuid string) (UnmatchedBooking, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, b := range m.bookings {
+		if b.InviteeUUID == uuid {
+			return b, nil
+		}
+	}
+	return UnmatchedBooking{}, mgo.ErrNotFound
+}
+
+func (m *memoryUnmatchedStore) FindByStatus(status string) ([]UnmatchedBooking, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	bookings := make([]UnmatchedBooking, 0)
+	for _, b := range m.bookings {
+		if b.Status == status {
+			bookings = append(bookings, b)
+		}
+	}
+	return bookings, nil
+}
+
+// memoryInboxStore - InboxStore kept in process memory
+type memoryInboxStore struct {
+	mu         sync.Mutex
+	deliveries []WebhookDelivery
+}
+
+func newMemoryInboxStore() *memoryInboxStore {
+	return &memoryInboxStore{}
+}
+
+func (m *memoryInboxStore) Save(d WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries = append(m.deliveries, d)
+	return nil
+}
+
+func (m *memoryInboxStore) Update(d WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.deliveries {
+		if m.deliveries[i].ID == d.ID {
+			m.deliveries[i] = d
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryInboxStore) FindByID(id string) (WebhookDelivery, error) {
+	if !govalidator.IsMongoID(id) {
+		return WebhookDelivery{}, errors.New("requested delivery ID is not a valid mongo ID")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.deliveries {
+		if d.ID == bson.ObjectIdHex(id) {
+			return d, nil
+		}
+	}
+	return WebhookDelivery{}, mgo.ErrNotFound
+}
+
+func (m *memoryInboxStore) FindByStatus(status string) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deliveries := make([]WebhookDelivery, 0)
+	for _, d := range m.deliveries {
+		if d.Status == status {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *memoryInboxStore) Claim(now time.Time, lease time.Duration) (WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next := -1
+	for i, d := range m.deliveries {
+		if (d.Status != DeliveryPending && d.Status != DeliveryProcessing) || d.NextAttemptAt.After(now) {
+			continue
+		}
+		if next < 0 || d.NextAttemptAt.Before(m.deliveries[next].NextAttemptAt) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return WebhookDelivery{}, mgo.ErrNotFound
+	}
+	m.deliveries[next].Status = DeliveryProcessing
+	m.deliveries[next].NextAttemptAt = now.Add(lease)
+	return m.deliveries[next], nil
+}
+
+// memorySchedulingStore - SchedulingStore kept in process memory
+type memorySchedulingStore struct {
+	mu        sync.Mutex
+	locations []PickupLocation
+	booked    map[string]int
+}
+
+func newMemorySchedulingStore() *memorySchedulingStore {
+	return &memorySchedulingStore{booked: map[string]int{}}
+}
+
+func (m *memorySchedulingStore) SaveLocation(l PickupLocation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locations = append(m.locations, l)
+	return nil
+}
+
+func (m *memorySchedulingStore) UpdateLocation(l PickupLocation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.locations {
+		if m.locations[i].ID == l.ID {
+			m.locations[i] = l
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memorySchedulingStore) FindLocation(id string) (PickupLocation, error) {
+	if !govalidator.IsMongoID(id) {
+		return PickupLocation{}, errors.New("requested locationID is not a valid mongo ID")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.locations {
+		if l.ID == bson.ObjectIdHex(id) {
+			return l, nil
+		}
+	}
+	return PickupLocation{}, mgo.ErrNotFound
+}
+
+func (m *memorySchedulingStore) Locations() ([]PickupLocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	locations := make([]PickupLocation, len(m.locations))
+	copy(locations, m.locations)
+	sort.SliceStable(locations, func(i, j int) bool { return locations[i].Name < locations[j].Name })
+	return locations, nil
+}
+
+func (m *memorySchedulingStore) BookedCounts(locationID bson.ObjectId, from time.Time, to time.Time) (map[int64]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	booked := map[int64]int{}
+	for t := from.Truncate(time.Minute); t.Before(to); t = t.Add(time.Minute) {
+		if n, ok := m.booked[slotID(locationID, t)]; ok {
+			booked[t.Unix()] = n
+		}
+	}
+	return booked, nil
+}
+
+func (m *memorySchedulingStore) ReserveSlot(locationID bson.ObjectId, start time.Time, capacity int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := slotID(locationID, start)
+	if m.booked[id] >= capacity {
+		return errSlotFull
+	}
+	m.booked[id]++
+	return nil
+}
+
+func (m *memorySchedulingStore) ReleaseSlot(locationID bson.ObjectId, start time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := slotID(locationID, start)
+	if m.booked[id] > 0 {
+		m.booked[id]--
+	}
+	return nil
+}
+
+// memoryCalendarFeedStore - CalendarFeedStore kept in process memory
+type memoryCalendarFeedStore struct {
+	mu    sync.RWMutex
+	feeds []CalendarFeed
+}
+
+func newMemoryCalendarFeedStore() *memoryCalendarFeedStore {
+	return &memoryCalendarFeedStore{}
+}
+
+func (m *memoryCalendarFeedStore) Save(f CalendarFeed) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.feeds = append(m.feeds, f)
+	return nil
+}
+
+func (m *memoryCalendarFeedStore) Delete(id string) error {
+	if !govalidator.IsMongoID(id) {
+		return errors.New("requested feed ID is not a valid mongo ID")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, f := range m.feeds {
+		if f.ID == bson.ObjectIdHex(id) {
+			m.feeds = append(m.feeds[:i], m.feeds[i+1:]...)
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryCalendarFeedStore) FindByID(id string) (CalendarFeed, error) {
+	if !govalidator.IsMongoID(id) {
+		return CalendarFeed{}, errors.New("requested feed ID is not a valid mongo ID")
+	}
+	return m.findOne(func(f CalendarFeed) bool { return f.ID == bson.ObjectIdHex(id) })
+}
+
+func (m *memoryCalendarFeedStore) FindByToken(token string) (CalendarFeed, error) {
+	return m.findOne(func(f CalendarFeed) bool { return f.Token == token })
+}
+
+func (m *memoryCalendarFeedStore) List() ([]CalendarFeed, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	feeds := make([]CalendarFeed, len(m.feeds))
+	copy(feeds, m.feeds)
+	return feeds, nil
+}
+
+func (m *memoryCalendarFeedStore) findOne(match func(CalendarFeed) bool) (CalendarFeed, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, f := range m.feeds {
+		if match(f) {
+			return f, nil
+		}
+	}
+	return CalendarFeed{}, mgo.ErrNotFound
+}
+
+// memoryTemplateStore - TemplateStore held in memory
+type memoryTemplateStore struct {
+	mu        sync.RWMutex
+	templates []EmailTemplate
+}
+
+func newMemoryTemplateStore() *memoryTemplateStore {
+	return &memoryTemplateStore{}
+}
+
+func (m *memoryTemplateStore) Save(t EmailTemplate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.templates {
+		if existing.Name == t.Name && existing.Version == t.Version {
+			return &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error collection: email_templates"}
+		}
+	}
+	m.templates = append(m.templates, t)
+	return nil
+}
+
+func (m *memoryTemplateStore) Latest(name string) (EmailTemplate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var latest EmailTemplate
+	for _, t := range m.templates {
+		if t.Name == name && t.Version > latest.Version {
+			latest = t
+		}
+	}
+	if latest.Version == 0 {
+		return EmailTemplate{}, mgo.ErrNotFound
+	}
+	return latest, nil
+}
+
+func (m *memoryTemplateStore) List() ([]EmailTemplate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	templates := make([]EmailTemplate, len(m.templates))
+	copy(templates, m.templates)
+	return templates, nil
+}
+
+// memoryMessageStore - MessageStore held in memory
+type memoryMessageStore struct {
+	mu       sync.RWMutex
+	messages []Message
+}
+
+func newMemoryMessageStore() *memoryMessageStore {
+	return &memoryMessageStore{}
+}
+
+func (m *memoryMessageStore) Save(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func (m *memoryMessageStore) Update(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.messages {
+		if m.messages[i].ID == msg.ID {
+			m.messages[i] = msg
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryMessageStore) RecordAttempt(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.messages {
+		if m.messages[i].ID == msg.ID {
+			m.messages[i].Status = msg.Status
+			m.messages[i].Attempts = msg.Attempts
+			m.messages[i].SentAt = msg.SentAt
+			m.messages[i].ProviderID = msg.ProviderID
+			m.messages[i].LastError = msg.LastError
+			m.messages[i].NextAttemptAt = msg.NextAttemptAt
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryMessageStore) Delete(id bson.ObjectId) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.messages {
+		if m.messages[i].ID == id {
+			m.messages = append(m.messages[:i], m.messages[i+1:]...)
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryMessageStore) FindByID(id string) (Message, error) {
+	if !govalidator.IsMongoID(id) {
+		return Message{}, errors.New("requested message ID is not a valid mongo ID")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, msg := range m.messages {
+		if msg.ID == bson.ObjectIdHex(id) {
+			return msg, nil
+		}
+	}
+	return Message{}, mgo.ErrNotFound
+}
+
+func (m *memoryMessageStore) FindByClientID(clientID string) ([]Message, error) {
+	if !govalidator.IsMongoID(clientID) {
+		return []Message{}, errors.New("requested clientID is not a valid mongo ID")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	messages := make([]Message, 0)
+	for _, msg := range m.messages {
+		if msg.ClientID == bson.ObjectIdHex(clientID) {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+func (m *memoryMessageStore) FindByStatus(status string) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	messages := make([]Message, 0)
+	for _, msg := range m.messages {
+		if msg.Status == status {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+func (m *memoryMessageStore) FindByProviderID(id string) (Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, msg := range m.messages {
+		if msg.ProviderID == id {
+			return msg, nil
+		}
+	}
+	return Message{}, mgo.ErrNotFound
+}
+
+func (m *memoryMessageStore) AddEvent(id bson.ObjectId, ev MessageEvent, delivery string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.messages {
+		if m.messages[i].ID != id {
+			continue
+		}
+		for _, existing := range m.messages[i].Events {
+			if existing.ID == ev.ID {
+				return mgo.ErrNotFound
+			}
+		}
+		m.messages[i].Events = append(m.messages[i].Events, ev)
+		m.messages[i].Delivery = delivery
+		return nil
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memoryMessageStore) Claim(now time.Time, lease time.Duration) (Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next := -1
+	for i, msg := range m.messages {
+		if (msg.Status != MessagePending && msg.Status != MessageProcessing) || msg.NextAttemptAt.After(now) {
+			continue
+		}
+		if next < 0 || msg.NextAttemptAt.Before(m.messages[next].NextAttemptAt) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return Message{}, mgo.ErrNotFound
+	}
+	m.messages[next].Status = MessageProcessing
+	m.messages[next].NextAttemptAt = now.Add(lease)
+	return m.messages[next], nil
+}
+
+// memorySettingsStore - SettingsStore held in memory
+type memorySettingsStore struct {
+	mu            sync.RWMutex
+	notifications *NotificationSettings
+}
+
+func newMemorySettingsStore() *memorySettingsStore {
+	return &memorySettingsStore{}
+}
+
+func (m *memorySettingsStore) Notifications() (NotificationSettings, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.notifications == nil {
+		return NotificationSettings{}, mgo.ErrNotFound
+	}
+	return *m.notifications, nil
+}
+
+func (m *memorySettingsStore) SaveNotifications(n NotificationSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifications = &n
+	return nil
+}
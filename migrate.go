@@ -0,0 +1,667 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	rollbar "github.com/rollbar/rollbar-go"
+)
+
+var migrationsConnection = "migrations"
+
+// duplicate appointments set aside by migration 9
+var appointmentDuplicatesConnection = "appointments_duplicates"
+
+// migration - one versioned schema change with a way to undo it
+type migration struct {
+	Version int
+	Name    string
+	Up      func(db *mgo.Database) error
+	Down    func(db *mgo.Database) error
+}
+
+// appliedMigration - the record kept in the migrations collection
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// migrations - every schema change in version order; append new ones, never edit applied ones
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "unique client email and sin",
+		Up: func(db *mgo.Database) error {
+			err := db.C(clientsConnection).EnsureIndex(mgo.Index{Key: []string{"clientEmail"}, Unique: true, Name: "clientEmail_unique"})
+			if err != nil {
+				return err
+			}
+			// sin is optional so only index the clients that have one
+			return db.C(clientsConnection).EnsureIndex(mgo.Index{Key: []string{"sin"}, Unique: true, Sparse: true, Name: "sin_unique"})
+		},
+		Down: func(db *mgo.Database) error {
+			err := db.C(clientsConnection).DropIndexName("clientEmail_unique")
+			if err != nil {
+				return err
+			}
+			return db.C(clientsConnection).DropIndexName("sin_unique")
+		},
+	},
+	{
+		Version: 2,
+		Name:    "client status index",
+		Up: func(db *mgo.Database) error {
+			return db.C(clientsConnection).EnsureIndex(mgo.Index{Key: []string{"status"}, Name: "status"})
+		},
+		Down: func(db *mgo.Database) error {
+			return db.C(clientsConnection).DropIndexName("status")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "appointment client index",
+		Up: func(db *mgo.Database) error {
+			return db.C(appointmentsConnection).EnsureIndex(mgo.Index{Key: []string{"clientid"}, Name: "clientid"})
+		},
+		Down: func(db *mgo.Database) error {
+			return db.C(appointmentsConnection).DropIndexName("clientid")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "client listing sort indexes",
+		Up: func(db *mgo.Database) error {
+			err := db.C(clientsConnection).EnsureIndex(mgo.Index{Key: []string{"status", "dateCreated", "_id"}, Name: "status_dateCreated"})
+			if err != nil {
+				return err
+			}
+			return db.C(clientsConnection).EnsureIndex(mgo.Index{Key: []string{"status", "clientName", "_id"}, Name: "status_clientName"})
+		},
+		Down: func(db *mgo.Database) error {
+			err := db.C(clientsConnection).DropIndexName("status_dateCreated")
+			if err != nil {
+				return err
+			}
+			return db.C(clientsConnection).DropIndexName("status_clientName")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "client search tokens",
+		Up: func(db *mgo.Database) error {
+			// backfill tokens for clients saved before search existed
+			var c Client
+			iter := db.C(clientsConnection).Find(nil).Iter()
+			for iter.Next(&c) {
+				err := db.C(clientsConnection).UpdateId(c.ID, bson.M{"$set": bson.M{"searchTokens": searchTokens(c)}})
+				if err != nil {
+					iter.Close()
+					return err
+				}
+			}
+			err := iter.Close()
+			if err != nil {
+				return err
+			}
+			return db.C(clientsConnection).EnsureIndex(mgo.Index{Key: []string{"searchTokens"}, Name: "searchTokens"})
+		},
+		Down: func(db *mgo.Database) error {
+			err := db.C(clientsConnection).DropIndexName("searchTokens")
+			if err != nil {
+				return err
+			}
+			_, err = db.C(clientsConnection).UpdateAll(nil, bson.M{"$unset": bson.M{"searchTokens": ""}})
+			return err
+		},
+	},
+	{
+		Version: 6,
+		Name:    "audit log client index",
+		Up: func(db *mgo.Database) error {
+			return db.C(auditConnection).EnsureIndex(mgo.Index{Key: []string{"clientID", "timestamp"}, Name: "clientID_timestamp"})
+		},
+		Down: func(db *mgo.Database) error {
+			return db.C(auditConnection).DropIndexName("clientID_timestamp")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "encrypt sin and dates of birth",
+		Up: func(db *mgo.Database) error {
+			f, err := loadFieldCipher()
+			if err != nil {
+				return err
+			}
+			_, err = rekeyClients(db, f)
+			if err != nil {
+				return err
+			}
+			// sin ciphertext differs on every write so uniqueness moves to the blind index
+			err = db.C(clientsConnection).DropIndexName("sin_unique")
+			if err != nil {
+				return err
+			}
+			return db.C(clientsConnection).EnsureIndex(mgo.Index{Key: []string{"sinHash"}, Unique: true, Sparse: true, Name: "sinHash_unique"})
+		},
+		Down: func(db *mgo.Database) error {
+			f, err := loadFieldCipher()
+			if err != nil {
+				return err
+			}
+			err = decryptClients(db, f)
+			if err != nil {
+				return err
+			}
+			err = db.C(clientsConnection).DropIndexName("sinHash_unique")
+			if err != nil {
+				return err
+			}
+			_, err = db.C(clientsConnection).UpdateAll(nil, bson.M{"$unset": bson.M{"sinHash": ""}})
+			if err != nil {
+				return err
+			}
+			return db.C(clientsConnection).EnsureIndex(mgo.Index{Key: []string{"sin"}, Unique: true, Sparse: true, Name: "sin_unique"})
+		},
+	},
+	{
+		Version: 8,
+		Name:    "appointment invitee index",
+		Up: func(db *mgo.Database) error {
+			return db.C(appointmentsConnection).EnsureIndex(mgo.Index{Key: []string{"inviteeUUID"}, Name: "inviteeUUID"})
+		},
+		Down: func(db *mgo.Database) error {
+			return db.C(appointmentsConnection).DropIndexName("inviteeUUID")
+		},
+	},
+	{
+		Version: 9,
+		Name:    "unique calendly appointment uuids",
+		Up: func(db *mgo.Database) error {
+			// fill the uuids on appointments saved before they were extracted, and park
+			// the duplicates left by retried deliveries so the unique index can be built
+			seen := map[string]bool{}
+			iter := db.C(appointmentsConnection).Find(nil).Sort("_id").Iter()
+			for {
+				var doc bson.M
+				if !iter.Next(&doc) {
+					break
+				}
+				payload, _ := doc["payload"].(bson.M)
+				event, _ := payload["event"].(bson.M)
+				invitee, _ := payload["invitee"].(bson.M)
+				eventUUID, _ := event["uuid"].(string)
+				inviteeUUID, _ := invitee["uuid"].(string)
+				if inviteeUUID == "" {
+					continue
+				}
+				key := eventUUID + "/" + inviteeUUID
+				var err error
+				if seen[key] {
+					err = db.C(appointmentDuplicatesConnection).Insert(doc)
+					if err == nil {
+						err = db.C(appointmentsConnection).RemoveId(doc["_id"])
+					}
+				} else {
+					seen[key] = true
+					err = db.C(appointmentsConnection).UpdateId(doc["_id"], bson.M{"$set": bson.M{"eventUUID": eventUUID, "inviteeUUID": inviteeUUID}})
+				}
+				if err != nil {
+					iter.Close()
+					return err
+				}
+			}
+			err := iter.Close()
+			if err != nil {
+				return err
+			}
+			return db.C(appointmentsConnection).EnsureIndex(mgo.Index{Key: []string{"eventUUID", "inviteeUUID"}, Unique: true, Sparse: true, Name: "calendly_uuids_unique"})
+		},
+		Down: func(db *mgo.Database) error {
+			err := db.C(appointmentsConnection).DropIndexName("calendly_uuids_unique")
+			if err != nil {
+				return err
+			}
+			iter := db.C(appointmentDuplicatesConnection).Find(nil).Iter()
+			for {
+				var doc bson.M
+				if !iter.Next(&doc) {
+					break
+				}
+				err = db.C(appointmentsConnection).Insert(doc)
+				if err != nil {
+					iter.Close()
+					return err
+				}
+			}
+			err = iter.Close()
+			if err != nil {
+				return err
+			}
+			err = db.C(appointmentDuplicatesConnection).DropCollection()
+			if err != nil && err.Error() != "ns not found" {
+				return err
+			}
+			return nil
+		},
+	},
+	{
+		Version: 10,
+		Name:    "unmatched appointment queue and email aliases",
+		Up: func(db *mgo.Database) error {
+			err := db.C(unmatchedConnection).EnsureIndex(mgo.Index{Key: []string{"inviteeUUID"}, Unique: true, Sparse: true, Name: "inviteeUUID_unique"})
+			if err != nil {
+				return err
+			}
+			err = db.C(unmatchedConnection).EnsureIndex(mgo.Index{Key: []string{"status", "receivedAt"}, Name: "status_receivedAt"})
+			if err != nil {
+				return err
+			}
+			return db.C(clientsConnection).EnsureIndex(mgo.Index{Key: []string{"emailAliases"}, Unique: true, Sparse: true, Name: "emailAliases_unique"})
+		},
+		Down: func(db *mgo.Database) error {
+			err := db.C(clientsConnection).DropIndexName("emailAliases_unique")
+			if err != nil {
+				return err
+			}
+			err = db.C(unmatchedConnection).DropIndexName("status_receivedAt")
+			if err != nil {
+				return err
+			}
+			return db.C(unmatchedConnection).DropIndexName("inviteeUUID_unique")
+		},
+	},
+	{
+		Version: 11,
+		Name:    "webhook inbox",
+		Up: func(db *mgo.Database) error {
+			err := db.C(inboxConnection).EnsureIndex(mgo.Index{Key: []string{"status", "nextAttemptAt"}, Name: "status_nextAttemptAt"})
+			if err != nil {
+				return err
+			}
+			return db.C(inboxConnection).EnsureIndex(mgo.Index{Key: []string{"status", "receivedAt"}, Name: "status_receivedAt"})
+		},
+		Down: func(db *mgo.Database) error {
+			err := db.C(inboxConnection).DropIndexName("status_receivedAt")
+			if err != nil {
+				return err
+			}
+			return db.C(inboxConnection).DropIndexName("status_nextAttemptAt")
+		},
+	},
+	{
+		Version: 12,
+		Name:    "structured appointments",
+		Up: func(db *mgo.Database) error {
+			// appointments used to be the delivery body as is; parse them and keep the body under raw
+			iter := db.C(appointmentsConnection).Find(bson.M{"raw": bson.M{"$exists": false}}).Iter()
+			unparsed := make([]string, 0)
+			for {
+				var doc bson.M
+				if !iter.Next(&doc) {
+					break
+				}
+				update, err := structureAppointment(doc)
+				if err != nil {
+					unparsed = append(unparsed, fmt.Sprintf("%v (%s)", doc["_id"], err))
+				}
+				err = db.C(appointmentsConnection).UpdateId(doc["_id"], update)
+				if err != nil {
+					iter.Close()
+					return err
+				}
+			}
+			if len(unparsed) > 0 {
+				// they keep their raw delivery and can be fixed by hand
+				rollbar.Error(fmt.Errorf("migration 12 kept %d appointments unparsed: %s", len(unparsed), strings.Join(unparsed, ", ")))
+			}
+			return iter.Close()
+		},
+		Down: func(db *mgo.Database) error {
+			iter := db.C(appointmentsConnection).Find(bson.M{"raw": bson.M{"$exists": true}}).Iter()
+			for {
+				var doc bson.M
+				if !iter.Next(&doc) {
+					break
+				}
+				err := db.C(appointmentsConnection).UpdateId(doc["_id"], unstructureAppointment(doc))
+				if err != nil {
+					iter.Close()
+					return err
+				}
+			}
+			return iter.Close()
+		},
+	},
+	{
+		Version: 13,
+		Name:    "native scheduling",
+		Up: func(db *mgo.Database) error {
+			return db.C(slotsConnection).EnsureIndex(mgo.Index{Key: []string{"locationID", "start"}, Name: "locationID_start"})
+		},
+		Down: func(db *mgo.Database) error {
+			return db.C(slotsConnection).DropIndexName("locationID_start")
+		},
+	},
+	{
+		Version: 14,
+		Name:    "calendar feeds",
+		Up: func(db *mgo.Database) error {
+			err := db.C(calendarFeedsConnection).EnsureIndex(mgo.Index{Key: []string{"token"}, Unique: true, Name: "token_unique"})
+			if err != nil {
+				return err
+			}
+			return db.C(appointmentsConnection).EnsureIndex(mgo.Index{Key: []string{"startTime"}, Name: "startTime"})
+		},
+		Down: func(db *mgo.Database) error {
+			err := db.C(appointmentsConnection).DropIndexName("startTime")
+			if err != nil {
+				return err
+			}
+			return db.C(calendarFeedsConnection).DropIndexName("token_unique")
+		},
+	},
+	{
+		Version: 15,
+		Name:    "appointment reminders",
+		Up: func(db *mgo.Database) error {
+			return db.C(appointmentsConnection).EnsureIndex(mgo.Index{Key: []string{"status", "startTime"}, Name: "status_startTime"})
+		},
+		Down: func(db *mgo.Database) error {
+			return db.C(appointmentsConnection).DropIndexName("status_startTime")
+		},
+	},
+	{
+		Version: 16,
+		Name:    "email templates and sent messages",
+		Up: func(db *mgo.Database) error {
+			err := db.C(emailTemplatesConnection).EnsureIndex(mgo.Index{Key: []string{"name", "version"}, Unique: true, Name: "name_version_unique"})
+			if err != nil {
+				return err
+			}
+			return db.C(messagesConnection).EnsureIndex(mgo.Index{Key: []string{"clientID", "sentAt"}, Name: "clientID_sentAt"})
+		},
+		Down: func(db *mgo.Database) error {
+			err := db.C(messagesConnection).DropIndexName("clientID_sentAt")
+			if err != nil {
+				return err
+			}
+			return db.C(emailTemplatesConnection).DropIndexName("name_version_unique")
+		},
+	},
+	{
+		Version: 17,
+		Name:    "email outbox",
+		Up: func(db *mgo.Database) error {
+			err := db.C(messagesConnection).EnsureIndex(mgo.Index{Key: []string{"status", "nextAttemptAt"}, Name: "status_nextAttemptAt"})
+			if err != nil {
+				return err
+			}
+			// queued messages are listed by when they were created, not all of them are sent
+			err = db.C(messagesConnection).EnsureIndex(mgo.Index{Key: []string{"clientID", "createdAt"}, Name: "clientID_createdAt"})
+			if err != nil {
+				return err
+			}
+			return db.C(messagesConnection).DropIndexName("clientID_sentAt")
+		},
+		Down: func(db *mgo.Database) error {
+			err := db.C(messagesConnection).EnsureIndex(mgo.Index{Key: []string{"clientID", "sentAt"}, Name: "clientID_sentAt"})
+			if err != nil {
+				return err
+			}
+			err = db.C(messagesConnection).DropIndexName("clientID_createdAt")
+			if err != nil {
+				return err
+			}
+			return db.C(messagesConnection).DropIndexName("status_nextAttemptAt")
+		},
+	},
+	{
+		Version: 18,
+		Name:    "email delivery events",
+		Up: func(db *mgo.Database) error {
+			err := db.C(messagesConnection).EnsureIndex(mgo.Index{Key: []string{"providerID"}, Sparse: true, Name: "providerID"})
+			if err != nil {
+				return err
+			}
+			return db.C(clientsConnection).EnsureIndex(mgo.Index{Key: []string{"emailIssue", "status"}, Sparse: true, Name: "emailIssue_status"})
+		},
+		Down: func(db *mgo.Database) error {
+			err := db.C(clientsConnection).DropIndexName("emailIssue_status")
+			if err != nil {
+				return err
+			}
+			return db.C(messagesConnection).DropIndexName("providerID")
+		},
+	},
+}
+
+// migrator - applies and rolls back migrations, recording each in the migrations collection
+type migrator struct {
+	conn       *mongoConn
+	migrations []migration
+}
+
+func newMigrator(conn *mongoConn) *migrator {
+	sorted := make([]migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &migrator{conn: conn, migrations: sorted}
+}
+
+func (m *migrator) applied(db *mgo.Database) (map[int]appliedMigration, error) {
+	records := make([]appliedMigration, 0)
+	err := db.C(migrationsConnection).Find(nil).All(&records)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]appliedMigration{}
+	for _, r := range records {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// Up - apply every pending migration up to and including target (0 means all)
+func (m *migrator) Up(target int) ([]migration, error) {
+	session := m.conn.session.Copy()
+	defer session.Close()
+	db := session.DB(m.conn.database)
+	applied, err := m.applied(db)
+	if err != nil {
+		return nil, err
+	}
+	ran := make([]migration, 0)
+	for _, mig := range m.migrations {
+		if target > 0 && mig.Version > target {
+			break
+		}
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+		err = mig.Up(db)
+		if err != nil {
+			return ran, fmt.Errorf("migration %d (%s): %v", mig.Version, mig.Name, err)
+		}
+		err = db.C(migrationsConnection).Insert(appliedMigration{Version: mig.Version, Name: mig.Name, AppliedAt: time.Now()})
+		if err != nil {
+			return ran, err
+		}
+		ran = append(ran, mig)
+	}
+	return ran, nil
+}
+
+// Down - roll back the most recently applied migrations, newest first
+func (m *migrator) Down(steps int) ([]migration, error) {
+	session := m.conn.session.Copy()
+	defer session.Close()
+	db := session.DB(m.conn.database)
+	applied, err := m.applied(db)
+	if err != nil {
+		return nil, err
+	}
+	ran := make([]migration, 0)
+	for i := len(m.migrations) - 1; i >= 0 && len(ran) < steps; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+		err = mig.Down(db)
+		if err != nil {
+			return ran, fmt.Errorf("migration %d (%s): %v", mig.Version, mig.Name, err)
+		}
+		err = db.C(migrationsConnection).RemoveId(mig.Version)
+		if err != nil {
+			return ran, err
+		}
+		ran = append(ran, mig)
+	}
+	return ran, nil
+}
+
+// Status - one line per known migration saying whether and when it was applied
+func (m *migrator) Status() ([]string, error) {
+	session := m.conn.session.Copy()
+	defer session.Close()
+	applied, err := m.applied(session.DB(m.conn.database))
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		state := "pending"
+		if r, ok := applied[mig.Version]; ok {
+			state = "applied " + r.AppliedAt.Format(time.RFC3339)
+		}
+		lines = append(lines, fmt.Sprintf("%4d  %-40s %s", mig.Version, mig.Name, state))
+	}
+	return lines, nil
+}
+
+// structureAppointment - migration 12's update for an appointment saved as the delivery body; the error says why
+// the body could not be parsed, in which case it is only moved under raw
+func structureAppointment(doc bson.M) (bson.M, error) {
+	delivery := bson.M{"event": doc["event"], "time": doc["time"], "payload": doc["payload"]}
+	set := bson.M{"raw": delivery}
+	update := bson.M{"$set": set, "$unset": bson.M{"event": "", "time": "", "payload": ""}}
+	// what unstructureAppointment has to put back the way it was
+	undo := bson.M{}
+	// the first appointments were saved under clientID, which the store never read
+	if _, ok := doc["clientID"]; ok {
+		if _, ok := doc["clientid"]; !ok {
+			update["$rename"] = bson.M{"clientID": "clientid"}
+			undo["clientID"] = true
+		}
+	}
+
+	data, err := json.Marshal(delivery)
+	if err == nil {
+		var apt Appointment
+		apt, err = parseCalendlyAppointment(data)
+		if err == nil {
+			set["eventTypeSlug"] = apt.EventTypeSlug
+			set["eventTypeName"] = apt.EventTypeName
+			set["startTime"] = apt.StartTime
+			set["endTime"] = apt.EndTime
+			set["timezone"] = apt.Timezone
+			set["assignedTo"] = apt.AssignedTo
+			set["location"] = apt.Location
+			set["inviteeName"] = apt.InviteeName
+			set["inviteeEmail"] = apt.InviteeEmail
+			set["phone"] = apt.Phone
+			set["otherAnswers"] = apt.OtherAnswers
+			// a status from a cancel delivery stands; one saved before there was a status takes it from the
+			// canceled flag of the booking
+			if status, _ := doc["status"].(string); status == "" {
+				set["status"] = apt.Status
+				undo["status"] = true
+			}
+		}
+	}
+	if len(undo) > 0 {
+		set["migration12"] = undo
+	}
+	return update, err
+}
+
+// unstructureAppointment - migration 12's rollback for one appointment, back to the delivery body it was saved as
+func unstructureAppointment(doc bson.M) bson.M {
+	raw, _ := doc["raw"].(bson.M)
+	unset := bson.M{
+		"raw": "", "eventTypeSlug": "", "eventTypeName": "", "startTime": "", "endTime": "", "timezone": "",
+		"assignedTo": "", "location": "", "inviteeName": "", "inviteeEmail": "", "phone": "", "otherAnswers": "",
+		"migration12": "",
+	}
+	update := bson.M{
+		"$set":   bson.M{"event": raw["event"], "time": raw["time"], "payload": raw["payload"]},
+		"$unset": unset,
+	}
+	undo, _ := doc["migration12"].(bson.M)
+	if undo["clientID"] == true {
+		update["$rename"] = bson.M{"clientid": "clientID"}
+	}
+	if undo["status"] == true {
+		unset["status"] = ""
+	}
+	return update
+}
+
+// runMigrate - the `api migrate up [version] | down [steps] | status` subcommand
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: api migrate up [version] | down [steps] | status")
+	}
+	conn, err := dialMongo()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	m := newMigrator(conn)
+
+	switch args[0] {
+	case "up":
+		target := 0
+		if len(args) > 1 {
+			target, err = strconv.Atoi(args[1])
+			if err != nil {
+				return errors.New("version must be a number")
+			}
+		}
+		ran, err := m.Up(target)
+		for _, mig := range ran {
+			fmt.Printf("applied %d %s\n", mig.Version, mig.Name)
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil {
+				return errors.New("steps must be a number")
+			}
+		}
+		ran, err := m.Down(steps)
+		for _, mig := range ran {
+			fmt.Printf("rolled back %d %s\n", mig.Version, mig.Name)
+		}
+		return err
+	case "status":
+		lines, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return nil
+	}
+	return errors.New("unknown migrate command " + args[0])
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestMigrationsAreNumberedInOrder(t *testing.T) {
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			t.Errorf("migration %q is version %d, expected %d", mig.Name, mig.Version, i+1)
+		}
+		if mig.Up == nil || mig.Down == nil {
+			t.Errorf("migration %d (%s) cannot be applied and rolled back", mig.Version, mig.Name)
+		}
+	}
+}
+
+// legacyAppointment - an appointment the way the first webhook saved it: the delivery body plus clientID
+func legacyAppointment(t *testing.T, clientID bson.ObjectId, canceled bool) bson.M {
+	t.Helper()
+	body, err := ioutil.ReadFile("webhook_fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canceled {
+		body = []byte(strings.Replace(string(body), `"canceled": false`, `"canceled": true`, 1))
+	}
+	var doc bson.M
+	err = json.Unmarshal(body, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc["_id"] = bson.NewObjectId()
+	doc["clientID"] = clientID
+	return doc
+}
+
+func TestStructureAppointment(t *testing.T) {
+	clientID := bson.NewObjectId()
+	for canceled, status := range map[bool]string{false: AppointmentActive, true: AppointmentCanceled} {
+		update, err := structureAppointment(legacyAppointment(t, clientID, canceled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := update["$set"].(bson.M)
+		if set["status"] != status || set["startTime"] == nil || set["raw"] == nil {
+			t.Errorf("canceled %v: set %v", canceled, set)
+		}
+		if rename := update["$rename"].(bson.M); rename["clientID"] != "clientid" {
+			t.Errorf("canceled %v: rename %v", canceled, rename)
+		}
+		undo := set["migration12"].(bson.M)
+		if undo["clientID"] != true || undo["status"] != true {
+			t.Errorf("canceled %v: undo %v", canceled, undo)
+		}
+	}
+
+	// saved by the typed store with a status from a cancel delivery: both are left alone
+	doc := legacyAppointment(t, clientID, false)
+	delete(doc, "clientID")
+	doc["clientid"] = clientID
+	doc["status"] = AppointmentCanceled
+	update, err := structureAppointment(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := update["$set"].(bson.M)
+	if _, ok := update["$rename"]; ok || set["status"] != nil || set["migration12"] != nil {
+		t.Errorf("changed a typed appointment's client or status: %v", update)
+	}
+
+	// one that cannot be parsed still has its body moved under raw
+	update, err = structureAppointment(bson.M{"_id": bson.NewObjectId(), "clientID": clientID, "event": "invitee.created"})
+	if err == nil || update["$set"].(bson.M)["raw"] == nil || update["$rename"] == nil {
+		t.Errorf("unparsed: %v %v", update, err)
+	}
+}
+
+func TestUnstructureAppointment(t *testing.T) {
+	raw := bson.M{"event": "invitee.created", "time": "2018-03-14T19:16:01Z", "payload": bson.M{}}
+	update := unstructureAppointment(bson.M{"raw": raw, "status": AppointmentActive, "migration12": bson.M{"clientID": true, "status": true}})
+	if rename := update["$rename"].(bson.M); rename["clientid"] != "clientID" {
+		t.Errorf("rename %v", rename)
+	}
+	if unset := update["$unset"].(bson.M); unset["status"] == nil || unset["migration12"] == nil {
+		t.Errorf("unset %v", unset)
+	}
+	if set := update["$set"].(bson.M); set["event"] != "invitee.created" {
+		t.Errorf("set %v", set)
+	}
+
+	// nothing was renamed or derived, so the client and status stay
+	update = unstructureAppointment(bson.M{"raw": raw, "status": AppointmentCanceled})
+	if _, ok := update["$rename"]; ok || update["$unset"].(bson.M)["status"] != nil {
+		t.Errorf("undid what migration 12 did not do: %v", update)
+	}
+}
@@ -2,8 +2,7 @@ package main
 
 import (
 	"errors"
-
-	"github.com/labstack/echo"
+	"time"
 
 	"github.com/spf13/cast"
 	"github.com/spf13/viper"
@@ -13,162 +12,870 @@ import (
 	"github.com/globalsign/mgo/bson"
 )
 
-var db *mgo.Database
 var clientsConnection = "clients"
 var appointmentsConnection = "appointments"
 
-func connect() error {
+// mongoConn - the one session dialed at startup; operations copy it so sockets go back to the pool
+type mongoConn struct {
+	session  *mgo.Session
+	database string
+}
+
+// mongoDialInfo - where and how to connect; MONGODB_OP_TIMEOUT is the one limit on waiting for a pooled socket
+// and on every read and write, and MONGODB_DIAL_TIMEOUT bounds connecting and finding a primary
+func mongoDialInfo() (*mgo.DialInfo, error) {
 	viper.AutomaticEnv()
-	session, err := mgo.Dial(cast.ToString(viper.Get("mongodb_uri")))
+	viper.SetDefault("mongodb_pool_limit", 64)
+	viper.SetDefault("mongodb_dial_timeout", "10s")
+	viper.SetDefault("mongodb_op_timeout", "30s")
+
+	info, err := mgo.ParseURL(cast.ToString(viper.Get("mongodb_uri")))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	db = session.DB(cast.ToString(viper.Get("database")))
-	return nil
+	opTimeout := cast.ToDuration(viper.Get("mongodb_op_timeout"))
+	info.Timeout = cast.ToDuration(viper.Get("mongodb_dial_timeout"))
+	info.PoolLimit = cast.ToInt(viper.Get("mongodb_pool_limit"))
+	info.PoolTimeout = opTimeout
+	info.ReadTimeout = opTimeout
+	info.WriteTimeout = opTimeout
+	return info, nil
+}
+
+func dialMongo() (*mongoConn, error) {
+	info, err := mongoDialInfo()
+	if err != nil {
+		return nil, err
+	}
+	// the session keeps these timeouts; SetSocketTimeout would replace the read, write and dial ones together
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	session.SetSyncTimeout(info.Timeout)
+	// fail at startup rather than on the first request
+	err = session.Ping()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return &mongoConn{
+		session:  session,
+		database: cast.ToString(viper.Get("database")),
+	}, nil
+}
+
+// collection - a collection on a copied session; call done when finished with it
+func (m *mongoConn) collection(name string) (c *mgo.Collection, done func()) {
+	session := m.session.Copy()
+	return session.DB(m.database).C(name), session.Close
+}
+
+func (m *mongoConn) Close() {
+	m.session.Close()
+}
+
+// mongoClientStore - ClientStore backed by the clients collection
+// sin, clientDOB and babyDOB are encrypted on the way in and decrypted on the way out
+type mongoClientStore struct {
+	conn   *mongoConn
+	fields *fieldCipher
+}
+
+func newMongoClientStore(conn *mongoConn, fields *fieldCipher) *mongoClientStore {
+	return &mongoClientStore{conn: conn, fields: fields}
 }
 
-func saveClient(client interface{}) error {
-	err := connect()
+// openAll - decrypt a list of clients read from the collection
+func (m *mongoClientStore) openAll(clients []Client) ([]Client, error) {
+	for i := range clients {
+		var err error
+		clients[i], err = m.fields.openClient(clients[i])
+		if err != nil {
+			return []Client{}, err
+		}
+	}
+	return clients, nil
+}
+
+func (m *mongoClientStore) Save(client Client) error {
+	err := client.Validate()
+	if err != nil {
+		return err
+	}
+	client.SearchTokens = searchTokens(client)
+	client, err = m.fields.sealClient(client)
 	if err != nil {
 		return err
 	}
-	err = db.C(clientsConnection).Insert(&client)
+	c, done := m.conn.collection(clientsConnection)
+	defer done()
+	err = c.Insert(&client)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func updateClientStatus(id string, status string) error {
-	err := connect()
+// UpdateStatus - compare-and-set so two staff changing the same client cannot both win
+func (m *mongoClientStore) UpdateStatus(id string, from string, to string, reason string) error {
+	validID := govalidator.IsMongoID(id)
+	if !validID {
+		return errors.New("requested clientID is not a valid mongo ID")
+	}
+	c, done := m.conn.collection(clientsConnection)
+	defer done()
+	update := bson.M{"$set": bson.M{"status": to}, "$unset": bson.M{"statusReason": ""}}
+	if reason != "" {
+		update = bson.M{"$set": bson.M{"status": to, "statusReason": reason}}
+	}
+	err := c.Update(bson.M{"_id": bson.ObjectIdHex(id), "status": from}, update)
+	if err == mgo.ErrNotFound {
+		return errStatusChanged
+	}
 	if err != nil {
 		return err
 	}
-	err = db.C(clientsConnection).Update(bson.M{"_id": bson.ObjectIdHex(id)}, bson.M{"$set": bson.M{"status": status}})
+	return nil
+}
+
+func (m *mongoClientStore) FindByID(id string) (Client, error) {
+	validID := govalidator.IsMongoID(id)
+	if !validID {
+		return Client{}, errors.New("requested clientID is not a valid mongo ID")
+	}
+	c, done := m.conn.collection(clientsConnection)
+	defer done()
+	var client Client
+	err := c.FindId(bson.ObjectIdHex(id)).One(&client)
+	if err != nil {
+		return Client{}, err
+	}
+	return m.fields.openClient(client)
+}
+
+func (m *mongoClientStore) FindByEmail(email string) (Client, error) {
+	c, done := m.conn.collection(clientsConnection)
+	defer done()
+	var client Client
+	err := c.Find(bson.M{"$or": []bson.M{{"clientEmail": email}, {"emailAliases": email}}}).One(&client)
+	if err != nil {
+		return Client{}, err
+	}
+	return m.fields.openClient(client)
+}
+
+// AddEmailAlias - another address the client books with, searchable like their own
+func (m *mongoClientStore) AddEmailAlias(id string, email string) error {
+	client, err := m.FindByID(id)
 	if err != nil {
 		return err
 	}
-	c, err := findClientByID(id)
+	client.EmailAliases = append(client.EmailAliases, email)
+	c, done := m.conn.collection(clientsConnection)
+	defer done()
+	return c.UpdateId(client.ID, bson.M{
+		"$addToSet": bson.M{"emailAliases": email},
+		"$set":      bson.M{"searchTokens": searchTokens(client)},
+	})
+}
+
+func (m *mongoClientStore) SetEmailIssue(id string, issue string, at time.Time) error {
+	validID := govalidator.IsMongoID(id)
+	if !validID {
+		return errors.New("requested clientID is not a valid mongo ID")
+	}
+	c, done := m.conn.collection(clientsConnection)
+	defer done()
+	if issue == "" {
+		return c.UpdateId(bson.ObjectIdHex(id), bson.M{"$unset": bson.M{"emailIssue": "", "emailIssueAt": ""}})
+	}
+	return c.UpdateId(bson.ObjectIdHex(id), bson.M{"$set": bson.M{"emailIssue": issue, "emailIssueAt": at}})
+}
+
+func (m *mongoClientStore) FindBySIN(sin string) (Client, error) {
+	c, done := m.conn.collection(clientsConnection)
+	defer done()
+	var client Client
+	// sin is stored encrypted so look it up through its blind index
+	err := c.Find(bson.M{"sinHash": m.fields.BlindIndex("sin", sin)}).One(&client)
+	if err != nil {
+		return Client{}, err
+	}
+	return m.fields.openClient(client)
+}
+
+func (m *mongoClientStore) List(q ClientQuery) (ClientPage, error) {
+	c, done := m.conn.collection(clientsConnection)
+	defer done()
+	clients := make([]Client, 0)
+	// fetch one past the limit to know whether there is a next page
+	err := c.Find(q.mongoFilter()).Sort(q.mongoSort()...).Limit(q.Limit + 1).All(&clients)
+	if err != nil {
+		return ClientPage{}, err
+	}
+	clients, err = m.openAll(clients)
+	if err != nil {
+		return ClientPage{}, err
+	}
+	return q.page(clients), nil
+}
+
+func (m *mongoClientStore) Search(q SearchQuery) (SearchResults, error) {
+	c, done := m.conn.collection(clientsConnection)
+	defer done()
+	ranked := make([]Client, 0)
+	err := c.Pipe(q.mongoPipeline()).All(&ranked)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	ranked, err = m.openAll(ranked)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	return q.page(ranked), nil
+}
+
+// mongoAppointmentStore - AppointmentStore backed by the appointments collection
+type mongoAppointmentStore struct {
+	conn *mongoConn
+}
+
+func newMongoAppointmentStore(conn *mongoConn) *mongoAppointmentStore {
+	return &mongoAppointmentStore{conn: conn}
+}
+
+func (m *mongoAppointmentStore) Save(apt Appointment) error {
+	err := apt.Validate()
 	if err != nil {
 		return err
 	}
-	if status == "APPROVED" {
-		err = sendMakeApptEmail(cast.ToString(c["clientEmail"]))
-		if err != nil {
-			return err
-		}
+	c, done := m.conn.collection(appointmentsConnection)
+	defer done()
+	err = c.Insert(&apt)
+	if err != nil {
+		return err
 	}
 	return nil
 }
 
-func findClientByID(id string) (echo.Map, error) {
-	err := connect()
+// set - $set the fields on one appointment, leaving the rest of the document as it is
+func (m *mongoAppointmentStore) set(id bson.ObjectId, fields bson.M) error {
+	c, done := m.conn.collection(appointmentsConnection)
+	defer done()
+	return c.UpdateId(id, bson.M{"$set": fields})
+}
+
+func (m *mongoAppointmentStore) SetAttendance(id bson.ObjectId, attendance string, at time.Time) error {
+	return m.set(id, bson.M{"attendance": attendance, "attendanceAt": at})
+}
+
+func (m *mongoAppointmentStore) Cancel(id bson.ObjectId, reason string, canceler string, at time.Time) error {
+	fields := bson.M{"status": AppointmentCanceled, "canceledAt": at}
+	// empty strings are left off like omitempty does on insert
+	if reason != "" {
+		fields["cancelReason"] = reason
+	}
+	if canceler != "" {
+		fields["cancelerName"] = canceler
+	}
+	return m.set(id, fields)
+}
+
+func (m *mongoAppointmentStore) SetReplacedBy(id bson.ObjectId, replacedByID bson.ObjectId) error {
+	return m.set(id, bson.M{"replacedByID": replacedByID})
+}
+
+func (m *mongoAppointmentStore) SetReplaces(id bson.ObjectId, replacesID bson.ObjectId) error {
+	return m.set(id, bson.M{"replacesID": replacesID})
+}
+
+func (m *mongoAppointmentStore) FindByInviteeUUID(uuid string) (Appointment, error) {
+	c, done := m.conn.collection(appointmentsConnection)
+	defer done()
+	var apt Appointment
+	err := c.Find(bson.M{"inviteeUUID": uuid}).One(&apt)
+	if err != nil {
+		return Appointment{}, err
+	}
+	return apt, nil
+}
+
+func (m *mongoAppointmentStore) FindByBookingUUIDs(eventUUID string, inviteeUUID string) (Appointment, error) {
+	c, done := m.conn.collection(appointmentsConnection)
+	defer done()
+	var apt Appointment
+	err := c.Find(bson.M{"eventUUID": eventUUID, "inviteeUUID": inviteeUUID}).One(&apt)
 	if err != nil {
-		return echo.Map{}, err
+		return Appointment{}, err
 	}
+	return apt, nil
+}
+
+func (m *mongoAppointmentStore) FindByID(id string) (Appointment, error) {
 	validID := govalidator.IsMongoID(id)
 	if !validID {
-		return echo.Map{}, errors.New("requested clientID is not a valid mongo ID")
+		return Appointment{}, errors.New("requested appointmentID is not a valid mongo ID")
+	}
+	c, done := m.conn.collection(appointmentsConnection)
+	defer done()
+	var apt Appointment
+	err := c.FindId(bson.ObjectIdHex(id)).One(&apt)
+	if err != nil {
+		return Appointment{}, err
+	}
+	return apt, nil
+}
+
+func (m *mongoAppointmentStore) FindByClientID(clientID string) ([]Appointment, error) {
+	validID := govalidator.IsMongoID(clientID)
+	if !validID {
+		return []Appointment{}, errors.New("requested clientID is not a valid mongo ID")
+	}
+	c, done := m.conn.collection(appointmentsConnection)
+	defer done()
+	appointments := make([]Appointment, 0)
+	err := c.Find(bson.M{"clientid": bson.ObjectIdHex(clientID)}).All(&appointments)
+	if err != nil {
+		return []Appointment{}, err
+	}
+	return appointments, nil
+}
+
+func (m *mongoAppointmentStore) FindBetween(from time.Time, to time.Time) ([]Appointment, error) {
+	c, done := m.conn.collection(appointmentsConnection)
+	defer done()
+	appointments := make([]Appointment, 0)
+	err := c.Find(bson.M{"startTime": bson.M{"$gte": from, "$lt": to}}).Sort("startTime").All(&appointments)
+	if err != nil {
+		return []Appointment{}, err
+	}
+	return appointments, nil
+}
+
+func (m *mongoAppointmentStore) DueForReminder(reminder string, from time.Time, to time.Time) ([]Appointment, error) {
+	c, done := m.conn.collection(appointmentsConnection)
+	defer done()
+	appointments := make([]Appointment, 0)
+	err := c.Find(bson.M{
+		"status":        AppointmentActive,
+		"startTime":     bson.M{"$gt": from, "$lte": to},
+		"remindersSent": bson.M{"$ne": reminder},
+	}).All(&appointments)
+	if err != nil {
+		return []Appointment{}, err
+	}
+	return appointments, nil
+}
+
+// MarkReminded - conditional on the first reminder so two API instances never both send it
+func (m *mongoAppointmentStore) MarkReminded(id bson.ObjectId, reminders []string) error {
+	c, done := m.conn.collection(appointmentsConnection)
+	defer done()
+	return c.Update(
+		bson.M{"_id": id, "remindersSent": bson.M{"$ne": reminders[0]}},
+		bson.M{"$addToSet": bson.M{"remindersSent": bson.M{"$each": reminders}}},
+	)
+}
+
+func (m *mongoAppointmentStore) UnmarkReminded(id bson.ObjectId, reminders []string) error {
+	c, done := m.conn.collection(appointmentsConnection)
+	defer done()
+	return c.UpdateId(id, bson.M{"$pullAll": bson.M{"remindersSent": reminders}})
+}
+
+// mongoAuditStore - AuditStore backed by the audit_log collection, which is only ever inserted into
+type mongoAuditStore struct {
+	conn *mongoConn
+}
+
+func newMongoAuditStore(conn *mongoConn) *mongoAuditStore {
+	return &mongoAuditStore{conn: conn}
+}
+
+func (m *mongoAuditStore) Append(entry AuditEntry) error {
+	c, done := m.conn.collection(auditConnection)
+	defer done()
+	return c.Insert(&entry)
+}
+
+func (m *mongoAuditStore) FindByClientID(clientID string) ([]AuditEntry, error) {
+	validID := govalidator.IsMongoID(clientID)
+	if !validID {
+		return []AuditEntry{}, errors.New("requested clientID is not a valid mongo ID")
 	}
-	var client echo.Map
-	err = db.C(clientsConnection).FindId(bson.ObjectIdHex(id)).One(&client)
+	c, done := m.conn.collection(auditConnection)
+	defer done()
+	entries := make([]AuditEntry, 0)
+	err := c.Find(bson.M{"clientID": bson.ObjectIdHex(clientID)}).Sort("timestamp").All(&entries)
 	if err != nil {
-		return echo.Map{}, err
+		return []AuditEntry{}, err
 	}
-	return client, nil
+	return entries, nil
 }
 
-func findClientByEmail(email string) (echo.Map, error) {
-	err := connect()
+// mongoUnmatchedStore - UnmatchedStore backed by the unmatched_appointments collection
+type mongoUnmatchedStore struct {
+	conn *mongoConn
+}
+
+func newMongoUnmatchedStore(conn *mongoConn) *mongoUnmatchedStore {
+	return &mongoUnmatchedStore{conn: conn}
+}
+
+func (m *mongoUnmatchedStore) Save(b UnmatchedBooking) error {
+	c, done := m.conn.collection(unmatchedConnection)
+	defer done()
+	return c.Insert(&b)
+}
+
+func (m *mongoUnmatchedStore) Update(b UnmatchedBooking) error {
+	c, done := m.conn.collection(unmatchedConnection)
+	defer done()
+	return c.UpdateId(b.ID, &b)
+}
+
+func (m *mongoUnmatchedStore) FindByID(id string) (UnmatchedBooking, error) {
+	validID := govalidator.IsMongoID(id)
+	if !validID {
+		return UnmatchedBooking{}, errors.New("requested unmatched appointment ID is not a valid mongo ID")
+	}
+	c, done := m.conn.collection(unmatchedConnection)
+	defer done()
+	var b UnmatchedBooking
+	err := c.FindId(bson.ObjectIdHex(id)).One(&b)
 	if err != nil {
-		return echo.Map{}, err
+		return UnmatchedBooking{}, err
 	}
-	var client echo.Map
-	err = db.C(clientsConnection).Find(bson.M{"clientEmail": email}).One(&client)
+	return b, nil
+}
+
+func (m *mongoUnmatchedStore) FindByInviteeUUID(uuid string) (UnmatchedBooking, error) {
+	c, done := m.conn.collection(unmatchedConnection)
+	defer done()
+	var b UnmatchedBooking
+	err := c.Find(bson.M{"inviteeUUID": uuid}).One(&b)
 	if err != nil {
-		return echo.Map{}, err
+		return UnmatchedBooking{}, err
 	}
-	return client, nil
+	return b, nil
 }
 
-func findClientBySIN(sin string) (echo.Map, error) {
-	err := connect()
+func (m *mongoUnmatchedStore) FindByStatus(status string) ([]UnmatchedBooking, error) {
+	c, done := m.conn.collection(unmatchedConnection)
+	defer done()
+	bookings := make([]UnmatchedBooking, 0)
+	err := c.Find(bson.M{"status": status}).Sort("receivedAt").All(&bookings)
 	if err != nil {
-		return echo.Map{}, err
+		return []UnmatchedBooking{}, err
+	}
+	return bookings, nil
+}
+
+// mongoInboxStore - InboxStore backed by the webhook_inbox collection
+type mongoInboxStore struct {
+	conn *mongoConn
+}
+
+func newMongoInboxStore(conn *mongoConn) *mongoInboxStore {
+	return &mongoInboxStore{conn: conn}
+}
+
+func (m *mongoInboxStore) Save(d WebhookDelivery) error {
+	c, done := m.conn.collection(inboxConnection)
+	defer done()
+	return c.Insert(&d)
+}
+
+func (m *mongoInboxStore) Update(d WebhookDelivery) error {
+	c, done := m.conn.collection(inboxConnection)
+	defer done()
+	return c.UpdateId(d.ID, &d)
+}
+
+func (m *mongoInboxStore) FindByID(id string) (WebhookDelivery, error) {
+	validID := govalidator.IsMongoID(id)
+	if !validID {
+		return WebhookDelivery{}, errors.New("requested delivery ID is not a valid mongo ID")
 	}
-	var client echo.Map
-	err = db.C(clientsConnection).Find(bson.M{"sin": sin}).One(&client)
+	c, done := m.conn.collection(inboxConnection)
+	defer done()
+	var d WebhookDelivery
+	err := c.FindId(bson.ObjectIdHex(id)).One(&d)
 	if err != nil {
-		return echo.Map{}, err
+		return WebhookDelivery{}, err
 	}
-	return client, nil
+	return d, nil
 }
 
-func findClientsByApprovedStatus(status string) ([]echo.Map, error) {
-	err := connect()
+func (m *mongoInboxStore) FindByStatus(status string) ([]WebhookDelivery, error) {
+	c, done := m.conn.collection(inboxConnection)
+	defer done()
+	deliveries := make([]WebhookDelivery, 0)
+	err := c.Find(bson.M{"status": status}).Sort("receivedAt").All(&deliveries)
 	if err != nil {
-		return []echo.Map{}, err
+		return []WebhookDelivery{}, err
+	}
+	return deliveries, nil
+}
+
+// Claim - findAndModify so two API instances never process the same delivery at once
+func (m *mongoInboxStore) Claim(now time.Time, lease time.Duration) (WebhookDelivery, error) {
+	c, done := m.conn.collection(inboxConnection)
+	defer done()
+	var d WebhookDelivery
+	due := bson.M{
+		"status":        bson.M{"$in": []string{DeliveryPending, DeliveryProcessing}},
+		"nextAttemptAt": bson.M{"$lte": now},
+	}
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"status": DeliveryProcessing, "nextAttemptAt": now.Add(lease)}},
+		ReturnNew: true,
 	}
-	clients := make([]echo.Map, 0)
-	err = db.C(clientsConnection).Find(bson.M{"status": status}).All(&clients)
+	_, err := c.Find(due).Sort("nextAttemptAt").Apply(change, &d)
 	if err != nil {
-		return []echo.Map{}, err
+		return WebhookDelivery{}, err
 	}
-	return clients, nil
+	return d, nil
 }
 
-func findClientsByPartialName(name string) ([]echo.Map, error) {
-	err := connect()
+// mongoSchedulingStore - SchedulingStore backed by the pickup_locations and slot_bookings collections
+type mongoSchedulingStore struct {
+	conn *mongoConn
+}
+
+func newMongoSchedulingStore(conn *mongoConn) *mongoSchedulingStore {
+	return &mongoSchedulingStore{conn: conn}
+}
+
+func (m *mongoSchedulingStore) SaveLocation(l PickupLocation) error {
+	c, done := m.conn.collection(locationsConnection)
+	defer done()
+	return c.Insert(&l)
+}
+
+func (m *mongoSchedulingStore) UpdateLocation(l PickupLocation) error {
+	c, done := m.conn.collection(locationsConnection)
+	defer done()
+	return c.UpdateId(l.ID, &l)
+}
+
+func (m *mongoSchedulingStore) FindLocation(id string) (PickupLocation, error) {
+	validID := govalidator.IsMongoID(id)
+	if !validID {
+		return PickupLocation{}, errors.New("requested locationID is not a valid mongo ID")
+	}
+	c, done := m.conn.collection(locationsConnection)
+	defer done()
+	var l PickupLocation
+	err := c.FindId(bson.ObjectIdHex(id)).One(&l)
 	if err != nil {
-		return []echo.Map{}, err
+		return PickupLocation{}, err
 	}
-	clients := make([]echo.Map, 0)
-	regexStr := `.*` + name + `.*`
-	err = db.C(clientsConnection).Find(bson.M{"clientName": bson.M{"$regex": bson.RegEx{Pattern: regexStr, Options: "i"}}}).All(&clients)
+	return l, nil
+}
+
+func (m *mongoSchedulingStore) Locations() ([]PickupLocation, error) {
+	c, done := m.conn.collection(locationsConnection)
+	defer done()
+	locations := make([]PickupLocation, 0)
+	err := c.Find(nil).Sort("name").All(&locations)
 	if err != nil {
-		return []echo.Map{}, err
+		return []PickupLocation{}, err
 	}
-	return clients, nil
+	return locations, nil
 }
 
-func saveAppointment(apt echo.Map) error {
-	err := connect()
+func (m *mongoSchedulingStore) BookedCounts(locationID bson.ObjectId, from time.Time, to time.Time) (map[int64]int, error) {
+	c, done := m.conn.collection(slotsConnection)
+	defer done()
+	var slots []struct {
+		Start  time.Time `bson:"start"`
+		Booked int       `bson:"booked"`
+	}
+	err := c.Find(bson.M{"locationID": locationID, "start": bson.M{"$gte": from, "$lt": to}}).All(&slots)
 	if err != nil {
+		return nil, err
+	}
+	booked := map[int64]int{}
+	for _, slot := range slots {
+		booked[slot.Start.Unix()] = slot.Booked
+	}
+	return booked, nil
+}
+
+// ReserveSlot - the capacity check and the increment are one update, so two families cannot take the last place
+func (m *mongoSchedulingStore) ReserveSlot(locationID bson.ObjectId, start time.Time, capacity int) error {
+	c, done := m.conn.collection(slotsConnection)
+	defer done()
+	id := slotID(locationID, start)
+	_, err := c.Upsert(bson.M{"_id": id}, bson.M{"$setOnInsert": bson.M{"locationID": locationID, "start": start.UTC(), "booked": 0}})
+	if err != nil && !mgo.IsDup(err) {
+		// a duplicate means a concurrent booking created the counter first
 		return err
 	}
-	err = db.C(appointmentsConnection).Insert(&apt)
+	err = c.Update(bson.M{"_id": id, "booked": bson.M{"$lt": capacity}}, bson.M{"$inc": bson.M{"booked": 1}})
+	if err == mgo.ErrNotFound {
+		return errSlotFull
+	}
+	return err
+}
+
+func (m *mongoSchedulingStore) ReleaseSlot(locationID bson.ObjectId, start time.Time) error {
+	c, done := m.conn.collection(slotsConnection)
+	defer done()
+	err := c.Update(bson.M{"_id": slotID(locationID, start), "booked": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"booked": -1}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// mongoCalendarFeedStore - CalendarFeedStore backed by the calendar_feeds collection
+type mongoCalendarFeedStore struct {
+	conn *mongoConn
+}
+
+func newMongoCalendarFeedStore(conn *mongoConn) *mongoCalendarFeedStore {
+	return &mongoCalendarFeedStore{conn: conn}
+}
+
+func (m *mongoCalendarFeedStore) Save(f CalendarFeed) error {
+	c, done := m.conn.collection(calendarFeedsConnection)
+	defer done()
+	return c.Insert(&f)
+}
+
+func (m *mongoCalendarFeedStore) Delete(id string) error {
+	validID := govalidator.IsMongoID(id)
+	if !validID {
+		return errors.New("requested feed ID is not a valid mongo ID")
+	}
+	c, done := m.conn.collection(calendarFeedsConnection)
+	defer done()
+	return c.RemoveId(bson.ObjectIdHex(id))
+}
+
+func (m *mongoCalendarFeedStore) FindByID(id string) (CalendarFeed, error) {
+	validID := govalidator.IsMongoID(id)
+	if !validID {
+		return CalendarFeed{}, errors.New("requested feed ID is not a valid mongo ID")
+	}
+	c, done := m.conn.collection(calendarFeedsConnection)
+	defer done()
+	var f CalendarFeed
+	err := c.FindId(bson.ObjectIdHex(id)).One(&f)
 	if err != nil {
-		return err
+		return CalendarFeed{}, err
 	}
-	return nil
+	return f, nil
 }
 
-func findAppointmentByID(id string) (echo.Map, error) {
-	err := connect()
+func (m *mongoCalendarFeedStore) FindByToken(token string) (CalendarFeed, error) {
+	c, done := m.conn.collection(calendarFeedsConnection)
+	defer done()
+	var f CalendarFeed
+	err := c.Find(bson.M{"token": token}).One(&f)
 	if err != nil {
-		return echo.Map{}, err
+		return CalendarFeed{}, err
 	}
-	var apt echo.Map
-	err = db.C(appointmentsConnection).FindId(bson.ObjectIdHex(id)).One(&apt)
+	return f, nil
+}
+
+func (m *mongoCalendarFeedStore) List() ([]CalendarFeed, error) {
+	c, done := m.conn.collection(calendarFeedsConnection)
+	defer done()
+	feeds := make([]CalendarFeed, 0)
+	err := c.Find(nil).Sort("createdAt").All(&feeds)
 	if err != nil {
-		return echo.Map{}, err
+		return []CalendarFeed{}, err
 	}
-	return apt, nil
+	return feeds, nil
+}
+
+// mongoTemplateStore - TemplateStore backed by the email_templates collection, one document per version
+type mongoTemplateStore struct {
+	conn *mongoConn
+}
+
+func newMongoTemplateStore(conn *mongoConn) *mongoTemplateStore {
+	return &mongoTemplateStore{conn: conn}
+}
+
+func (m *mongoTemplateStore) Save(t EmailTemplate) error {
+	c, done := m.conn.collection(emailTemplatesConnection)
+	defer done()
+	return c.Insert(&t)
+}
+
+func (m *mongoTemplateStore) Latest(name string) (EmailTemplate, error) {
+	c, done := m.conn.collection(emailTemplatesConnection)
+	defer done()
+	var t EmailTemplate
+	err := c.Find(bson.M{"name": name}).Sort("-version").One(&t)
+	if err != nil {
+		return EmailTemplate{}, err
+	}
+	return t, nil
 }
 
-func findAppointmentsByClientID(id string) ([]echo.Map, error) {
-	err := connect()
+func (m *mongoTemplateStore) List() ([]EmailTemplate, error) {
+	c, done := m.conn.collection(emailTemplatesConnection)
+	defer done()
+	templates := make([]EmailTemplate, 0)
+	err := c.Find(nil).Sort("name", "-version").All(&templates)
 	if err != nil {
-		return []echo.Map{}, err
+		return []EmailTemplate{}, err
 	}
-	appointments := make([]echo.Map, 0)
+	return templates, nil
+}
+
+// mongoMessageStore - MessageStore backed by the messages collection, which is the email outbox
+type mongoMessageStore struct {
+	conn *mongoConn
+}
+
+func newMongoMessageStore(conn *mongoConn) *mongoMessageStore {
+	return &mongoMessageStore{conn: conn}
+}
+
+func (m *mongoMessageStore) Save(msg Message) error {
+	c, done := m.conn.collection(messagesConnection)
+	defer done()
+	return c.Insert(&msg)
+}
+
+func (m *mongoMessageStore) Update(msg Message) error {
+	c, done := m.conn.collection(messagesConnection)
+	defer done()
+	return c.UpdateId(msg.ID, &msg)
+}
+
+// RecordAttempt - $set only what a send changes, so a mailgun event recorded while it was sending is kept
+func (m *mongoMessageStore) RecordAttempt(msg Message) error {
+	c, done := m.conn.collection(messagesConnection)
+	defer done()
+	return c.UpdateId(msg.ID, bson.M{"$set": bson.M{
+		"status":        msg.Status,
+		"attempts":      msg.Attempts,
+		"sentAt":        msg.SentAt,
+		"providerID":    msg.ProviderID,
+		"lastError":     msg.LastError,
+		"nextAttemptAt": msg.NextAttemptAt,
+	}})
+}
+
+func (m *mongoMessageStore) Delete(id bson.ObjectId) error {
+	c, done := m.conn.collection(messagesConnection)
+	defer done()
+	return c.RemoveId(id)
+}
+
+func (m *mongoMessageStore) FindByID(id string) (Message, error) {
 	validID := govalidator.IsMongoID(id)
 	if !validID {
-		return []echo.Map{}, errors.New("requested clientID is not a valid mongo ID")
+		return Message{}, errors.New("requested message ID is not a valid mongo ID")
 	}
-	err = db.C(appointmentsConnection).Find(bson.M{"clientid": bson.ObjectIdHex(id)}).All(&appointments)
+	c, done := m.conn.collection(messagesConnection)
+	defer done()
+	var msg Message
+	err := c.FindId(bson.ObjectIdHex(id)).One(&msg)
 	if err != nil {
-		return []echo.Map{}, err
+		return Message{}, err
 	}
-	return appointments, nil
+	return msg, nil
+}
+
+func (m *mongoMessageStore) FindByClientID(clientID string) ([]Message, error) {
+	validID := govalidator.IsMongoID(clientID)
+	if !validID {
+		return []Message{}, errors.New("requested clientID is not a valid mongo ID")
+	}
+	c, done := m.conn.collection(messagesConnection)
+	defer done()
+	messages := make([]Message, 0)
+	err := c.Find(bson.M{"clientID": bson.ObjectIdHex(clientID)}).Sort("createdAt").All(&messages)
+	if err != nil {
+		return []Message{}, err
+	}
+	return messages, nil
+}
+
+func (m *mongoMessageStore) FindByStatus(status string) ([]Message, error) {
+	c, done := m.conn.collection(messagesConnection)
+	defer done()
+	messages := make([]Message, 0)
+	err := c.Find(bson.M{"status": status}).Sort("createdAt").All(&messages)
+	if err != nil {
+		return []Message{}, err
+	}
+	return messages, nil
+}
+
+func (m *mongoMessageStore) FindByProviderID(id string) (Message, error) {
+	c, done := m.conn.collection(messagesConnection)
+	defer done()
+	var msg Message
+	err := c.Find(bson.M{"providerID": id}).One(&msg)
+	if err != nil {
+		return Message{}, err
+	}
+	return msg, nil
+}
+
+// AddEvent - the event id in the filter makes a repeated event a no-op
+func (m *mongoMessageStore) AddEvent(id bson.ObjectId, ev MessageEvent, delivery string) error {
+	c, done := m.conn.collection(messagesConnection)
+	defer done()
+	return c.Update(
+		bson.M{"_id": id, "events.id": bson.M{"$ne": ev.ID}},
+		bson.M{"$push": bson.M{"events": ev}, "$set": bson.M{"delivery": delivery}},
+	)
+}
+
+// Claim - findAndModify so two API instances never send the same message at once
+func (m *mongoMessageStore) Claim(now time.Time, lease time.Duration) (Message, error) {
+	c, done := m.conn.collection(messagesConnection)
+	defer done()
+	var msg Message
+	due := bson.M{
+		"status":        bson.M{"$in": []string{MessagePending, MessageProcessing}},
+		"nextAttemptAt": bson.M{"$lte": now},
+	}
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"status": MessageProcessing, "nextAttemptAt": now.Add(lease)}},
+		ReturnNew: true,
+	}
+	_, err := c.Find(due).Sort("nextAttemptAt").Apply(change, &msg)
+	if err != nil {
+		return Message{}, err
+	}
+	return msg, nil
+}
+
+// mongoSettingsStore - SettingsStore backed by the settings collection, one document per kind of setting
+type mongoSettingsStore struct {
+	conn *mongoConn
+}
+
+func newMongoSettingsStore(conn *mongoConn) *mongoSettingsStore {
+	return &mongoSettingsStore{conn: conn}
+}
+
+func (m *mongoSettingsStore) Notifications() (NotificationSettings, error) {
+	c, done := m.conn.collection(settingsConnection)
+	defer done()
+	var n NotificationSettings
+	err := c.FindId(notificationSettingsID).One(&n)
+	if err != nil {
+		return NotificationSettings{}, err
+	}
+	return n, nil
+}
+
+func (m *mongoSettingsStore) SaveNotifications(n NotificationSettings) error {
+	c, done := m.conn.collection(settingsConnection)
+	defer done()
+	_, err := c.UpsertId(notificationSettingsID, &n)
+	return err
 }
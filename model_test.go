@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMongoDialInfoTimeouts(t *testing.T) {
+	os.Setenv("MONGODB_URI", "mongodb://localhost:27017")
+	os.Setenv("MONGODB_OP_TIMEOUT", "5s")
+	defer os.Unsetenv("MONGODB_URI")
+	defer os.Unsetenv("MONGODB_OP_TIMEOUT")
+	info, err := mongoDialInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ReadTimeout != 5*time.Second || info.WriteTimeout != 5*time.Second || info.PoolTimeout != 5*time.Second {
+		t.Errorf("operations should all wait MONGODB_OP_TIMEOUT, got %+v", info)
+	}
+	if info.Timeout != 10*time.Second {
+		t.Errorf("dial timeout = %s", info.Timeout)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/labstack/echo"
+	rollbar "github.com/rollbar/rollbar-go"
+)
+
+var settingsConnection = "settings"
+
+// notificationSettingsID - the settings document for notifications; a deployment serves one organization
+const notificationSettingsID = "notifications"
+
+// EventReceived - a referral coming in, notified like a status but before the client has one to change from
+const EventReceived = "RECEIVED"
+
+// NotificationRecipients - who is emailed about one event
+type NotificationRecipients struct {
+	Client   bool `json:"client" bson:"client"`
+	Referrer bool `json:"referrer" bson:"referrer"`
+}
+
+// NotificationSettings - the organization's choice of emails, keyed by RECEIVED or the status being entered
+type NotificationSettings struct {
+	ID        string                            `json:"-" bson:"_id"`
+	Events    map[string]NotificationRecipients `json:"events" bson:"events"`
+	UpdatedBy *Actor                            `json:"updatedBy,omitempty" bson:"updatedBy,omitempty"`
+	UpdatedAt time.Time                         `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+}
+
+// SettingsStore - persistence for organization settings
+type SettingsStore interface {
+	Notifications() (NotificationSettings, error)
+	SaveNotifications(n NotificationSettings) error
+}
+
+// defaultNotifications - what is sent until an admin changes it
+func defaultNotifications() NotificationSettings {
+	return NotificationSettings{
+		ID: notificationSettingsID,
+		Events: map[string]NotificationRecipients{
+			EventReceived:    {Referrer: true},
+			StatusApproved:   {Client: true, Referrer: true},
+			StatusDeclined:   {Client: true},
+			StatusWaitlisted: {Client: true},
+		},
+	}
+}
+
+// notificationTemplate - the template for an event and audience: the event in lowercase, with _referrer for
+// the agency worker; approval keeps the name it had before notifications could be configured
+func notificationTemplate(event string, referrer bool) string {
+	name := strings.ToLower(event)
+	if event == StatusApproved {
+		name = templateApproval
+	}
+	if referrer {
+		name += "_referrer"
+	}
+	return name
+}
+
+// notifications - the saved settings, or the defaults when there are none
+func (s *server) notifications() (NotificationSettings, error) {
+	n, err := s.settings.Notifications()
+	if err == mgo.ErrNotFound {
+		return defaultNotifications(), nil
+	}
+	return n, err
+}
+
+// notificationEmails - the emails for a client entering a state, not yet saved; an email that cannot be made,
+// such as one whose template no longer renders, is reported and left out rather than holding up the change
+func (s *server) notificationEmails(c Client, from string, to string, reason string) ([]Message, error) {
+	if from == StatusScheduled && to == StatusApproved {
+		// a canceled booking returning the client to approved is not a decision anyone needs telling about
+		return nil, nil
+	}
+	n, err := s.notifications()
+	if err != nil {
+		return nil, err
+	}
+	recipients := n.Events[to]
+	data := clientEmailData(c)
+	data.Status = to
+	data.Reason = reason
+	if to == StatusApproved && recipients.Client {
+		// the link signs the family in, so it is only made for their email
+		data.BookingURL, err = bookingLink(c)
+		if err != nil {
+			notificationFailed(c, to, err)
+			recipients.Client = false
+		}
+	}
+	messages := make([]Message, 0)
+	if recipients.Client && c.ClientEmail != "" {
+		msg, err := s.newMessage(notificationTemplate(to, false), c.ClientEmail, data)
+		if err != nil {
+			notificationFailed(c, to, err)
+		} else {
+			messages = append(messages, msg)
+		}
+	}
+	if recipients.Referrer && c.ReferrerEmail != "" {
+		msg, err := s.newMessage(notificationTemplate(to, true), c.ReferrerEmail, data)
+		if err != nil {
+			notificationFailed(c, to, err)
+		} else {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+// notificationFailed - report an email that was left out; staff can still see the change in the audit log
+func notificationFailed(c Client, event string, err error) {
+	rollbar.Error(errors.New(event + " notification for client " + c.ID.Hex() + ": " + err.Error()))
+}
+
+// notifiable - the events notifications can be set for: every status but PENDING, which is where
+// RECEIVED leaves a client
+func notifiable(event string) bool {
+	if event == EventReceived {
+		return true
+	}
+	return knownStatus(event) && event != StatusPending
+}
+
+// validateNotifications - every event must be notifiable and every email turned on must have a template to send
+func (s *server) validateNotifications(n NotificationSettings) error {
+	errs := ValidationErrors{}
+	for event, recipients := range n.Events {
+		if !notifiable(event) {
+			errs[event] = "is not RECEIVED or a status a client can move to"
+			continue
+		}
+		for _, referrer := range []bool{false, true} {
+			if (referrer && !recipients.Referrer) || (!referrer && !recipients.Client) {
+				continue
+			}
+			name := notificationTemplate(event, referrer)
+			_, err := s.emailTemplate(name)
+			if err == mgo.ErrNotFound {
+				errs[event] = "needs a " + name + " email template"
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (s *server) notificationSettings(ctx echo.Context) error {
+	if !hasRole(ctx, RoleAdmin) {
+		m := echo.Map{}
+		m["error"] = "only admins can manage notifications"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	n, err := s.notifications()
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(http.StatusOK, n)
+}
+
+// saveNotificationSettings - replace the organization's notifications; events left out send nothing
+func (s *server) saveNotificationSettings(ctx echo.Context) error {
+	if !hasRole(ctx, RoleAdmin) {
+		m := echo.Map{}
+		m["error"] = "only admins can manage notifications"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(ctx.Request().Body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	var n NotificationSettings
+	err = json.Unmarshal(buf.Bytes(), &n)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	if n.Events == nil {
+		n.Events = map[string]NotificationRecipients{}
+	}
+	err = s.validateNotifications(n)
+	if _, ok := err.(ValidationErrors); ok {
+		return validationError(ctx, err)
+	}
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	actor := actorFrom(ctx)
+	n.ID = notificationSettingsID
+	n.UpdatedBy = &actor
+	n.UpdatedAt = time.Now()
+	err = s.settings.SaveNotifications(n)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(http.StatusOK, n)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// recipientsOf - who was queued an email from each template for the client
+func recipientsOf(t *testing.T, api *testAPI, c Client) map[string]string {
+	t.Helper()
+	messages, err := api.messages.FindByClientID(c.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := map[string]string{}
+	for _, msg := range messages {
+		sent[msg.Template] = msg.Recipient
+	}
+	return sent
+}
+
+func TestDefaultNotifications(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	sent := recipientsOf(t, api, c)
+	if len(sent) != 1 || sent["received_referrer"] != "rita@agency.org" {
+		t.Fatalf("a referral should only acknowledge the referrer, got %v", sent)
+	}
+
+	rec := api.call("PATCH", "/clients/"+c.ID.Hex(), `{"status":"DECLINED","reason":"outside our area"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("decline: %d %s", rec.Code, rec.Body)
+	}
+	sent = recipientsOf(t, api, c)
+	if sent["declined"] != "ann@example.com" || sent["declined_referrer"] != "" {
+		t.Errorf("a decline should only email the client, got %v", sent)
+	}
+}
+
+func TestNotificationSettings(t *testing.T) {
+	api := newTestAPI()
+	rec := api.call("PUT", "/notification_settings", `{"events":{}}`, RoleCaseworker)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("caseworker: got %d", rec.Code)
+	}
+	rec = api.call("PUT", "/notification_settings", `{"events":{"PENDING":{"client":true},"FULFILLED":{"client":true}}}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid settings: %d %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Fields map[string]string `json:"fields"`
+	}
+	decode(t, rec, &body)
+	// PENDING is never entered through a change and FULFILLED has no template yet
+	if body.Fields["PENDING"] == "" || body.Fields["FULFILLED"] == "" {
+		t.Errorf("expected both events refused, got %s", rec.Body)
+	}
+
+	rec = api.call("PUT", "/notification_settings", `{"events":{"DECLINED":{"client":true,"referrer":true}}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("save: %d %s", rec.Code, rec.Body)
+	}
+	var saved NotificationSettings
+	decode(t, api.call("GET", "/notification_settings", ""), &saved)
+	if len(saved.Events) != 1 || !saved.Events[StatusDeclined].Referrer || saved.UpdatedBy == nil {
+		t.Errorf("unexpected settings %+v", saved)
+	}
+
+	// an event left out sends nothing, including the acknowledgment that was on by default
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	if sent := recipientsOf(t, api, c); len(sent) != 0 {
+		t.Errorf("RECEIVED was turned off, got %v", sent)
+	}
+	api.call("PATCH", "/clients/"+c.ID.Hex(), `{"status":"DECLINED"}`)
+	sent := recipientsOf(t, api, c)
+	if sent["declined"] != "ann@example.com" || sent["declined_referrer"] != "rita@agency.org" {
+		t.Errorf("expected the decline to go to both, got %v", sent)
+	}
+}
+
+func TestCanceledBookingSendsNothing(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	actor := Actor{Subject: "auth0|staff"}
+	c, _ = api.transition(actor, c, StatusApproved)
+	c, _ = api.transition(actor, c, StatusScheduled)
+	before, _ := api.messages.FindByClientID(c.ID.Hex())
+	_, err := api.transition(actor, c, StatusApproved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := api.messages.FindByClientID(c.ID.Hex())
+	if len(after) != len(before) {
+		t.Errorf("returning to approved after a cancel queued %d emails", len(after)-len(before))
+	}
+}
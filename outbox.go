@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+	rollbar "github.com/rollbar/rollbar-go"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+var messagesConnection = "messages"
+
+// message states: staged ones wait for the status change they belong to, pending and processing ones are
+// picked up by the worker, dead ones wait for a retry
+const (
+	MessageStaged     = "staged"
+	MessagePending    = "pending"
+	MessageProcessing = "processing"
+	MessageSent       = "sent"
+	MessageDead       = "dead"
+)
+
+// Message - an email in the outbox, rendered when it was queued and kept with the template version used
+type Message struct {
+	ID            bson.ObjectId `json:"_id" bson:"_id"`
+	ClientID      bson.ObjectId `json:"clientID,omitempty" bson:"clientID,omitempty"`
+	AppointmentID bson.ObjectId `json:"appointmentID,omitempty" bson:"appointmentID,omitempty"`
+	Template      string        `json:"template" bson:"template"`
+	Version       int           `json:"version" bson:"version"`
+	Source        string        `json:"templateSource" bson:"templateSource,omitempty"`
+	Recipient     string        `json:"recipient" bson:"recipient"`
+	Subject       string        `json:"subject" bson:"subject"`
+	HTML          string        `json:"-" bson:"html"`
+	Text          string        `json:"-" bson:"text"`
+	Status        string        `json:"status" bson:"status"`
+	// ClientStatus - the status change a staged message belongs to
+	ClientStatus string `json:"-" bson:"clientStatus,omitempty"`
+	Attempts     int    `json:"attempts" bson:"attempts"`
+	LastError    string `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	ProviderID   string `json:"providerID,omitempty" bson:"providerID,omitempty"`
+	// Delivery - the furthest mailgun has reported the message getting, with every event it sent
+	Delivery      string         `json:"delivery,omitempty" bson:"delivery,omitempty"`
+	Events        []MessageEvent `json:"events,omitempty" bson:"events,omitempty"`
+	CreatedAt     time.Time      `json:"createdAt" bson:"createdAt"`
+	NextAttemptAt time.Time      `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	SentAt        time.Time      `json:"sentAt,omitempty" bson:"sentAt,omitempty"`
+}
+
+// MessageStore - persistence for the outbox
+type MessageStore interface {
+	Save(m Message) error
+	Update(m Message) error
+	// RecordAttempt - save the outcome of a send without touching the delivery events that may already be arriving
+	RecordAttempt(m Message) error
+	Delete(id bson.ObjectId) error
+	FindByID(id string) (Message, error)
+	FindByClientID(id string) ([]Message, error)
+	FindByStatus(status string) ([]Message, error)
+	FindByProviderID(id string) (Message, error)
+	// AddEvent - record a delivery event once, mgo.ErrNotFound when it was already recorded
+	AddEvent(id bson.ObjectId, ev MessageEvent, delivery string) error
+	// Claim - take the oldest due message and lease it until now+lease so a crashed worker's claim expires
+	Claim(now time.Time, lease time.Duration) (Message, error)
+}
+
+func outboxConfig() retrySettings {
+	viper.AutomaticEnv()
+	viper.SetDefault("outbox_poll_interval", "10s")
+	viper.SetDefault("outbox_backoff", "1m")
+	viper.SetDefault("outbox_max_backoff", "6h")
+	viper.SetDefault("outbox_max_attempts", 10)
+	viper.SetDefault("outbox_lease", "5m")
+	return retrySettings{
+		PollInterval: cast.ToDuration(viper.Get("outbox_poll_interval")),
+		Backoff:      cast.ToDuration(viper.Get("outbox_backoff")),
+		MaxBackoff:   cast.ToDuration(viper.Get("outbox_max_backoff")),
+		MaxAttempts:  cast.ToInt(viper.Get("outbox_max_attempts")),
+		Lease:        cast.ToDuration(viper.Get("outbox_lease")),
+	}
+}
+
+// newMessage - the newest version of a template rendered for one recipient, not yet saved
+func (s *server) newMessage(name string, recipient string, data emailData) (Message, error) {
+	t, err := s.emailTemplate(name)
+	if err == mgo.ErrNotFound {
+		return Message{}, errors.New("there is no " + name + " email template")
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	r, err := t.render(data)
+	if err != nil {
+		return Message{}, err
+	}
+	now := time.Now()
+	return Message{
+		ID:            bson.NewObjectId(),
+		ClientID:      data.clientID,
+		AppointmentID: data.appointmentID,
+		Template:      t.Name,
+		Version:       t.Version,
+		Source:        t.Source,
+		Recipient:     recipient,
+		Subject:       r.Subject,
+		HTML:          r.HTML,
+		Text:          r.Text,
+		Status:        MessagePending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}, nil
+}
+
+func (s *server) wakeOutbox() {
+	select {
+	case s.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// queueEmail - put an email in the outbox to go out right away
+func (s *server) queueEmail(name string, recipient string, data emailData) error {
+	msg, err := s.newMessage(name, recipient, data)
+	if err != nil {
+		return err
+	}
+	err = s.messages.Save(msg)
+	if err != nil {
+		return err
+	}
+	s.wakeOutbox()
+	return nil
+}
+
+// stageNotifications - save the notifications for a status change, or for RECEIVED a new client, before it is
+// written; nothing is sent until they are released
+func (s *server) stageNotifications(c Client, from string, to string, reason string) ([]Message, error) {
+	messages, err := s.notificationEmails(c, from, to, reason)
+	if err != nil {
+		return nil, err
+	}
+	// a new referral's notifications belong to the client being saved as it is
+	status := to
+	if to == EventReceived {
+		status = c.Status
+	}
+	staged := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		msg.Status = MessageStaged
+		msg.ClientStatus = status
+		err = s.messages.Save(msg)
+		if err != nil {
+			s.discardEmails(staged)
+			return nil, err
+		}
+		staged = append(staged, msg)
+	}
+	return staged, nil
+}
+
+// releaseEmails - hand staged emails to the worker once their status change is written; one that fails here
+// is released by the worker when its lease runs out
+func (s *server) releaseEmails(staged []Message) {
+	for _, msg := range staged {
+		msg.Status = MessagePending
+		msg.ClientStatus = ""
+		msg.NextAttemptAt = time.Now()
+		err := s.messages.Update(msg)
+		if err != nil {
+			rollbar.Error(err)
+		}
+	}
+	if len(staged) > 0 {
+		s.wakeOutbox()
+	}
+}
+
+// discardEmails - drop staged emails whose status change did not happen
+func (s *server) discardEmails(staged []Message) {
+	for _, msg := range staged {
+		err := s.messages.Delete(msg.ID)
+		if err != nil {
+			rollbar.Error(err)
+		}
+	}
+}
+
+// recoverStaged - settle emails left staged by an instance that stopped between the status change and the release
+func (s *server) recoverStaged(cfg retrySettings, now time.Time) {
+	staged, err := s.messages.FindByStatus(MessageStaged)
+	if err != nil {
+		rollbar.Error(err)
+		return
+	}
+	for _, msg := range staged {
+		if msg.CreatedAt.After(now.Add(-cfg.Lease)) {
+			// the request that staged it may still be running
+			continue
+		}
+		client, err := s.clients.FindByID(msg.ClientID.Hex())
+		if err != nil && err != mgo.ErrNotFound {
+			rollbar.Error(err)
+			continue
+		}
+		if err == nil && client.Status == msg.ClientStatus {
+			s.releaseEmails([]Message{msg})
+		} else {
+			s.discardEmails([]Message{msg})
+		}
+	}
+}
+
+// sendMessage - one delivery attempt; failures are retried with backoff until the message is dead
+func (s *server) sendMessage(cfg retrySettings, msg Message) Message {
+	msg.Attempts++
+	id, err := s.mailer.Send(outgoingEmail{
+		From:    mailerConfig().From,
+		To:      msg.Recipient,
+		Subject: msg.Subject,
+		HTML:    msg.HTML,
+		Text:    msg.Text,
+	})
+	now := time.Now()
+	switch {
+	case err == nil:
+		msg.Status = MessageSent
+		msg.LastError = ""
+		msg.ProviderID = id
+		msg.SentAt = now
+	case isPermanent(err) || msg.Attempts >= cfg.MaxAttempts:
+		msg.Status = MessageDead
+		msg.LastError = err.Error()
+		rollbar.Error(errors.New("message " + msg.ID.Hex() + " to " + msg.Recipient + " dead-lettered: " + err.Error()))
+	default:
+		msg.Status = MessagePending
+		msg.LastError = err.Error()
+		msg.NextAttemptAt = now.Add(cfg.backoff(msg.Attempts))
+	}
+	err = s.messages.RecordAttempt(msg)
+	if err != nil {
+		// the lease runs out and the message is sent again, so a duplicate is possible but not a loss
+		rollbar.Error(err)
+	}
+	return msg
+}
+
+// drainOutbox - send every message that is due
+func (s *server) drainOutbox(cfg retrySettings) {
+	s.recoverStaged(cfg, time.Now())
+	for {
+		msg, err := s.messages.Claim(time.Now(), cfg.Lease)
+		if err == mgo.ErrNotFound {
+			return
+		}
+		if err != nil {
+			rollbar.Error(err)
+			return
+		}
+		s.sendMessage(cfg, msg)
+	}
+}
+
+// runOutbox - the worker: drain on every poll and whenever an email is queued
+func (s *server) runOutbox() {
+	cfg := outboxConfig()
+	ticker := time.NewTicker(cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		s.drainOutbox(cfg)
+		select {
+		case <-ticker.C:
+		case <-s.outboxWake:
+		}
+	}
+}
+
+// clientMessages - the emails queued for a client and where each one is
+func (s *server) clientMessages(ctx echo.Context) error {
+	if !policyFor(ctx).sensitive() {
+		m := echo.Map{}
+		m["error"] = "messages are only available to caseworkers and admins"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	messages, err := s.messages.FindByClientID(ctx.Param("id"))
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].CreatedAt.Before(messages[j].CreatedAt) })
+	return ctx.JSON(http.StatusOK, messages)
+}
+
+func (s *server) outboxMessages(ctx echo.Context) error {
+	if !hasRole(ctx, RoleAdmin) {
+		m := echo.Map{}
+		m["error"] = "the outbox is only available to admins"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	status := ctx.QueryParam("status")
+	if status == "" {
+		status = MessageDead
+	}
+	messages, err := s.messages.FindByStatus(status)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(http.StatusOK, messages)
+}
+
+// retryMessage - put a message back to its first attempt and send it now
+func (s *server) retryMessage(ctx echo.Context) error {
+	if !hasRole(ctx, RoleAdmin) {
+		m := echo.Map{}
+		m["error"] = "the outbox is only available to admins"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	msg, err := s.messages.FindByID(ctx.Param("id"))
+	if err == mgo.ErrNotFound {
+		m := echo.Map{}
+		m["error"] = "message not found"
+		return ctx.JSON(404, m)
+	}
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	if msg.Status != MessageDead {
+		m := echo.Map{}
+		m["error"] = "only dead messages can be retried, this one is " + msg.Status
+		return ctx.JSON(http.StatusConflict, m)
+	}
+	msg.Attempts = 0
+	return ctx.JSON(http.StatusOK, s.sendMessage(outboxConfig(), msg))
+}
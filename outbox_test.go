@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var testRetries = retrySettings{Backoff: time.Minute, MaxBackoff: 5 * time.Minute, MaxAttempts: 3, Lease: time.Minute}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1: time.Minute,
+		2: 2 * time.Minute,
+		3: 4 * time.Minute,
+		4: 5 * time.Minute,
+		9: 5 * time.Minute,
+	} {
+		if got := testRetries.backoff(attempts); got != want {
+			t.Errorf("attempt %d: got %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+// queuedMessage - queue an email for the client and claim it as the worker would
+func queuedMessage(t *testing.T, api *testAPI, c Client) Message {
+	t.Helper()
+	err := api.queueEmail(templateReminder, c.ClientEmail, clientEmailData(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := api.messages.Claim(time.Now(), testRetries.Lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSendMessageRetries(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	api.drainOutbox(testRetries)
+	msg := queuedMessage(t, api, c)
+
+	api.mailer.err = errors.New("connection refused")
+	before := time.Now()
+	msg = api.sendMessage(testRetries, msg)
+	if msg.Status != MessagePending || msg.Attempts != 1 || msg.LastError != "connection refused" {
+		t.Fatalf("a failed send should be retried, got %+v", msg)
+	}
+	if msg.NextAttemptAt.Before(before.Add(time.Minute)) {
+		t.Errorf("retried without backing off: %s", msg.NextAttemptAt)
+	}
+	msg = api.sendMessage(testRetries, msg)
+	msg = api.sendMessage(testRetries, msg)
+	if msg.Status != MessageDead || msg.Attempts != 3 {
+		t.Fatalf("expected a dead letter after the last attempt, got %+v", msg)
+	}
+
+	// an admin retry starts over and sends it
+	api.mailer.err = nil
+	rec := api.call("POST", "/messages/"+msg.ID.Hex()+"/retry", "")
+	var retried Message
+	decode(t, rec, &retried)
+	if retried.Status != MessageSent || retried.Attempts != 1 || retried.ProviderID == "" || retried.LastError != "" {
+		t.Errorf("retry: %d %+v", rec.Code, retried)
+	}
+}
+
+func TestSendMessagePermanentFailure(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	api.drainOutbox(testRetries)
+	msg := queuedMessage(t, api, c)
+
+	api.mailer.err = permanentError{errors.New("recipient rejected")}
+	msg = api.sendMessage(testRetries, msg)
+	if msg.Status != MessageDead || msg.Attempts != 1 {
+		t.Errorf("a permanent failure should not be retried, got %+v", msg)
+	}
+}
+
+func TestSendMessageKeepsDeliveryEvents(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	api.drainOutbox(testRetries)
+	msg := queuedMessage(t, api, c)
+
+	// mailgun's webhook lands while the worker still holds its copy of the message
+	err := api.messages.AddEvent(msg.ID, MessageEvent{ID: "ev1", Event: "delivered", Timestamp: time.Now()}, "delivered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.sendMessage(testRetries, msg)
+	saved, _ := api.messages.FindByID(msg.ID.Hex())
+	if saved.Status != MessageSent || saved.Delivery != "delivered" || len(saved.Events) != 1 {
+		t.Errorf("the send overwrote the delivery events: %+v", saved)
+	}
+}
+
+func TestBrokenTemplateDoesNotBlockStatusChange(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	rec := api.call("POST", "/email_templates/declined", `{"subject":"Update","html":"<p>{{.Name.First}}</p>"}`)
+	if rec.Code != 201 {
+		t.Fatalf("save template: %d %s", rec.Code, rec.Body)
+	}
+
+	declined, err := api.transition(Actor{Subject: "auth0|staff"}, c, StatusDeclined)
+	if err != nil || declined.Status != StatusDeclined {
+		t.Fatalf("the status change should go through: %+v %v", declined, err)
+	}
+	messages, _ := api.messages.FindByClientID(c.ID.Hex())
+	for _, msg := range messages {
+		if msg.Template == "declined" {
+			t.Errorf("queued an email from a template that does not render: %+v", msg)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// sortRelevance - search's default order: best score first, then name and id
+const sortRelevance = "relevance"
+
+// sortable client fields; a leading "-" on the sort param means descending
+var clientSortFields = []string{"dateCreated", "clientName"}
+
+// ClientQuery - filters, sort order and page position for client listings
+type ClientQuery struct {
+	Status      string
+	EmailIssue  string
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	SortField   string
+	Descending  bool
+	Limit       int
+	After       *pageCursor
+}
+
+// ClientPage - one page of clients and the cursor to fetch the next one
+type ClientPage struct {
+	Data       []Client `json:"data"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+// pageCursor - the sort value and id of the last client on the previous page; it is also how two clients are
+// compared, so the memory store and the cursor always agree on the order
+type pageCursor struct {
+	Sort  string        `json:"s"`
+	Score int           `json:"r,omitempty"`
+	Name  string        `json:"n,omitempty"`
+	Date  time.Time     `json:"d,omitempty"`
+	ID    bson.ObjectId `json:"i"`
+}
+
+func (cur pageCursor) encode() string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (q ClientQuery) sortParam() string {
+	if q.Descending {
+		return "-" + q.SortField
+	}
+	return q.SortField
+}
+
+// position - where client c sits in the sort order; search fills in the score for relevance
+func (q ClientQuery) position(c Client) pageCursor {
+	p := pageCursor{Sort: q.sortParam(), ID: c.ID}
+	if q.SortField == "dateCreated" {
+		p.Date = c.DateCreated
+	} else {
+		p.Name = c.ClientName
+	}
+	return p
+}
+
+// compare - -1, 0 or 1 as position a comes before, at or after b: the sort field in the requested direction,
+// then _id in the same direction as mongoSort's tie breaker
+func (q ClientQuery) compare(a, b pageCursor) int {
+	cmp := 0
+	switch q.SortField {
+	case sortRelevance:
+		// higher scores first, then the name and id ascending
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		cmp = strings.Compare(a.Name, b.Name)
+	case "clientName":
+		cmp = strings.Compare(a.Name, b.Name)
+	default:
+		if a.Date.Before(b.Date) {
+			cmp = -1
+		} else if a.Date.After(b.Date) {
+			cmp = 1
+		}
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.ID.Hex(), b.ID.Hex())
+	}
+	if q.Descending {
+		return -cmp
+	}
+	return cmp
+}
+
+// page - trim the one extra client fetched past the limit and turn it into a next cursor
+func (q ClientQuery) page(clients []Client) ClientPage {
+	p := ClientPage{Data: clients}
+	if len(clients) > q.Limit {
+		p.Data = clients[:q.Limit]
+		p.NextCursor = q.position(p.Data[q.Limit-1]).encode()
+	}
+	return p
+}
+
+// matches - whether client c passes the filters and sorts after the cursor
+func (q ClientQuery) matches(c Client) bool {
+	return q.filtered(c) && q.after(q.position(c))
+}
+
+// filtered - whether client c passes the status, email issue and creation date filters
+func (q ClientQuery) filtered(c Client) bool {
+	if q.Status != "" && c.Status != q.Status {
+		return false
+	}
+	if q.EmailIssue != "" && c.EmailIssue != q.EmailIssue {
+		return false
+	}
+	if !q.CreatedFrom.IsZero() && c.DateCreated.Before(q.CreatedFrom) {
+		return false
+	}
+	if !q.CreatedTo.IsZero() && !c.DateCreated.Before(q.CreatedTo) {
+		return false
+	}
+	return true
+}
+
+// less - the sort order used by the memory store, matching mongoSort
+func (q ClientQuery) less(a, b Client) bool {
+	return q.compare(q.position(a), q.position(b)) < 0
+}
+
+// after - whether position p sorts strictly after the cursor
+func (q ClientQuery) after(p pageCursor) bool {
+	return q.After == nil || q.compare(p, *q.After) > 0
+}
+
+// mongoFilter - the filter, including the cursor position, for the query
+func (q ClientQuery) mongoFilter() bson.M {
+	filter := q.mongoFilters()
+	if q.After != nil {
+		filter["$or"] = q.mongoCursor()
+	}
+	return filter
+}
+
+// mongoFilters - the status, email issue and creation date filters
+func (q ClientQuery) mongoFilters() bson.M {
+	filter := bson.M{}
+	if q.Status != "" {
+		filter["status"] = q.Status
+	}
+	if q.EmailIssue != "" {
+		filter["emailIssue"] = q.EmailIssue
+	}
+	created := bson.M{}
+	if !q.CreatedFrom.IsZero() {
+		created["$gte"] = q.CreatedFrom
+	}
+	if !q.CreatedTo.IsZero() {
+		created["$lt"] = q.CreatedTo
+	}
+	if len(created) > 0 {
+		filter["dateCreated"] = created
+	}
+	return filter
+}
+
+// mongoCursor - the $or picking out what sorts after the cursor, the same order as compare
+func (q ClientQuery) mongoCursor() []bson.M {
+	if q.SortField == sortRelevance {
+		// searchScore is added by the search pipeline before this is matched
+		return []bson.M{
+			{"searchScore": bson.M{"$lt": q.After.Score}},
+			{"searchScore": q.After.Score, "clientName": bson.M{"$gt": q.After.Name}},
+			{"searchScore": q.After.Score, "clientName": q.After.Name, "_id": bson.M{"$gt": q.After.ID}},
+		}
+	}
+	op := "$gt"
+	if q.Descending {
+		op = "$lt"
+	}
+	var value interface{} = q.After.Date
+	if q.SortField == "clientName" {
+		value = q.After.Name
+	}
+	return []bson.M{
+		{q.SortField: bson.M{op: value}},
+		{q.SortField: value, "_id": bson.M{op: q.After.ID}},
+	}
+}
+
+// mongoSort - sort keys with _id as the tie breaker so pages never overlap
+func (q ClientQuery) mongoSort() []string {
+	if q.SortField == sortRelevance {
+		return []string{"-searchScore", "clientName", "_id"}
+	}
+	if q.Descending {
+		return []string{"-" + q.SortField, "-_id"}
+	}
+	return []string{q.SortField, "_id"}
+}
+
+// parseClientQuery - read limit, sort, cursor, emailIssue and createdFrom/createdTo from the request
+func parseClientQuery(ctx echo.Context) (ClientQuery, error) {
+	q := ClientQuery{SortField: "dateCreated", Limit: defaultPageLimit}
+
+	// clients_by_status/APPROVED?emailIssue=bounced - the families to phone because email is not reaching them
+	if issue := ctx.QueryParam("emailIssue"); issue != "" {
+		if issue != EmailBounced && issue != EmailComplained {
+			return q, errors.New("emailIssue must be bounced or complained")
+		}
+		q.EmailIssue = issue
+	}
+	err := q.parsePage(ctx, maxPageLimit, clientSortFields)
+	return q, err
+}
+
+// parsePage - read limit, sort, createdFrom/createdTo and cursor, which listings and search share
+func (q *ClientQuery) parsePage(ctx echo.Context, maxLimit int, sortFields []string) error {
+	if limit := ctx.QueryParam("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return errors.New("limit must be a positive number")
+		}
+		if n > maxLimit {
+			n = maxLimit
+		}
+		q.Limit = n
+	}
+
+	if sortParam := ctx.QueryParam("sort"); sortParam != "" {
+		q.Descending = strings.HasPrefix(sortParam, "-")
+		q.SortField = strings.TrimPrefix(sortParam, "-")
+		known := false
+		for _, field := range sortFields {
+			known = known || field == q.SortField
+		}
+		// relevance only runs best first
+		if !known || (q.Descending && q.SortField == sortRelevance) {
+			return errors.New("sort must be one of " + strings.Join(sortFields, ", "))
+		}
+	}
+
+	var err error
+	q.CreatedFrom, err = parseDateParam(ctx.QueryParam("createdFrom"), false)
+	if err != nil {
+		return errors.New("createdFrom " + err.Error())
+	}
+	q.CreatedTo, err = parseDateParam(ctx.QueryParam("createdTo"), true)
+	if err != nil {
+		return errors.New("createdTo " + err.Error())
+	}
+
+	if cursor := ctx.QueryParam("cursor"); cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return errors.New("cursor is invalid")
+		}
+		var cur pageCursor
+		err = json.Unmarshal(data, &cur)
+		if err != nil || !cur.ID.Valid() {
+			return errors.New("cursor is invalid")
+		}
+		// a cursor only makes sense for the sort order that produced it
+		if cur.Sort != q.sortParam() {
+			return errors.New("cursor does not match sort")
+		}
+		q.After = &cur
+	}
+	return nil
+}
+
+// parseDateParam - accept RFC3339 or a plain YYYY-MM-DD; a plain end date includes the whole day
+func parseDateParam(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.New("must be a YYYY-MM-DD or RFC3339 date")
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// seedClients - save clients straight to the store; every third one shares its creation time with the
+// one before so the id tie breaker is exercised
+func seedClients(t *testing.T, api *testAPI, names []string) {
+	t.Helper()
+	created := time.Date(2019, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i, name := range names {
+		if i%3 != 2 {
+			created = created.Add(time.Hour)
+		}
+		err := api.clients.Save(Client{
+			ID:          bson.NewObjectId(),
+			DateCreated: created,
+			Status:      StatusPending,
+			ClientName:  name,
+			ClientEmail: "client" + strconv.Itoa(i) + "@example.com",
+			ClientDOB:   "07-13-1995",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// walkPages - follow nextCursor from the first page to the last and return the names in the order served
+func walkPages(t *testing.T, api *testAPI, query url.Values) []string {
+	t.Helper()
+	names := make([]string, 0)
+	for pages := 0; pages < 20; pages++ {
+		rec := api.call("GET", "/clients_by_status/PENDING?"+query.Encode(), "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", query.Encode(), rec.Code, rec.Body)
+		}
+		var page struct {
+			Data       []Client `json:"data"`
+			NextCursor string   `json:"nextCursor"`
+		}
+		decode(t, rec, &page)
+		for _, c := range page.Data {
+			names = append(names, c.ClientName)
+		}
+		if page.NextCursor == "" {
+			return names
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+	t.Fatal("pagination did not end")
+	return nil
+}
+
+func TestClientPagesCoverEveryClientOnce(t *testing.T) {
+	api := newTestAPI()
+	names := []string{"Ann", "Bea", "Cal", "Dee", "Eve", "Fay", "Gus"}
+	seedClients(t, api, names)
+
+	for _, sort := range []string{"dateCreated", "-dateCreated", "clientName", "-clientName"} {
+		got := walkPages(t, api, url.Values{"limit": {"2"}, "sort": {sort}})
+		if len(got) != len(names) {
+			t.Fatalf("sort %s: got %v", sort, got)
+		}
+		seen := map[string]bool{}
+		for _, name := range got {
+			if seen[name] {
+				t.Errorf("sort %s: %s served twice in %v", sort, name, got)
+			}
+			seen[name] = true
+		}
+		if sort == "clientName" && got[0] != "Ann" || sort == "-clientName" && got[0] != "Gus" {
+			t.Errorf("sort %s: wrong order %v", sort, got)
+		}
+	}
+}
+
+func TestClientPagesFilterByCreationDate(t *testing.T) {
+	api := newTestAPI()
+	seedClients(t, api, []string{"Ann", "Bea", "Cal", "Dee"})
+	got := walkPages(t, api, url.Values{"createdFrom": {"2019-03-01T10:30:00Z"}, "createdTo": {"2019-03-01T11:30:00Z"}})
+	if len(got) != 2 || got[0] == "Ann" || got[0] == "Dee" || got[1] == "Ann" || got[1] == "Dee" {
+		t.Errorf("expected Bea and Cal, who share 11:00, got %v", got)
+	}
+	// a plain end date includes the whole day
+	got = walkPages(t, api, url.Values{"createdTo": {"2019-03-01"}})
+	if len(got) != 4 {
+		t.Errorf("expected every client created on the day, got %v", got)
+	}
+}
+
+func TestClientQueryRejectsBadParams(t *testing.T) {
+	api := newTestAPI()
+	seedClients(t, api, []string{"Ann", "Bea", "Cal"})
+	rec := api.call("GET", "/clients_by_status/PENDING?limit=1&sort=clientName", "")
+	var page struct {
+		NextCursor string `json:"nextCursor"`
+	}
+	decode(t, rec, &page)
+	if page.NextCursor == "" {
+		t.Fatalf("no cursor: %s", rec.Body)
+	}
+
+	for _, query := range []string{
+		"limit=0",
+		"limit=ten",
+		"sort=clientEmail",
+		"cursor=not-base64!",
+		"cursor=e30",
+		"sort=dateCreated&cursor=" + page.NextCursor,
+		"createdFrom=yesterday",
+	} {
+		rec := api.call("GET", "/clients_by_status/PENDING?"+query, "")
+		if rec.Code != 400 {
+			t.Errorf("%s: got %d %s", query, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestClientQueryMongoFilterMatchesCursor(t *testing.T) {
+	id := bson.NewObjectId()
+	q := ClientQuery{SortField: "clientName", Descending: true, After: &pageCursor{Name: "Bea", ID: id}}
+	or, ok := q.mongoFilter()["$or"].([]bson.M)
+	if !ok || len(or) != 2 {
+		t.Fatalf("expected a two way $or, got %v", q.mongoFilter())
+	}
+	if or[0]["clientName"].(bson.M)["$lt"] != "Bea" || or[1]["_id"].(bson.M)["$lt"] != id {
+		t.Errorf("descending cursor should page with $lt, got %v", or)
+	}
+	if sort := q.mongoSort(); sort[0] != "-clientName" || sort[1] != "-_id" {
+		t.Errorf("mongoSort = %v", sort)
+	}
+}
+
+func TestClientQueryCompare(t *testing.T) {
+	early, late := time.Date(2019, 3, 1, 9, 0, 0, 0, time.UTC), time.Date(2019, 3, 2, 9, 0, 0, 0, time.UTC)
+	low, high := bson.ObjectIdHex("5c1b7a5e8f1e4a2b3c4d5e60"), bson.ObjectIdHex("5c1b7a5e8f1e4a2b3c4d5e6f")
+	cases := []struct {
+		sort string
+		a, b pageCursor
+		want int
+	}{
+		{"dateCreated", pageCursor{Date: early, ID: high}, pageCursor{Date: late, ID: low}, -1},
+		{"-dateCreated", pageCursor{Date: early, ID: high}, pageCursor{Date: late, ID: low}, 1},
+		{"dateCreated", pageCursor{Date: early, ID: low}, pageCursor{Date: early, ID: high}, -1},
+		{"-dateCreated", pageCursor{Date: early, ID: low}, pageCursor{Date: early, ID: high}, 1},
+		{"clientName", pageCursor{Name: "Ann", ID: high}, pageCursor{Name: "Bea", ID: low}, -1},
+		{"clientName", pageCursor{Name: "Ann", ID: low}, pageCursor{Name: "Ann", ID: low}, 0},
+		{sortRelevance, pageCursor{Score: 3, Name: "Bea"}, pageCursor{Score: 1, Name: "Ann"}, -1},
+		{sortRelevance, pageCursor{Score: 3, Name: "Ann", ID: high}, pageCursor{Score: 3, Name: "Ann", ID: low}, 1},
+	}
+	for _, c := range cases {
+		q := ClientQuery{SortField: strings.TrimPrefix(c.sort, "-"), Descending: strings.HasPrefix(c.sort, "-")}
+		if got := q.compare(c.a, c.b); got != c.want {
+			t.Errorf("%s: compare(%+v, %+v) = %d, want %d", c.sort, c.a, c.b, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/spf13/cast"
+)
+
+// echo context key for the roles set by auth0Middleware
+const actorRolesKey = "actorRoles"
+
+// roles that may see the whole client record
+const (
+	RoleAdmin      = "admin"
+	RoleCaseworker = "caseworker"
+	RoleVolunteer  = "volunteer"
+)
+
+// clientReadPolicies - the client fields each role may read; nil means every field
+var clientReadPolicies = map[string][]string{
+	RoleAdmin:      nil,
+	RoleCaseworker: nil,
+	// volunteers run pickups so only need to know who is coming and how to reach them
+	RoleVolunteer: {"_id", "status", "clientName", "clientPhone"},
+}
+
+// privateAppointmentFields - what the invitee typed and the delivery it came in, only shown with full records
+var privateAppointmentFields = []string{"raw", "otherAnswers", "inviteeEmail"}
+
+// readPolicy - the union of fields readable by every role a token carries
+type readPolicy struct {
+	all    bool
+	fields map[string]bool
+}
+
+// tokenRoles - roles from the <audience>roles custom claim plus any role:<name> scopes
+func tokenRoles(claimRoles interface{}, scopes []string) []string {
+	roles := cast.ToStringSlice(claimRoles)
+	for _, scope := range scopes {
+		if strings.HasPrefix(scope, "role:") {
+			roles = append(roles, strings.TrimPrefix(scope, "role:"))
+		}
+	}
+	return roles
+}
+
+// policyFor - the read policy of the request; a token without a known role gets the volunteer view
+func policyFor(ctx echo.Context) readPolicy {
+	p := readPolicy{fields: map[string]bool{}}
+	known := false
+	for _, role := range cast.ToStringSlice(ctx.Get(actorRolesKey)) {
+		fields, ok := clientReadPolicies[strings.ToLower(role)]
+		if !ok {
+			continue
+		}
+		known = true
+		if fields == nil {
+			p.all = true
+		}
+		for _, f := range fields {
+			p.fields[f] = true
+		}
+	}
+	if !known {
+		for _, f := range clientReadPolicies[RoleVolunteer] {
+			p.fields[f] = true
+		}
+	}
+	return p
+}
+
+// hasRole - whether the request's token carries the role
+func hasRole(ctx echo.Context, role string) bool {
+	for _, r := range cast.ToStringSlice(ctx.Get(actorRolesKey)) {
+		if strings.ToLower(r) == role {
+			return true
+		}
+	}
+	return false
+}
+
+// sensitive - whether the policy sees full records, which is what history and audit need
+func (p readPolicy) sensitive() bool {
+	return p.all
+}
+
+// client - the client with every field the policy does not allow removed
+func (p readPolicy) client(c Client) interface{} {
+	if p.all {
+		return c
+	}
+	var doc map[string]interface{}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return echo.Map{}
+	}
+	json.Unmarshal(data, &doc)
+	shaped := echo.Map{}
+	for k, v := range doc {
+		if p.fields[k] {
+			shaped[k] = v
+		}
+	}
+	return shaped
+}
+
+// page - a listing envelope with each client shaped by the policy
+func (p readPolicy) page(clients []Client, nextCursor string) echo.Map {
+	data := make([]interface{}, 0, len(clients))
+	for _, c := range clients {
+		data = append(data, p.client(c))
+	}
+	m := echo.Map{"data": data}
+	if nextCursor != "" {
+		m["nextCursor"] = nextCursor
+	}
+	return m
+}
+
+// appointment - the appointment without its private fields unless the policy sees full records
+func (p readPolicy) appointment(apt Appointment) interface{} {
+	if p.all {
+		return apt
+	}
+	var doc map[string]interface{}
+	data, err := json.Marshal(apt)
+	if err != nil {
+		return echo.Map{}
+	}
+	json.Unmarshal(data, &doc)
+	for _, f := range privateAppointmentFields {
+		delete(doc, f)
+	}
+	return doc
+}
+
+// appointments - each appointment shaped by the policy
+func (p readPolicy) appointments(apts []Appointment) []interface{} {
+	shaped := make([]interface{}, 0, len(apts))
+	for _, apt := range apts {
+		shaped = append(shaped, p.appointment(apt))
+	}
+	return shaped
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestTokenRoles(t *testing.T) {
+	roles := tokenRoles([]interface{}{"caseworker"}, []string{"openid", "role:volunteer", "read:clients"})
+	if !reflect.DeepEqual(roles, []string{"caseworker", "volunteer"}) {
+		t.Errorf("got %v", roles)
+	}
+	if roles := tokenRoles(nil, nil); len(roles) != 0 {
+		t.Errorf("a token without roles got %v", roles)
+	}
+}
+
+func TestGetClientShapedByRole(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	path := "/clients/" + c.ID.Hex()
+
+	for roles, full := range map[string]bool{
+		RoleCaseworker:                  true,
+		RoleVolunteer + "," + RoleAdmin: true,
+		"Caseworker":                    true,
+		RoleVolunteer:                   false,
+		// a token without a role anyone knows gets the narrowest view, never the whole record
+		"auditor": false,
+	} {
+		rec := api.call("GET", path, "", roles)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", roles, rec.Code, rec.Body)
+		}
+		var doc map[string]interface{}
+		decode(t, rec, &doc)
+		_, sawDOB := doc["clientDOB"]
+		_, sawEmail := doc["clientEmail"]
+		if sawDOB != full || sawEmail != full {
+			t.Errorf("%s: full record %v, got %s", roles, full, rec.Body)
+		}
+		if doc["clientName"] != "Ann Smith" || doc["status"] != StatusPending {
+			t.Errorf("%s: missing the fields every role sees: %s", roles, rec.Body)
+		}
+	}
+}
+
+func TestAppointmentsShapedByRole(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	apt := Appointment{
+		ID:           bson.NewObjectId(),
+		ClientID:     c.ID,
+		Status:       AppointmentActive,
+		StartTime:    time.Date(2019, 3, 1, 17, 0, 0, 0, time.UTC),
+		EndTime:      time.Date(2019, 3, 1, 17, 30, 0, 0, time.UTC),
+		InviteeName:  "Ann Smith",
+		InviteeEmail: "ann@example.com",
+		OtherAnswers: []AppointmentAnswer{{Question: "Anything else?", Answer: "We just moved out of a shelter"}},
+		Raw:          map[string]interface{}{"event": "invitee.created"},
+	}
+	err := api.appointments.Save(apt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for roles, full := range map[string]bool{RoleCaseworker: true, RoleVolunteer: false} {
+		var list []map[string]interface{}
+		rec := api.call("GET", "/appointments_by_clientid/"+c.ID.Hex(), "", roles)
+		decode(t, rec, &list)
+		if rec.Code != http.StatusOK || len(list) != 1 {
+			t.Fatalf("%s: %d %s", roles, rec.Code, rec.Body)
+		}
+		var one map[string]interface{}
+		rec = api.call("GET", "/appointments/"+apt.ID.Hex(), "", roles)
+		decode(t, rec, &one)
+		for _, doc := range []map[string]interface{}{list[0], one} {
+			for _, f := range privateAppointmentFields {
+				if _, saw := doc[f]; saw != full {
+					t.Errorf("%s: %s shown %v, want %v", roles, f, saw, full)
+				}
+			}
+			if doc["startTime"] == nil || doc["inviteeName"] != "Ann Smith" {
+				t.Errorf("%s: missing the fields every role sees: %v", roles, doc)
+			}
+		}
+	}
+}
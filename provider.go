@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+	rollbar "github.com/rollbar/rollbar-go"
+)
+
+// appointment states
+const (
+	AppointmentActive   = "active"
+	AppointmentCanceled = "canceled"
+)
+
+// booking event kinds every provider's deliveries are normalized to
+const (
+	bookingCreated  = "created"
+	bookingCanceled = "canceled"
+)
+
+// bookingEvent - one provider delivery in terms of our appointment model
+type bookingEvent struct {
+	// Kind - bookingCreated, bookingCanceled, or empty for events we do not act on
+	Kind string
+	// Name - the provider's own name for the event, for logging
+	Name string
+	// Appointment - the full booking when created; the uuids and cancel details when canceled
+	Appointment Appointment
+	// ReplacesInvitee - on a created booking, the invitee uuid of the booking it reschedules
+	ReplacesInvitee string
+	// ReplacedByInvitee - on a canceled booking, the invitee uuid of the booking that replaced it
+	ReplacedByInvitee string
+	// CancelsReplaced - the provider sends no cancel of its own for the booking a reschedule replaces
+	CancelsReplaced bool
+}
+
+// schedulingProvider - a booking service whose webhooks create and cancel appointments
+type schedulingProvider interface {
+	Name() string
+	// Verify - reject a delivery that was not signed by the provider
+	Verify(header http.Header, body []byte, now time.Time) error
+	// Parse - the booking event a verified delivery describes
+	Parse(body []byte) (bookingEvent, error)
+}
+
+// schedulingProviders - every provider with a webhook route, by the name stored on deliveries
+var schedulingProviders = map[string]schedulingProvider{
+	providerCalendly: calendlyProvider{},
+	providerCalcom:   calcomProvider{},
+}
+
+// providerWebhook - verify a provider's delivery and put it in the inbox
+func (s *server) providerWebhook(p schedulingProvider) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		buf := new(bytes.Buffer)
+		_, err := buf.ReadFrom(ctx.Request().Body)
+		if err != nil {
+			m := echo.Map{}
+			m["error"] = err.Error()
+			return ctx.JSON(500, m)
+		}
+		body := buf.Bytes()
+		err = p.Verify(ctx.Request().Header, body, time.Now())
+		if err != nil {
+			rollbar.RequestError(rollbar.WARN, ctx.Request(), errors.New("rejected "+p.Name()+" webhook: "+err.Error()))
+			m := echo.Map{}
+			m["error"] = err.Error()
+			return ctx.JSON(http.StatusUnauthorized, m)
+		}
+		// the delivery is only acknowledged once it is stored; the inbox worker processes it
+		_, err = s.enqueue(p.Name(), body)
+		if err != nil {
+			rollbar.Error(err)
+			m := echo.Map{}
+			m["error"] = err.Error()
+			return ctx.JSON(500, m)
+		}
+		return ctx.JSON(200, "")
+	}
+}
+
+// processBooking - apply one verified delivery to appointments and the client lifecycle
+func (s *server) processBooking(p schedulingProvider, body []byte) error {
+	ev, err := p.Parse(body)
+	if err != nil {
+		return err
+	}
+	switch ev.Kind {
+	case bookingCreated:
+		return s.bookingCreated(p, body, ev)
+	case bookingCanceled:
+		return s.cancelAppointment(systemActor(p.Name()), ev)
+	}
+	rollbar.Info("ignored " + p.Name() + " event " + ev.Name)
+	return nil
+}
+
+func (s *server) bookingCreated(p schedulingProvider, body []byte, ev bookingEvent) error {
+	client, err := s.clients.FindByEmail(ev.Appointment.InviteeEmail)
+	if err == mgo.ErrNotFound {
+		// families often book with a different email to the one their referrer gave us
+		return s.queueUnmatched(p.Name(), body, ev)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.createAppointment(systemActor(p.Name()), ev, client)
+	return err
+}
+
+// createAppointment - book a created booking against the client and move them to scheduled
+func (s *server) createAppointment(actor Actor, ev bookingEvent, client Client) (Appointment, error) {
+	apt := ev.Appointment
+	apt.ID = bson.NewObjectId()
+	apt.ClientID = client.ID
+
+	// providers retry deliveries, so a booking we already have is not saved again; the steps after the save
+	// still run in case the delivery that saved it failed part way through them
+	existing, err := s.appointments.FindByBookingUUIDs(apt.EventUUID, apt.InviteeUUID)
+	if err == nil {
+		return existing, s.finishBooking(actor, ev, client, existing)
+	}
+	if err != mgo.ErrNotFound {
+		return apt, err
+	}
+
+	// a reschedule books a new invitee and cancels the old one, in either order
+	if ev.ReplacesInvitee != "" {
+		old, err := s.appointments.FindByInviteeUUID(ev.ReplacesInvitee)
+		if err != nil && err != mgo.ErrNotFound {
+			return apt, err
+		}
+		if err == nil {
+			apt.ReplacesID = old.ID
+		}
+	}
+
+	err = s.appointments.Save(apt)
+	if mgo.IsDup(err) {
+		// a concurrent retry of the same delivery got there first and finishes the booking
+		return s.appointments.FindByBookingUUIDs(apt.EventUUID, apt.InviteeUUID)
+	}
+	if err != nil {
+		return apt, err
+	}
+	s.audit(actor, "appointment.create", client.ID, nil, echo.Map{"appointmentID": apt.ID, "eventType": apt.EventTypeSlug, "startTime": apt.StartTime})
+	return apt, s.finishBooking(actor, ev, client, apt)
+}
+
+// finishBooking - link a saved appointment to the one it replaces and move the client to scheduled; each step
+// checks whether it is already done so a retried delivery completes what an earlier attempt started
+func (s *server) finishBooking(actor Actor, ev bookingEvent, client Client, apt Appointment) error {
+	if apt.ReplacesID != "" {
+		old, err := s.appointments.FindByID(apt.ReplacesID.Hex())
+		if err != nil {
+			return err
+		}
+		if old.ReplacedByID != apt.ID {
+			before := old
+			old.ReplacedByID = apt.ID
+			if ev.CancelsReplaced && old.Status == AppointmentActive {
+				old.Status = AppointmentCanceled
+				old.CancelReason = "rescheduled"
+				old.CanceledAt = time.Now()
+			}
+			if old.Status != before.Status {
+				err = s.appointments.Cancel(old.ID, old.CancelReason, old.CancelerName, old.CanceledAt)
+				if err != nil {
+					return err
+				}
+			}
+			// the link is written last because it is what tells a retried delivery this step is done
+			err = s.appointments.SetReplacedBy(old.ID, apt.ID)
+			if err != nil {
+				return err
+			}
+			s.audit(actor, "appointment.reschedule", client.ID, before, old)
+		}
+	}
+
+	if apt.Status != AppointmentActive || client.Status != StatusApproved {
+		return nil
+	}
+	_, err := s.transition(actor, client, StatusScheduled)
+	if err == errStatusChanged {
+		// staff or another booking moved the client first, which leaves nothing for this one to do
+		return nil
+	}
+	return err
+}
+
+// cancelAppointment - cancel the booking and, unless it was rescheduled, send the client back to booking
+func (s *server) cancelAppointment(actor Actor, ev bookingEvent) error {
+	inviteeUUID := ev.Appointment.InviteeUUID
+	apt, err := s.appointments.FindByInviteeUUID(inviteeUUID)
+	if err == mgo.ErrNotFound {
+		// the booking may still be waiting in the unmatched queue
+		err = s.cancelUnmatched(actor, inviteeUUID)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if apt.Status == AppointmentCanceled {
+		// a retried cancel delivery
+		return nil
+	}
+	before := apt
+	apt.Status = AppointmentCanceled
+	apt.CancelReason = ev.Appointment.CancelReason
+	apt.CancelerName = ev.Appointment.CancelerName
+	apt.CanceledAt = ev.Appointment.CanceledAt
+	if apt.CanceledAt.IsZero() {
+		apt.CanceledAt = time.Now()
+	}
+
+	rescheduled := ev.ReplacedByInvitee != ""
+	if rescheduled {
+		replacement, err := s.appointments.FindByInviteeUUID(ev.ReplacedByInvitee)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		if err == nil {
+			apt.ReplacedByID = replacement.ID
+			if replacement.ReplacesID == "" {
+				err = s.appointments.SetReplaces(replacement.ID, apt.ID)
+				if err != nil {
+					return err
+				}
+			}
+			err = s.appointments.SetReplacedBy(apt.ID, replacement.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the status is written last because a canceled appointment is what tells a retried delivery it is done
+	err = s.appointments.Cancel(apt.ID, apt.CancelReason, apt.CancelerName, apt.CanceledAt)
+	if err != nil {
+		return err
+	}
+	s.audit(actor, "appointment.cancel", apt.ClientID, before, apt)
+
+	// a reschedule keeps the client scheduled; a plain cancel sends them back to booking
+	if rescheduled {
+		return nil
+	}
+	client, err := s.clients.FindByID(apt.ClientID.Hex())
+	if err != nil {
+		return err
+	}
+	if client.Status != StatusScheduled {
+		return nil
+	}
+	remaining, err := s.appointments.FindByClientID(client.ID.Hex())
+	if err != nil {
+		return err
+	}
+	for _, other := range remaining {
+		if other.Status == AppointmentActive {
+			return nil
+		}
+	}
+	_, err = s.transition(actor, client, StatusApproved)
+	return err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// calendlyFixture - the captured invitee.created delivery and the approved client it books for
+func calendlyFixture(t *testing.T, api *testAPI) ([]byte, Appointment, Client) {
+	t.Helper()
+	body, err := ioutil.ReadFile("webhook_fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apt, err := parseCalendlyAppointment(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := api.createClient(t, apt.InviteeName, apt.InviteeEmail)
+	c, err = api.transition(Actor{}, c, StatusApproved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body, apt, c
+}
+
+func TestBookingDeliveryIsIdempotent(t *testing.T) {
+	api := newTestAPI()
+	body, _, c := calendlyFixture(t, api)
+	for i := 0; i < 2; i++ {
+		err := api.processBooking(calendlyProvider{}, body)
+		if err != nil {
+			t.Fatalf("delivery %d: %v", i+1, err)
+		}
+	}
+	apts, _ := api.appointments.FindByClientID(c.ID.Hex())
+	if len(apts) != 1 {
+		t.Errorf("expected one appointment, got %d", len(apts))
+	}
+	saved, _ := api.clients.FindByID(c.ID.Hex())
+	if saved.Status != StatusScheduled {
+		t.Errorf("status = %s", saved.Status)
+	}
+}
+
+func TestRetriedBookingFinishesHalfAppliedDelivery(t *testing.T) {
+	api := newTestAPI()
+	body, apt, c := calendlyFixture(t, api)
+
+	// an earlier attempt saved the appointment and failed before moving the client
+	apt.ID = bson.NewObjectId()
+	apt.ClientID = c.ID
+	err := api.appointments.Save(apt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = api.processBooking(calendlyProvider{}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := api.clients.FindByID(c.ID.Hex())
+	if saved.Status != StatusScheduled {
+		t.Errorf("retry left the client %s", saved.Status)
+	}
+	apts, _ := api.appointments.FindByClientID(c.ID.Hex())
+	if len(apts) != 1 {
+		t.Errorf("expected the one appointment, got %d", len(apts))
+	}
+}
+
+func TestRetriedBookingLeavesCanceledAppointmentAlone(t *testing.T) {
+	api := newTestAPI()
+	body, apt, c := calendlyFixture(t, api)
+	apt.ID = bson.NewObjectId()
+	apt.ClientID = c.ID
+	apt.Status = AppointmentCanceled
+	err := api.appointments.Save(apt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.processBooking(calendlyProvider{}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := api.clients.FindByID(c.ID.Hex())
+	if saved.Status != StatusApproved {
+		t.Errorf("a canceled booking scheduled the client: %s", saved.Status)
+	}
+}
+
+// calendlyCancel - an invitee.canceled delivery for the fixture's booking, replaced by newInvitee on a reschedule
+func calendlyCancel(newInvitee string) []byte {
+	replaced := "null"
+	if newInvitee != "" {
+		replaced = `{"uuid":"` + newInvitee + `"}`
+	}
+	return []byte(`{"event":"invitee.canceled","payload":{"event":{"uuid":"GBDUFZETWLK3Y2R7"},"invitee":{"uuid":"FGFXPRFA7FRJR3SQ",` +
+		`"cancel_reason":"baby came early","canceler_name":"Bevan Hunt","canceled_at":"2018-10-06T10:00:00Z"},"new_invitee":` + replaced + `}}`)
+}
+
+// calendlyReschedule - the invitee.created delivery for the booking that replaces the fixture's
+func calendlyReschedule(body []byte) []byte {
+	s := strings.Replace(string(body), "FGFXPRFA7FRJR3SQ", "RESCHEDULEDINVITEE", 1)
+	s = strings.Replace(s, "GBDUFZETWLK3Y2R7", "RESCHEDULEDEVENT", 1)
+	s = strings.Replace(s, `"old_invitee": null`, `"old_invitee": {"uuid": "FGFXPRFA7FRJR3SQ"}`, 1)
+	return []byte(s)
+}
+
+func TestCalendlyCancellation(t *testing.T) {
+	api := newTestAPI()
+	body, _, c := calendlyFixture(t, api)
+	err := api.processBooking(calendlyProvider{}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = api.processBooking(calendlyProvider{}, calendlyCancel(""))
+		if err != nil {
+			t.Fatalf("cancel %d: %v", i+1, err)
+		}
+	}
+	apt, err := api.appointments.FindByInviteeUUID("FGFXPRFA7FRJR3SQ")
+	if err != nil || apt.Status != AppointmentCanceled || apt.CancelReason != "baby came early" || apt.CanceledAt.IsZero() {
+		t.Errorf("unexpected appointment %+v %v", apt, err)
+	}
+	saved, _ := api.clients.FindByID(c.ID.Hex())
+	if saved.Status != StatusApproved {
+		t.Errorf("a canceled booking should let the client book again, got %s", saved.Status)
+	}
+}
+
+func TestCalendlyReschedule(t *testing.T) {
+	for _, cancelFirst := range []bool{false, true} {
+		api := newTestAPI()
+		body, _, c := calendlyFixture(t, api)
+		err := api.processBooking(calendlyProvider{}, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// calendly does not promise which of the two deliveries arrives first
+		deliveries := [][]byte{calendlyReschedule(body), calendlyCancel("RESCHEDULEDINVITEE")}
+		if cancelFirst {
+			deliveries[0], deliveries[1] = deliveries[1], deliveries[0]
+		}
+		for _, d := range deliveries {
+			err = api.processBooking(calendlyProvider{}, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		old, _ := api.appointments.FindByInviteeUUID("FGFXPRFA7FRJR3SQ")
+		replacement, _ := api.appointments.FindByInviteeUUID("RESCHEDULEDINVITEE")
+		if old.Status != AppointmentCanceled || replacement.Status != AppointmentActive {
+			t.Errorf("cancel first %v: old %s, replacement %s", cancelFirst, old.Status, replacement.Status)
+		}
+		if old.ReplacedByID != replacement.ID || replacement.ReplacesID != old.ID {
+			t.Errorf("cancel first %v: appointments not linked: %s -> %s, %s <- %s",
+				cancelFirst, old.ID, old.ReplacedByID, replacement.ID, replacement.ReplacesID)
+		}
+		saved, _ := api.clients.FindByID(c.ID.Hex())
+		if saved.Status != StatusScheduled {
+			t.Errorf("cancel first %v: a reschedule should keep the client scheduled, got %s", cancelFirst, saved.Status)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/labstack/echo"
+	rollbar "github.com/rollbar/rollbar-go"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// attendance outcomes staff record once the appointment time has passed
+const (
+	AttendanceAttended = "attended"
+	AttendanceNoShow   = "no_show"
+)
+
+// reminderSettings - when reminders go out and what repeated no-shows lead to
+type reminderSettings struct {
+	PollInterval time.Duration
+	// Offsets - how long before the start each reminder is sent, shortest first
+	Offsets []time.Duration
+	// NoShowLimit - the no-show that moves the client to NoShowStatus
+	NoShowLimit  int
+	NoShowStatus string
+}
+
+func reminderConfig() reminderSettings {
+	viper.AutomaticEnv()
+	viper.SetDefault("reminder_poll_interval", "5m")
+	viper.SetDefault("reminder_offsets", "48h,2h")
+	viper.SetDefault("no_show_limit", 2)
+	viper.SetDefault("no_show_status", StatusFollowUp)
+	cfg := reminderSettings{
+		PollInterval: cast.ToDuration(viper.Get("reminder_poll_interval")),
+		NoShowLimit:  cast.ToInt(viper.Get("no_show_limit")),
+		NoShowStatus: strings.ToUpper(cast.ToString(viper.Get("no_show_status"))),
+	}
+	for _, offset := range strings.Split(cast.ToString(viper.Get("reminder_offsets")), ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(offset))
+		if err == nil && d > 0 {
+			cfg.Offsets = append(cfg.Offsets, d)
+		}
+	}
+	sort.Slice(cfg.Offsets, func(i, j int) bool { return cfg.Offsets[i] < cfg.Offsets[j] })
+	return cfg
+}
+
+// validate - reject settings the api cannot act on; a no-show status the lifecycle does not allow from
+// scheduled would only be discovered when staff mark the limit-reaching no-show
+func (cfg reminderSettings) validate() error {
+	if !canTransition(StatusScheduled, cfg.NoShowStatus) {
+		return errors.New("NO_SHOW_STATUS " + cfg.NoShowStatus + " is not a status a scheduled client can move to")
+	}
+	return nil
+}
+
+// reminderName - how a reminder is recorded on the appointment, e.g. "48h"
+func reminderName(offset time.Duration) string {
+	name := offset.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = strings.TrimSuffix(name, "0s")
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = strings.TrimSuffix(name, "0m")
+	}
+	return name
+}
+
+// sendReminders - send every reminder that is due; the shortest offsets go first and also mark the
+// longer ones, so a late booking gets one reminder instead of all of them at once
+func (s *server) sendReminders(cfg reminderSettings, now time.Time) {
+	for i, offset := range cfg.Offsets {
+		reminders := make([]string, 0)
+		for _, later := range cfg.Offsets[i:] {
+			reminders = append(reminders, reminderName(later))
+		}
+		due, err := s.appointments.DueForReminder(reminders[0], now, now.Add(offset))
+		if err != nil {
+			rollbar.Error(err)
+			return
+		}
+		for _, apt := range due {
+			err = s.appointments.MarkReminded(apt.ID, reminders)
+			if err == mgo.ErrNotFound {
+				// another instance got to it first
+				continue
+			}
+			if err != nil {
+				rollbar.Error(err)
+				continue
+			}
+			err = s.queueReminder(apt)
+			if err != nil {
+				rollbar.Error(errors.New("reminder for appointment " + apt.ID.Hex() + ": " + err.Error()))
+				// try again on the next poll
+				err = s.appointments.UnmarkReminded(apt.ID, unsent(apt.RemindersSent, reminders))
+				if err != nil {
+					rollbar.Error(err)
+				}
+			}
+		}
+	}
+}
+
+// unsent - the reminders this pass marked, leaving ones sent on earlier polls alone
+func unsent(sent []string, reminders []string) []string {
+	marked := make([]string, 0)
+	for _, r := range reminders {
+		if !containsString(sent, r) {
+			marked = append(marked, r)
+		}
+	}
+	return marked
+}
+
+func (s *server) queueReminder(apt Appointment) error {
+	client, err := s.clients.FindByID(apt.ClientID.Hex())
+	if err != nil {
+		return err
+	}
+	recipient := apt.InviteeEmail
+	if recipient == "" {
+		recipient = client.ClientEmail
+	}
+	return s.queueEmail(templateReminder, recipient, appointmentEmailData(client, apt))
+}
+
+// runReminders - the reminder scheduler
+func (s *server) runReminders() {
+	cfg := reminderConfig()
+	ticker := time.NewTicker(cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		s.sendReminders(cfg, time.Now())
+		<-ticker.C
+	}
+}
+
+// markAttendance - record whether the family came; a no-show frees them to rebook until they reach the limit
+func (s *server) markAttendance(ctx echo.Context) error {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(ctx.Request().Body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	var body echo.Map
+	err = json.Unmarshal(buf.Bytes(), &body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	attendance := cast.ToString(body["attendance"])
+	if attendance != AttendanceAttended && attendance != AttendanceNoShow {
+		return validationError(ctx, ValidationErrors{"attendance": "must be attended or no_show"})
+	}
+
+	apt, err := s.appointments.FindByID(ctx.Param("id"))
+	if err == mgo.ErrNotFound {
+		m := echo.Map{}
+		m["error"] = "appointment not found"
+		return ctx.JSON(404, m)
+	}
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	if apt.Status != AppointmentActive || apt.Attendance != "" {
+		m := echo.Map{}
+		m["error"] = "attendance can only be marked once on an active appointment"
+		return ctx.JSON(http.StatusConflict, m)
+	}
+	if apt.StartTime.After(time.Now()) {
+		return validationError(ctx, ValidationErrors{"attendance": "cannot be marked before the appointment starts"})
+	}
+
+	client, err := s.clients.FindByID(apt.ClientID.Hex())
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	before := apt
+	apt.Attendance = attendance
+	apt.AttendanceAt = time.Now()
+	to := client.Status
+	if client.Status == StatusScheduled {
+		to, err = s.afterAttendance(client, apt)
+		if err != nil {
+			m := echo.Map{}
+			m["error"] = err.Error()
+			return ctx.JSON(500, m)
+		}
+		// checked before anything is written so a client the lifecycle cannot move is not left half marked
+		if to != client.Status && !canTransition(client.Status, to) {
+			m := echo.Map{}
+			m["error"] = TransitionError{From: client.Status, To: to}.Error()
+			return ctx.JSON(http.StatusConflict, m)
+		}
+	}
+
+	actor := actorFrom(ctx)
+	err = s.appointments.SetAttendance(apt.ID, apt.Attendance, apt.AttendanceAt)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	s.audit(actor, "appointment.attendance", apt.ClientID, before, apt)
+	if to == client.Status {
+		return ctx.JSON(http.StatusOK, policyFor(ctx).appointment(apt))
+	}
+	_, err = s.transition(actor, client, to)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(http.StatusConflict, m)
+	}
+	return ctx.JSON(http.StatusOK, policyFor(ctx).appointment(apt))
+}
+
+// afterAttendance - the state a scheduled client moves to once the appointment is marked, counting the
+// attendance being marked even though it is not saved yet
+func (s *server) afterAttendance(client Client, marked Appointment) (string, error) {
+	if marked.Attendance == AttendanceAttended {
+		return StatusFulfilled, nil
+	}
+	appointments, err := s.appointments.FindByClientID(client.ID.Hex())
+	if err != nil {
+		return "", err
+	}
+	noShows := 0
+	upcoming := false
+	for _, apt := range appointments {
+		if apt.ID == marked.ID {
+			apt = marked
+		}
+		if apt.Attendance == AttendanceNoShow {
+			noShows++
+		}
+		if apt.Status == AppointmentActive && apt.Attendance == "" && apt.StartTime.After(time.Now()) {
+			upcoming = true
+		}
+	}
+	cfg := reminderConfig()
+	if noShows >= cfg.NoShowLimit {
+		return cfg.NoShowStatus, nil
+	}
+	if upcoming {
+		// they already rebooked
+		return client.Status, nil
+	}
+	return StatusApproved, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestReminderSettingsValidate(t *testing.T) {
+	for status, ok := range map[string]bool{
+		StatusFollowUp: true,
+		StatusApproved: true,
+		StatusInactive: true,
+		StatusDeclined: false,
+		StatusPending:  false,
+		"LOST":         false,
+	} {
+		err := reminderSettings{NoShowStatus: status}.validate()
+		if (err == nil) != ok {
+			t.Errorf("%s: got %v", status, err)
+		}
+	}
+}
+
+func TestReminderName(t *testing.T) {
+	for offset, want := range map[time.Duration]string{
+		48 * time.Hour:   "48h",
+		90 * time.Minute: "1h30m",
+		30 * time.Minute: "30m",
+	} {
+		if got := reminderName(offset); got != want {
+			t.Errorf("%s: got %s, want %s", offset, got, want)
+		}
+	}
+}
+
+// scheduledAppointment - an active appointment for the client starting at start
+func scheduledAppointment(t *testing.T, api *testAPI, c Client, start time.Time) Appointment {
+	t.Helper()
+	apt := Appointment{ID: bson.NewObjectId(), ClientID: c.ID, Status: AppointmentActive, EventTypeName: "Pickup",
+		StartTime: start, EndTime: start.Add(30 * time.Minute), InviteeEmail: c.ClientEmail}
+	err := api.appointments.Save(apt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apt
+}
+
+func TestSendReminders(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	now := time.Now()
+	soon := scheduledAppointment(t, api, c, now.Add(time.Hour))
+	later := scheduledAppointment(t, api, c, now.Add(30*time.Hour))
+	scheduledAppointment(t, api, c, now.Add(72*time.Hour))
+	cfg := reminderSettings{Offsets: []time.Duration{2 * time.Hour, 48 * time.Hour}}
+
+	reminders := func() map[bson.ObjectId]int {
+		messages, _ := api.messages.FindByClientID(c.ID.Hex())
+		sent := map[bson.ObjectId]int{}
+		for _, msg := range messages {
+			if msg.Template == templateReminder {
+				sent[msg.AppointmentID]++
+			}
+		}
+		return sent
+	}
+
+	api.sendReminders(cfg, now)
+	sent := reminders()
+	if len(sent) != 2 || sent[soon.ID] != 1 || sent[later.ID] != 1 {
+		t.Fatalf("expected one reminder each for the next two appointments, got %v", sent)
+	}
+	// the booking inside two hours had both reminders marked, so it is not sent the 48h one as well
+	saved, _ := api.appointments.FindByID(soon.ID.Hex())
+	if len(saved.RemindersSent) != 2 {
+		t.Errorf("expected 2h and 48h marked, got %v", saved.RemindersSent)
+	}
+
+	api.sendReminders(cfg, now.Add(time.Minute))
+	if again := reminders(); len(again) != 2 || again[soon.ID] != 1 || again[later.ID] != 1 {
+		t.Errorf("the next poll sent reminders again: %v", again)
+	}
+
+	// 29 hours on the later appointment is inside two hours and gets its second reminder
+	api.sendReminders(cfg, now.Add(29*time.Hour))
+	if sent = reminders(); sent[later.ID] != 2 {
+		t.Errorf("expected the 2h reminder for the later appointment, got %v", sent)
+	}
+}
+
+// scheduledClient - a client who has booked the appointment starting at start
+func scheduledClient(t *testing.T, api *testAPI, start time.Time) (Client, Appointment) {
+	t.Helper()
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	actor := Actor{Subject: "auth0|staff"}
+	c, err := api.transition(actor, c, StatusApproved)
+	if err == nil {
+		c, err = api.transition(actor, c, StatusScheduled)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, scheduledAppointment(t, api, c, start)
+}
+
+func TestMarkAttendance(t *testing.T) {
+	api := newTestAPI()
+	c, first := scheduledClient(t, api, time.Now().Add(-time.Hour))
+
+	rec := api.call("POST", "/appointments/"+first.ID.Hex()+"/attendance", `{"attendance":"late"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unknown attendance: got %d", rec.Code)
+	}
+
+	rec = api.call("POST", "/appointments/"+first.ID.Hex()+"/attendance", `{"attendance":"no_show"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first no-show: %d %s", rec.Code, rec.Body)
+	}
+	saved, _ := api.clients.FindByID(c.ID.Hex())
+	if saved.Status != StatusApproved {
+		t.Fatalf("a first no-show should free the client to rebook, got %s", saved.Status)
+	}
+	rec = api.call("POST", "/appointments/"+first.ID.Hex()+"/attendance", `{"attendance":"attended"}`)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("marking twice: got %d", rec.Code)
+	}
+
+	saved, _ = api.transition(Actor{Subject: "auth0|staff"}, saved, StatusScheduled)
+	second := scheduledAppointment(t, api, saved, time.Now().Add(-time.Hour))
+	rec = api.call("POST", "/appointments/"+second.ID.Hex()+"/attendance", `{"attendance":"no_show"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("second no-show: %d %s", rec.Code, rec.Body)
+	}
+	saved, _ = api.clients.FindByID(c.ID.Hex())
+	if saved.Status != StatusFollowUp {
+		t.Errorf("reaching the no-show limit should need follow up, got %s", saved.Status)
+	}
+}
+
+func TestMarkAttendanceChecksTransitionFirst(t *testing.T) {
+	os.Setenv("NO_SHOW_LIMIT", "1")
+	os.Setenv("NO_SHOW_STATUS", StatusDeclined)
+	defer os.Unsetenv("NO_SHOW_LIMIT")
+	defer os.Unsetenv("NO_SHOW_STATUS")
+	api := newTestAPI()
+	c, apt := scheduledClient(t, api, time.Now().Add(-time.Hour))
+
+	rec := api.call("POST", "/appointments/"+apt.ID.Hex()+"/attendance", `{"attendance":"no_show"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected a conflict, got %d %s", rec.Code, rec.Body)
+	}
+	saved, _ := api.appointments.FindByID(apt.ID.Hex())
+	if saved.Attendance != "" {
+		t.Errorf("attendance was written without the status change: %s", saved.Attendance)
+	}
+	client, _ := api.clients.FindByID(c.ID.Hex())
+	if client.Status != StatusScheduled {
+		t.Errorf("client is %s, want SCHEDULED", client.Status)
+	}
+}
+
+// remindedAfterRead - an appointment store where the reminder worker marks every appointment just after it is
+// read, as it can between a handler's read and its write
+type remindedAfterRead struct {
+	AppointmentStore
+}
+
+func (s remindedAfterRead) FindByID(id string) (Appointment, error) {
+	apt, err := s.AppointmentStore.FindByID(id)
+	if err == nil {
+		s.MarkReminded(apt.ID, []string{"48h"})
+	}
+	return apt, err
+}
+
+func (s remindedAfterRead) FindByInviteeUUID(uuid string) (Appointment, error) {
+	apt, err := s.AppointmentStore.FindByInviteeUUID(uuid)
+	if err == nil {
+		s.MarkReminded(apt.ID, []string{"48h"})
+	}
+	return apt, err
+}
+
+func TestAppointmentWritesKeepConcurrentReminders(t *testing.T) {
+	api := newTestAPI()
+	_, apt := scheduledClient(t, api, time.Now().Add(-time.Hour))
+	api.appointments = remindedAfterRead{api.appointments}
+	rec := api.call("POST", "/appointments/"+apt.ID.Hex()+"/attendance", `{"attendance":"attended"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("attendance: %d %s", rec.Code, rec.Body)
+	}
+	saved, _ := api.appointments.FindByID(apt.ID.Hex())
+	if saved.Attendance != AttendanceAttended || !containsString(saved.RemindersSent, "48h") {
+		t.Errorf("marking attendance lost the reminder: %+v", saved)
+	}
+
+	api = newTestAPI()
+	body, _, _ := calendlyFixture(t, api)
+	err := api.processBooking(calendlyProvider{}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.appointments = remindedAfterRead{api.appointments}
+	err = api.processBooking(calendlyProvider{}, calendlyCancel(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ = api.appointments.FindByInviteeUUID("FGFXPRFA7FRJR3SQ")
+	if saved.Status != AppointmentCanceled || !containsString(saved.RemindersSent, "48h") {
+		t.Errorf("canceling lost the reminder: %+v", saved)
+	}
+}
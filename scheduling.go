@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+	rollbar "github.com/rollbar/rollbar-go"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+var locationsConnection = "pickup_locations"
+var slotsConnection = "slot_bookings"
+
+// appointments booked through our own scheduling rather than a provider's webhook
+const providerNative = "native"
+
+// echo context key for the client set by bookingAuth
+const bookingClientKey = "bookingClient"
+
+// how far ahead families may look for slots in one request
+const maxSlotRange = 31 * 24 * time.Hour
+
+// errSlotFull - every place in the slot is taken
+var errSlotFull = errors.New("slot is fully booked")
+
+// OpeningHours - when a location hands out gear on one day of the week, as HH:MM local time
+type OpeningHours struct {
+	Weekday time.Weekday `json:"weekday" bson:"weekday"`
+	Open    string       `json:"open" bson:"open"`
+	Close   string       `json:"close" bson:"close"`
+}
+
+// PickupLocation - a place families collect gear from, split into slots of SlotMinutes with Capacity families each
+type PickupLocation struct {
+	ID          bson.ObjectId  `json:"_id" bson:"_id"`
+	Name        string         `json:"name" bson:"name"`
+	Address     string         `json:"address" bson:"address"`
+	Timezone    string         `json:"timezone" bson:"timezone"`
+	SlotMinutes int            `json:"slotMinutes" bson:"slotMinutes"`
+	Capacity    int            `json:"capacity" bson:"capacity"`
+	Hours       []OpeningHours `json:"hours" bson:"hours"`
+	Active      bool           `json:"active" bson:"active"`
+}
+
+// Slot - one bookable period at a location
+type Slot struct {
+	LocationID bson.ObjectId `json:"locationID"`
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	Available  int           `json:"available"`
+}
+
+// SchedulingStore - persistence for pickup locations and how full their slots are
+type SchedulingStore interface {
+	SaveLocation(l PickupLocation) error
+	UpdateLocation(l PickupLocation) error
+	FindLocation(id string) (PickupLocation, error)
+	Locations() ([]PickupLocation, error)
+	// BookedCounts - places taken per slot starting in [from, to), keyed by unix time
+	BookedCounts(locationID bson.ObjectId, from time.Time, to time.Time) (map[int64]int, error)
+	// ReserveSlot - take a place in the slot only while fewer than capacity are taken
+	ReserveSlot(locationID bson.ObjectId, start time.Time, capacity int) error
+	ReleaseSlot(locationID bson.ObjectId, start time.Time) error
+}
+
+// slotID - the key of a slot's booking counter
+func slotID(locationID bson.ObjectId, start time.Time) string {
+	return locationID.Hex() + "_" + start.UTC().Format("20060102T1504Z")
+}
+
+// Validate - check every field of the location and report all failures at once
+func (l *PickupLocation) Validate() error {
+	errs := ValidationErrors{}
+	if l.Name == "" {
+		errs["name"] = "is required"
+	}
+	if _, err := time.LoadLocation(l.Timezone); l.Timezone == "" || err != nil {
+		errs["timezone"] = "must be an IANA time zone such as America/Vancouver"
+	}
+	if l.SlotMinutes <= 0 {
+		errs["slotMinutes"] = "must be positive"
+	}
+	if l.Capacity <= 0 {
+		errs["capacity"] = "must be positive"
+	}
+	for i, h := range l.Hours {
+		field := "hours." + strconv.Itoa(i)
+		open, err := time.Parse("15:04", h.Open)
+		if err != nil {
+			errs[field+".open"] = "must be HH:MM"
+		}
+		closes, err := time.Parse("15:04", h.Close)
+		if err != nil {
+			errs[field+".close"] = "must be HH:MM"
+		}
+		if !closes.After(open) {
+			errs[field] = "must close after it opens"
+		}
+		if h.Weekday < time.Sunday || h.Weekday > time.Saturday {
+			errs[field+".weekday"] = "must be 0 (Sunday) to 6 (Saturday)"
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// slotStarts - the start of every slot in [from, to), in UTC
+func (l PickupLocation) slotStarts(from time.Time, to time.Time) []time.Time {
+	starts := make([]time.Time, 0)
+	loc, err := time.LoadLocation(l.Timezone)
+	if err != nil || l.SlotMinutes <= 0 {
+		return starts
+	}
+	length := time.Duration(l.SlotMinutes) * time.Minute
+	local := from.In(loc)
+	for day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, h := range l.Hours {
+			if h.Weekday != day.Weekday() {
+				continue
+			}
+			open, err1 := time.Parse("15:04", h.Open)
+			closes, err2 := time.Parse("15:04", h.Close)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			end := time.Date(day.Year(), day.Month(), day.Day(), closes.Hour(), closes.Minute(), 0, 0, loc)
+			for t := time.Date(day.Year(), day.Month(), day.Day(), open.Hour(), open.Minute(), 0, 0, loc); !t.Add(length).After(end); t = t.Add(length) {
+				if !t.Before(from) && t.Before(to) {
+					starts = append(starts, t.UTC())
+				}
+			}
+		}
+	}
+	return starts
+}
+
+// isSlot - whether a slot starts at exactly this time
+func (l PickupLocation) isSlot(start time.Time) bool {
+	return len(l.slotStarts(start, start.Add(time.Second))) > 0
+}
+
+// bookingTokenConfig - the key booking links are signed with and how long they stay valid
+func bookingTokenConfig() (string, time.Duration) {
+	viper.AutomaticEnv()
+	viper.SetDefault("booking_token_ttl", "720h")
+	return cast.ToString(viper.Get("booking_token_key")), cast.ToDuration(viper.Get("booking_token_ttl"))
+}
+
+// bookingToken - "<clientID>.<expiry unix>.<hex hmac>", the only credential a family needs to book
+func bookingToken(clientID bson.ObjectId, expires time.Time, key string) string {
+	payload := clientID.Hex() + "." + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyBookingToken - the client ID a booking token was issued for
+func verifyBookingToken(token string, key string, now time.Time) (string, error) {
+	if key == "" {
+		return "", errors.New("booking token key is not configured")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !bson.IsObjectIdHex(parts[0]) {
+		return "", errors.New("malformed booking token")
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", errors.New("malformed booking token")
+	}
+	given, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed booking token")
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return "", errors.New("booking token signature does not match")
+	}
+	if now.After(time.Unix(expires, 0)) {
+		return "", errors.New("booking token has expired")
+	}
+	return parts[0], nil
+}
+
+// bookingConfigError - what is missing for approval emails to link families to the booking page; there is no
+// shared page to fall back on, so the api does not start without one
+func bookingConfigError() error {
+	viper.AutomaticEnv()
+	if cast.ToString(viper.Get("booking_url")) == "" {
+		return errors.New("BOOKING_URL is not set, so approval emails have no booking page to link to")
+	}
+	if key, _ := bookingTokenConfig(); key == "" {
+		return errors.New("BOOKING_URL is set but BOOKING_TOKEN_KEY is not")
+	}
+	return nil
+}
+
+// bookingLink - where the approval email sends the family to pick a slot
+func bookingLink(c Client) (string, error) {
+	err := bookingConfigError()
+	if err != nil {
+		return "", err
+	}
+	key, ttl := bookingTokenConfig()
+	base := cast.ToString(viper.Get("booking_url"))
+	return base + "?token=" + url.QueryEscape(bookingToken(c.ID, time.Now().Add(ttl), key)), nil
+}
+
+// clientActor - a family acting on their own bookings
+func clientActor(c Client) Actor {
+	return Actor{Subject: "client:" + c.ID.Hex(), Email: c.ClientEmail}
+}
+
+// bookingAuth - let a family through with the token from their approval email
+func (s *server) bookingAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		token := ctx.Request().Header.Get("X-Booking-Token")
+		if token == "" {
+			token = ctx.QueryParam("token")
+		}
+		key, _ := bookingTokenConfig()
+		clientID, err := verifyBookingToken(token, key, time.Now())
+		if err != nil {
+			m := echo.Map{}
+			m["error"] = err.Error()
+			return ctx.JSON(401, m)
+		}
+		client, err := s.clients.FindByID(clientID)
+		if err == mgo.ErrNotFound {
+			m := echo.Map{}
+			m["error"] = "booking token is for an unknown client"
+			return ctx.JSON(401, m)
+		}
+		if err != nil {
+			m := echo.Map{}
+			m["error"] = err.Error()
+			return ctx.JSON(500, m)
+		}
+		if client.Status != StatusApproved && client.Status != StatusScheduled {
+			m := echo.Map{}
+			m["error"] = "only approved clients can book"
+			return ctx.JSON(http.StatusForbidden, m)
+		}
+		ctx.Set(bookingClientKey, client)
+		return next(ctx)
+	}
+}
+
+func bookingClient(ctx echo.Context) Client {
+	c, _ := ctx.Get(bookingClientKey).(Client)
+	return c
+}
+
+func (s *server) pickupLocations(ctx echo.Context) error {
+	locations, err := s.scheduling.Locations()
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(http.StatusOK, locations)
+}
+
+func (s *server) savePickupLocation(ctx echo.Context) error {
+	if !hasRole(ctx, RoleAdmin) {
+		m := echo.Map{}
+		m["error"] = "pickup locations can only be changed by admins"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(ctx.Request().Body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	var l PickupLocation
+	err = json.Unmarshal(buf.Bytes(), &l)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	err = l.Validate()
+	if err != nil {
+		return validationError(ctx, err)
+	}
+
+	status := http.StatusCreated
+	if id := ctx.Param("id"); id != "" {
+		before, err := s.scheduling.FindLocation(id)
+		if err == mgo.ErrNotFound {
+			m := echo.Map{}
+			m["error"] = "pickup location not found"
+			return ctx.JSON(404, m)
+		}
+		if err != nil {
+			m := echo.Map{}
+			m["error"] = err.Error()
+			return ctx.JSON(400, m)
+		}
+		l.ID = before.ID
+		err = s.scheduling.UpdateLocation(l)
+		status = http.StatusOK
+	} else {
+		l.ID = bson.NewObjectId()
+		err = s.scheduling.SaveLocation(l)
+	}
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(status, l)
+}
+
+// bookingSlots - open slots at active locations between from and to (default the next two weeks)
+func (s *server) bookingSlots(ctx echo.Context) error {
+	now := time.Now()
+	from, err := parseDateParam(ctx.QueryParam("from"), false)
+	if err != nil {
+		return validationError(ctx, ValidationErrors{"from": err.Error()})
+	}
+	to, err := parseDateParam(ctx.QueryParam("to"), true)
+	if err != nil {
+		return validationError(ctx, ValidationErrors{"to": err.Error()})
+	}
+	if from.Before(now) {
+		from = now
+	}
+	if to.IsZero() {
+		to = from.Add(14 * 24 * time.Hour)
+	}
+	if to.Sub(from) > maxSlotRange {
+		to = from.Add(maxSlotRange)
+	}
+
+	locations, err := s.scheduling.Locations()
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	slots := make([]Slot, 0)
+	for _, l := range locations {
+		if !l.Active || (ctx.QueryParam("locationID") != "" && l.ID.Hex() != ctx.QueryParam("locationID")) {
+			continue
+		}
+		booked, err := s.scheduling.BookedCounts(l.ID, from, to)
+		if err != nil {
+			m := echo.Map{}
+			m["error"] = err.Error()
+			return ctx.JSON(500, m)
+		}
+		for _, start := range l.slotStarts(from, to) {
+			available := l.Capacity - booked[start.Unix()]
+			if available <= 0 {
+				continue
+			}
+			slots = append(slots, Slot{
+				LocationID: l.ID,
+				Start:      start,
+				End:        start.Add(time.Duration(l.SlotMinutes) * time.Minute),
+				Available:  available,
+			})
+		}
+	}
+	return ctx.JSON(http.StatusOK, slots)
+}
+
+func (s *server) bookingAppointments(ctx echo.Context) error {
+	client := bookingClient(ctx)
+	appointments, err := s.appointments.FindByClientID(client.ID.Hex())
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	active := make([]Appointment, 0)
+	for _, apt := range appointments {
+		if apt.Status == AppointmentActive {
+			apt.Raw = nil
+			active = append(active, apt)
+		}
+	}
+	return ctx.JSON(http.StatusOK, active)
+}
+
+// slotRequest - the body of a booking or reschedule
+type slotRequest struct {
+	LocationID string    `json:"locationID"`
+	Start      time.Time `json:"start"`
+}
+
+// reserve - check the requested slot exists and take a place in it
+func (s *server) reserve(ctx echo.Context) (PickupLocation, time.Time, error) {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(ctx.Request().Body)
+	if err != nil {
+		return PickupLocation{}, time.Time{}, err
+	}
+	var req slotRequest
+	err = json.Unmarshal(buf.Bytes(), &req)
+	if err != nil {
+		return PickupLocation{}, time.Time{}, ValidationErrors{"start": "must be an RFC3339 time"}
+	}
+	l, err := s.scheduling.FindLocation(req.LocationID)
+	if err != nil || !l.Active {
+		return l, req.Start, ValidationErrors{"locationID": "is not an open pickup location"}
+	}
+	start := req.Start.UTC()
+	if !start.After(time.Now()) || !l.isSlot(start) {
+		return l, start, ValidationErrors{"start": "is not an upcoming slot at this location"}
+	}
+	return l, start, s.scheduling.ReserveSlot(l.ID, start, l.Capacity)
+}
+
+// nativeAppointment - the appointment for a reserved slot
+func nativeAppointment(c Client, l PickupLocation, start time.Time) Appointment {
+	location := l.Name
+	if l.Address != "" {
+		location += ", " + l.Address
+	}
+	return Appointment{
+		Status:        AppointmentActive,
+		Provider:      providerNative,
+		EventTypeSlug: "pickup",
+		EventTypeName: "Pickup at " + l.Name,
+		StartTime:     start,
+		EndTime:       start.Add(time.Duration(l.SlotMinutes) * time.Minute),
+		Timezone:      l.Timezone,
+		AssignedTo:    make([]AppointmentStaff, 0),
+		Location:      location,
+		LocationID:    l.ID,
+		InviteeName:   c.ClientName,
+		InviteeEmail:  c.ClientEmail,
+		Phone:         c.ClientPhone,
+		EventUUID:     slotID(l.ID, start),
+		InviteeUUID:   bson.NewObjectId().Hex(),
+	}
+}
+
+// reserveError - the response for a slot that could not be reserved
+func reserveError(ctx echo.Context, err error) error {
+	if _, ok := err.(ValidationErrors); ok {
+		return validationError(ctx, err)
+	}
+	m := echo.Map{}
+	m["error"] = err.Error()
+	if err == errSlotFull {
+		return ctx.JSON(http.StatusConflict, m)
+	}
+	return ctx.JSON(500, m)
+}
+
+func (s *server) bookAppointment(ctx echo.Context) error {
+	client := bookingClient(ctx)
+	if client.Status != StatusApproved {
+		m := echo.Map{}
+		m["error"] = "client already has an appointment, reschedule it instead"
+		return ctx.JSON(http.StatusConflict, m)
+	}
+	l, start, err := s.reserve(ctx)
+	if err != nil {
+		return reserveError(ctx, err)
+	}
+	actor := clientActor(client)
+	// moving the client to scheduled is a conditional write, so doing it before the appointment is saved lets
+	// only one of two concurrent bookings through
+	scheduled, err := s.transition(actor, client, StatusScheduled)
+	if err != nil {
+		s.releaseSlot(l.ID, start)
+		m := echo.Map{}
+		m["error"] = err.Error()
+		if err == errStatusChanged {
+			m["error"] = "client already has an appointment, reschedule it instead"
+			return ctx.JSON(http.StatusConflict, m)
+		}
+		return ctx.JSON(500, m)
+	}
+	ev := bookingEvent{Kind: bookingCreated, Appointment: nativeAppointment(client, l, start)}
+	apt, err := s.createAppointment(actor, ev, scheduled)
+	if err != nil {
+		s.releaseSlot(l.ID, start)
+		// back to approved so the family can try again; that change sends no email
+		_, rerr := s.transition(actor, scheduled, StatusApproved)
+		if rerr != nil {
+			rollbar.Error(rerr)
+		}
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	apt.Raw = nil
+	return ctx.JSON(http.StatusCreated, apt)
+}
+
+// ownAppointment - the family's active, natively booked appointment named in the route
+func (s *server) ownAppointment(ctx echo.Context) (Appointment, error) {
+	apt, err := s.appointments.FindByID(ctx.Param("id"))
+	if err != nil {
+		return apt, err
+	}
+	if apt.ClientID != bookingClient(ctx).ID || apt.Provider != providerNative || apt.Status != AppointmentActive {
+		return apt, mgo.ErrNotFound
+	}
+	return apt, nil
+}
+
+func (s *server) rescheduleAppointment(ctx echo.Context) error {
+	client := bookingClient(ctx)
+	old, err := s.ownAppointment(ctx)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = "appointment not found"
+		return ctx.JSON(404, m)
+	}
+	l, start, err := s.reserve(ctx)
+	if err != nil {
+		return reserveError(ctx, err)
+	}
+	if l.ID == old.LocationID && start.Equal(old.StartTime) {
+		s.releaseSlot(l.ID, start)
+		return validationError(ctx, ValidationErrors{"start": "is the slot already booked"})
+	}
+	ev := bookingEvent{
+		Kind:            bookingCreated,
+		Appointment:     nativeAppointment(client, l, start),
+		ReplacesInvitee: old.InviteeUUID,
+		CancelsReplaced: true,
+	}
+	apt, err := s.createAppointment(clientActor(client), ev, client)
+	if err != nil {
+		s.releaseSlot(l.ID, start)
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	s.releaseSlot(old.LocationID, old.StartTime)
+	apt.Raw = nil
+	return ctx.JSON(http.StatusOK, apt)
+}
+
+func (s *server) cancelBooking(ctx echo.Context) error {
+	client := bookingClient(ctx)
+	apt, err := s.ownAppointment(ctx)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = "appointment not found"
+		return ctx.JSON(404, m)
+	}
+	ev := bookingEvent{Kind: bookingCanceled, Appointment: Appointment{
+		InviteeUUID:  apt.InviteeUUID,
+		CancelerName: client.ClientName,
+		CancelReason: ctx.QueryParam("reason"),
+	}}
+	err = s.cancelAppointment(clientActor(client), ev)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	s.releaseSlot(apt.LocationID, apt.StartTime)
+	return ctx.JSON(http.StatusOK, echo.Map{"status": AppointmentCanceled})
+}
+
+// releaseSlot - give a place back; the booking change already happened so failures are reported, not returned
+func (s *server) releaseSlot(locationID bson.ObjectId, start time.Time) {
+	err := s.scheduling.ReleaseSlot(locationID, start)
+	if err != nil {
+		rollbar.Error(err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// openLocation - a location open every day, so there is always an upcoming slot
+func openLocation(t *testing.T, api *testAPI, capacity int) PickupLocation {
+	t.Helper()
+	hours := make([]string, 0)
+	for day := 0; day < 7; day++ {
+		hours = append(hours, `{"weekday":`+strconv.Itoa(day)+`,"open":"08:00","close":"20:00"}`)
+	}
+	rec := api.call("POST", "/pickup_locations", `{"name":"Warehouse","timezone":"UTC","slotMinutes":30,"capacity":`+
+		strconv.Itoa(capacity)+`,"active":true,"hours":[`+strings.Join(hours, ",")+`]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create location: %d %s", rec.Code, rec.Body)
+	}
+	var l PickupLocation
+	decode(t, rec, &l)
+	return l
+}
+
+// book - post a booking with the family's token
+func (a *testAPI) book(token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/booking/appointments", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Booking-Token", token)
+	rec := httptest.NewRecorder()
+	a.app.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestConcurrentBookingsLeaveOneAppointment(t *testing.T) {
+	os.Setenv("BOOKING_TOKEN_KEY", "test-booking-key")
+	defer os.Unsetenv("BOOKING_TOKEN_KEY")
+	api := newTestAPI()
+	l := openLocation(t, api, 10)
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	c, err := api.transition(Actor{Subject: "auth0|staff"}, c, StatusApproved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := l.slotStarts(time.Now().Add(time.Hour), time.Now().Add(48*time.Hour))[0]
+	body := `{"locationID":"` + l.ID.Hex() + `","start":"` + start.Format(time.RFC3339) + `"}`
+
+	rec := api.book(bookingToken(c.ID, time.Now().Add(time.Hour), "test-booking-key"), body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("first booking: %d %s", rec.Code, rec.Body)
+	}
+
+	// a second booking that passed bookingAuth while the client was still approved
+	req := httptest.NewRequest("POST", "/booking/appointments", strings.NewReader(body))
+	rec = httptest.NewRecorder()
+	ctx := api.app.NewContext(req, rec)
+	ctx.Set(bookingClientKey, c)
+	err = api.bookAppointment(ctx)
+	if err != nil || rec.Code != http.StatusConflict {
+		t.Fatalf("second booking: %v %d %s", err, rec.Code, rec.Body)
+	}
+
+	appointments, _ := api.appointments.FindByClientID(c.ID.Hex())
+	if len(appointments) != 1 {
+		t.Errorf("expected one appointment, got %d", len(appointments))
+	}
+	saved, _ := api.clients.FindByID(c.ID.Hex())
+	if saved.Status != StatusScheduled {
+		t.Errorf("client is %s, want SCHEDULED", saved.Status)
+	}
+	// the loser gave its place back
+	booked, _ := api.scheduling.BookedCounts(l.ID, start, start.Add(time.Minute))
+	if booked[start.Unix()] != 1 {
+		t.Errorf("expected one place taken, got %d", booked[start.Unix()])
+	}
+}
+
+func TestBookingLink(t *testing.T) {
+	c := Client{ID: bson.NewObjectId()}
+	defer os.Unsetenv("BOOKING_URL")
+	defer os.Unsetenv("BOOKING_TOKEN_KEY")
+
+	// with no page of our own configured there is nothing to link to
+	if _, err := bookingLink(c); err == nil {
+		t.Error("linked without BOOKING_URL")
+	}
+	os.Setenv("BOOKING_URL", "https://book.modernbaby.online/")
+	if _, err := bookingLink(c); err == nil {
+		t.Error("linked without BOOKING_TOKEN_KEY")
+	}
+
+	os.Setenv("BOOKING_TOKEN_KEY", "test-booking-key")
+	if err := bookingConfigError(); err != nil {
+		t.Fatal(err)
+	}
+	link, err := bookingLink(c)
+	if err != nil || !strings.HasPrefix(link, "https://book.modernbaby.online/?token=") {
+		t.Fatalf("link %q %v", link, err)
+	}
+	u, _ := url.Parse(link)
+	clientID, err := verifyBookingToken(u.Query().Get("token"), "test-booking-key", time.Now())
+	if err != nil || clientID != c.ID.Hex() {
+		t.Errorf("token in the link is for %q: %v", clientID, err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// searchFields - query param to token prefix; "any" matches a term in every field
+var searchFields = map[string]string{
+	"q":        "any",
+	"name":     "name",
+	"email":    "email",
+	"phone":    "phone",
+	"agency":   "agency",
+	"referrer": "referrer",
+}
+
+// searchSortFields - search ranks by relevance unless asked for the listing orders
+var searchSortFields = []string{sortRelevance, "dateCreated", "clientName"}
+
+// SearchQuery - normalized search terms per field, all of which must match, paged like a client listing
+type SearchQuery struct {
+	Terms []searchTerm
+	ClientQuery
+}
+
+// searchTerm - one normalized word matched as a prefix of a stored token
+type searchTerm struct {
+	Field string
+	Word  string
+}
+
+func (t searchTerm) token() string {
+	return t.Field + ":" + t.Word
+}
+
+// SearchResults - ranked clients and the cursor for the next page of results
+type SearchResults struct {
+	Data       []Client `json:"data"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+// normalizeText - lowercase, strip accents (é to e) and replace punctuation with spaces
+func normalizeText(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// drop the combining accent left behind by decomposition
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	return b.String()
+}
+
+// searchWords - the normalized words of a value
+func searchWords(s string) []string {
+	return strings.Fields(normalizeText(s))
+}
+
+// searchTokens - the tokens stored on a client document and indexed for search
+func searchTokens(c Client) []string {
+	seen := map[string]bool{}
+	tokens := make([]string, 0)
+	add := func(field string, words ...string) {
+		for _, w := range words {
+			for _, t := range []string{field + ":" + w, "any:" + w} {
+				if w != "" && !seen[t] {
+					seen[t] = true
+					tokens = append(tokens, t)
+				}
+			}
+		}
+	}
+	add("name", searchWords(c.ClientName)...)
+	// the whole address as one word so exact email searches rank first
+	add("email", strings.Replace(normalizeText(c.ClientEmail), " ", "", -1))
+	add("email", searchWords(c.ClientEmail)...)
+	for _, alias := range c.EmailAliases {
+		add("email", strings.Replace(normalizeText(alias), " ", "", -1))
+		add("email", searchWords(alias)...)
+	}
+	add("phone", phoneWords(c.ClientPhone)...)
+	add("agency", searchWords(c.AgencyName)...)
+	add("referrer", searchWords(c.ReferrerName)...)
+	return tokens
+}
+
+// phoneWords - the digits of a phone number plus its local forms so 604-555-1234 matches +1 604 555 1234
+func phoneWords(phone string) []string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+	words := []string{digits}
+	for _, n := range []int{10, 7} {
+		if len(digits) > n {
+			words = append(words, digits[len(digits)-n:])
+		}
+	}
+	return words
+}
+
+// parseSearchQuery - turn q, name, email, phone, agency and referrer params into terms, with the listings' sort,
+// createdFrom/createdTo and cursor
+func parseSearchQuery(ctx echo.Context) (SearchQuery, error) {
+	q := SearchQuery{ClientQuery: ClientQuery{SortField: sortRelevance, Limit: defaultSearchLimit}}
+	params := make([]string, 0, len(searchFields))
+	for param := range searchFields {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		field := searchFields[param]
+		value := ctx.QueryParam(param)
+		words := searchWords(value)
+		if field == "email" && strings.Contains(value, "@") {
+			words = []string{strings.Replace(normalizeText(value), " ", "", -1)}
+		}
+		if field == "phone" && value != "" {
+			words = []string{phoneWords(value)[0]}
+		}
+		for _, w := range words {
+			if w != "" {
+				q.Terms = append(q.Terms, searchTerm{Field: field, Word: w})
+			}
+		}
+	}
+	if len(q.Terms) == 0 {
+		return q, errors.New("provide at least one of q, name, email, phone, agency, referrer")
+	}
+
+	err := q.parsePage(ctx, maxSearchLimit, searchSortFields)
+	return q, err
+}
+
+// mongoFilter - every term must be a prefix of some indexed token, and the client must pass the listing filters;
+// input is escaped so it is never a pattern
+func (q SearchQuery) mongoFilter() bson.M {
+	patterns := make([]interface{}, 0, len(q.Terms))
+	for _, t := range q.Terms {
+		patterns = append(patterns, bson.RegEx{Pattern: "^" + regexp.QuoteMeta(t.token())})
+	}
+	filter := q.mongoFilters()
+	filter["searchTokens"] = bson.M{"$all": patterns}
+	return filter
+}
+
+// mongoPipeline - match, score and sort in mongo so every match is ranked and a page is cut from the whole
+// ranking; the score is the one score() gives, since a matched term is either a whole token or a prefix of one
+func (q SearchQuery) mongoPipeline() []bson.M {
+	score := make([]interface{}, 0, len(q.Terms))
+	for _, t := range q.Terms {
+		score = append(score, bson.M{"$cond": []interface{}{bson.M{"$in": []interface{}{t.token(), "$searchTokens"}}, 3, 1}})
+	}
+	order := bson.D{}
+	for _, key := range q.mongoSort() {
+		if strings.HasPrefix(key, "-") {
+			order = append(order, bson.DocElem{Name: strings.TrimPrefix(key, "-"), Value: -1})
+		} else {
+			order = append(order, bson.DocElem{Name: key, Value: 1})
+		}
+	}
+	pipeline := []bson.M{
+		{"$match": q.mongoFilter()},
+		{"$addFields": bson.M{"searchScore": bson.M{"$add": score}}},
+	}
+	if q.After != nil {
+		// after the score is added, since a relevance cursor is a position in the ranking
+		pipeline = append(pipeline, bson.M{"$match": bson.M{"$or": q.mongoCursor()}})
+	}
+	return append(pipeline,
+		bson.M{"$sort": order},
+		// one past the page so we know whether there is another
+		bson.M{"$limit": q.Limit + 1},
+		bson.M{"$project": bson.M{"searchScore": 0}},
+	)
+}
+
+// matches - whether every term is a prefix of one of the client's tokens and the client passes the listing
+// filters and sorts after the cursor
+func (q SearchQuery) matches(c Client) bool {
+	if !q.filtered(c) || !q.after(q.position(c)) {
+		return false
+	}
+	tokens := c.SearchTokens
+	if len(tokens) == 0 {
+		tokens = searchTokens(c)
+	}
+	for _, t := range q.Terms {
+		found := false
+		for _, token := range tokens {
+			if strings.HasPrefix(token, t.token()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// score - a whole-word match counts three times as much as a prefix match
+func (q SearchQuery) score(c Client) int {
+	tokens := c.SearchTokens
+	if len(tokens) == 0 {
+		tokens = searchTokens(c)
+	}
+	score := 0
+	for _, t := range q.Terms {
+		best := 0
+		for _, token := range tokens {
+			s := 0
+			if token == t.token() {
+				s = 3
+			} else if strings.HasPrefix(token, t.token()) {
+				s = 1
+			}
+			if s > best {
+				best = s
+			}
+		}
+		score += best
+	}
+	return score
+}
+
+// position - where client c sits in the search order, with its score for a relevance sort
+func (q SearchQuery) position(c Client) pageCursor {
+	p := q.ClientQuery.position(c)
+	if q.SortField == sortRelevance {
+		p.Score = q.score(c)
+	}
+	return p
+}
+
+// rank - order the candidates after the cursor as mongoPipeline does and cut out the page
+func (q SearchQuery) rank(candidates []Client) SearchResults {
+	positions := make(map[bson.ObjectId]pageCursor, len(candidates))
+	for _, c := range candidates {
+		positions[c.ID] = q.position(c)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return q.compare(positions[candidates[i].ID], positions[candidates[j].ID]) < 0
+	})
+	return q.page(candidates)
+}
+
+// page - the ranked clients trimmed to the limit, with a cursor after the last one when there are more
+func (q SearchQuery) page(ranked []Client) SearchResults {
+	results := SearchResults{Data: make([]Client, 0)}
+	if len(ranked) > q.Limit {
+		ranked = ranked[:q.Limit]
+		results.NextCursor = q.position(ranked[q.Limit-1]).encode()
+	}
+	results.Data = append(results.Data, ranked...)
+	return results
+}
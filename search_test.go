@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestNormalizeText(t *testing.T) {
+	cases := map[string]string{
+		"Zoë O'Brien-Côté": "zoe o brien cote",
+		"ANN@Example.com":  "ann example com",
+		"  Ngọc  ":         "  ngoc  ",
+	}
+	for in, want := range cases {
+		if got := normalizeText(in); got != want {
+			t.Errorf("normalizeText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestPhoneWords(t *testing.T) {
+	got := phoneWords("+1 (604) 555-1234")
+	want := []string{"16045551234", "6045551234", "5551234"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("phoneWords = %v, want %v", got, want)
+	}
+}
+
+func TestSearchTokens(t *testing.T) {
+	tokens := searchTokens(Client{
+		ClientName:   "Zoë Côté",
+		ClientEmail:  "zoe@example.com",
+		EmailAliases: []string{"zc@work.org"},
+		ClientPhone:  "604-555-1234",
+		AgencyName:   "Family Place",
+	})
+	have := map[string]bool{}
+	for _, token := range tokens {
+		if have[token] {
+			t.Errorf("%s stored twice", token)
+		}
+		have[token] = true
+	}
+	for _, token := range []string{"name:zoe", "any:cote", "email:zoeexamplecom", "email:zcworkorg", "phone:5551234", "agency:family"} {
+		if !have[token] {
+			t.Errorf("missing %s in %v", token, tokens)
+		}
+	}
+}
+
+// searchClients - clients that all match "ann" in some way, saved to the store a day apart from March 1st 2019
+func searchClients(t *testing.T, api *testAPI) {
+	t.Helper()
+	for i, c := range []Client{
+		{ClientName: "Annabelle Wu", ClientEmail: "belle@example.com"},
+		{ClientName: "Ann Smith", ClientEmail: "smith@example.com"},
+		{ClientName: "Joanne Annis", ClientEmail: "jo@example.com"},
+		{ClientName: "Ann Brown", ClientEmail: "brown@example.com", AgencyName: "Annex Services"},
+		{ClientName: "Bea Jones", ClientEmail: "bea@example.com"},
+	} {
+		c.ID = bson.NewObjectId()
+		c.DateCreated = time.Date(2019, 3, 1+i, 9, 0, 0, 0, time.UTC)
+		c.Status = StatusPending
+		c.ClientDOB = "07-13-1995"
+		err := api.clients.Save(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func searchNames(t *testing.T, api *testAPI, query url.Values) ([]string, string) {
+	t.Helper()
+	rec := api.call("GET", "/search?"+query.Encode(), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: %d %s", query.Encode(), rec.Code, rec.Body)
+	}
+	var results SearchResults
+	decode(t, rec, &results)
+	names := make([]string, 0, len(results.Data))
+	for _, c := range results.Data {
+		names = append(names, c.ClientName)
+	}
+	return names, results.NextCursor
+}
+
+func TestSearchRanksWholeWordsFirst(t *testing.T) {
+	api := newTestAPI()
+	searchClients(t, api)
+
+	names, _ := searchNames(t, api, url.Values{"name": {"ann"}})
+	want := []string{"Ann Brown", "Ann Smith", "Annabelle Wu", "Joanne Annis"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("name=ann: got %v, want %v", names, want)
+	}
+
+	// q matches every field, so the agency counts too
+	names, _ = searchNames(t, api, url.Values{"q": {"ann"}})
+	if len(names) != 4 {
+		t.Errorf("q=ann: got %v", names)
+	}
+
+	// every term must match
+	names, _ = searchNames(t, api, url.Values{"q": {"ann smi"}})
+	if !reflect.DeepEqual(names, []string{"Ann Smith"}) {
+		t.Errorf("q=ann smi: got %v", names)
+	}
+
+	names, _ = searchNames(t, api, url.Values{"email": {"Jo@Example.com"}})
+	if !reflect.DeepEqual(names, []string{"Joanne Annis"}) {
+		t.Errorf("email=Jo@Example.com: got %v", names)
+	}
+}
+
+func TestSearchPages(t *testing.T) {
+	api := newTestAPI()
+	searchClients(t, api)
+
+	all := make([]string, 0)
+	query := url.Values{"name": {"ann"}, "limit": {"3"}}
+	for pages := 0; pages < 5; pages++ {
+		names, cursor := searchNames(t, api, query)
+		all = append(all, names...)
+		if cursor == "" {
+			break
+		}
+		query.Set("cursor", cursor)
+	}
+	want := []string{"Ann Brown", "Ann Smith", "Annabelle Wu", "Joanne Annis"}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("pages served %v, want %v", all, want)
+	}
+
+	for _, query := range []string{"", "q=%20-", "q=ann&limit=0", "q=ann&cursor=bm9wZQ", "q=ann&sort=-relevance", "q=ann&sort=clientEmail"} {
+		rec := api.call("GET", "/search?"+query, "")
+		if rec.Code != 400 {
+			t.Errorf("%s: got %d %s", query, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestSearchCursorKeepsItsPlace(t *testing.T) {
+	api := newTestAPI()
+	searchClients(t, api)
+
+	query := url.Values{"name": {"ann"}, "limit": {"2"}}
+	first, cursor := searchNames(t, api, query)
+	if !reflect.DeepEqual(first, []string{"Ann Brown", "Ann Smith"}) || cursor == "" {
+		t.Fatalf("first page %v %q", first, cursor)
+	}
+	// a better match arriving between pages ranks above the cursor, so it cannot push a client onto the next
+	// page a second time
+	err := api.clients.Save(Client{ID: bson.NewObjectId(), Status: StatusPending, ClientName: "Ann Adams", ClientEmail: "adams@example.com", ClientDOB: "07-13-1995"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query.Set("cursor", cursor)
+	next, _ := searchNames(t, api, query)
+	if !reflect.DeepEqual(next, []string{"Annabelle Wu", "Joanne Annis"}) {
+		t.Errorf("second page %v", next)
+	}
+}
+
+func TestSearchSortsAndFilters(t *testing.T) {
+	api := newTestAPI()
+	searchClients(t, api)
+
+	names, _ := searchNames(t, api, url.Values{"name": {"ann"}, "sort": {"-dateCreated"}})
+	if !reflect.DeepEqual(names, []string{"Ann Brown", "Joanne Annis", "Ann Smith", "Annabelle Wu"}) {
+		t.Errorf("sort=-dateCreated: got %v", names)
+	}
+	names, _ = searchNames(t, api, url.Values{"name": {"ann"}, "sort": {"clientName"}})
+	if !reflect.DeepEqual(names, []string{"Ann Brown", "Ann Smith", "Annabelle Wu", "Joanne Annis"}) {
+		t.Errorf("sort=clientName: got %v", names)
+	}
+	names, _ = searchNames(t, api, url.Values{"name": {"ann"}, "createdFrom": {"2019-03-02"}, "createdTo": {"2019-03-03"}})
+	if !reflect.DeepEqual(names, []string{"Ann Smith", "Joanne Annis"}) {
+		t.Errorf("created March 2nd and 3rd: got %v", names)
+	}
+
+	// pages of a date sort follow the dates, not the ranking
+	all := make([]string, 0)
+	query := url.Values{"name": {"ann"}, "sort": {"dateCreated"}, "limit": {"3"}}
+	for pages := 0; pages < 5; pages++ {
+		names, cursor := searchNames(t, api, query)
+		all = append(all, names...)
+		if cursor == "" {
+			break
+		}
+		query.Set("cursor", cursor)
+	}
+	if !reflect.DeepEqual(all, []string{"Annabelle Wu", "Ann Smith", "Joanne Annis", "Ann Brown"}) {
+		t.Errorf("pages served %v", all)
+	}
+}
+
+func TestSearchFilterEscapesInput(t *testing.T) {
+	q := SearchQuery{Terms: []searchTerm{{Field: "any", Word: "a.b"}}}
+	all := q.mongoFilter()["searchTokens"].(bson.M)["$all"].([]interface{})
+	if all[0].(bson.RegEx).Pattern != `^any:a\.b` {
+		t.Errorf("pattern = %q", all[0].(bson.RegEx).Pattern)
+	}
+}
+
+func TestSearchPipelineScoresEveryTerm(t *testing.T) {
+	id := bson.NewObjectId()
+	q := SearchQuery{
+		Terms:       []searchTerm{{Field: "name", Word: "ann"}, {Field: "any", Word: "smith"}},
+		ClientQuery: ClientQuery{SortField: sortRelevance, Limit: 20, After: &pageCursor{Score: 4, Name: "Ann Smith", ID: id}},
+	}
+	pipeline := q.mongoPipeline()
+	score := pipeline[1]["$addFields"].(bson.M)["searchScore"].(bson.M)["$add"].([]interface{})
+	if len(score) != 2 {
+		t.Fatalf("expected a score per term, got %v", score)
+	}
+	// the cursor is matched once the score exists, then the page is cut with no skip
+	or := pipeline[2]["$match"].(bson.M)["$or"].([]bson.M)
+	if or[0]["searchScore"].(bson.M)["$lt"] != 4 || or[2]["_id"].(bson.M)["$gt"] != id {
+		t.Errorf("cursor match = %v", or)
+	}
+	order := pipeline[3]["$sort"].(bson.D)
+	if order[0].Name != "searchScore" || order[0].Value != -1 || order[2].Name != "_id" {
+		t.Errorf("sort = %v", order)
+	}
+	if pipeline[4]["$limit"] != 21 {
+		t.Errorf("expected limit 21, got %v", pipeline[4])
+	}
+}
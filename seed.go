@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/wawandco/fako"
+)
+
+// seedClientCount - how many fake clients `api seed` adds each time it runs
+const seedClientCount = 5
+
+// fakeClientFields - the parts of a client fako can make up
+type fakeClientFields struct {
+	ClientName    string `fako:"full_name"`
+	ClientPhone   string `fako:"phone"`
+	AgencyName    string `fako:"company"`
+	ReferrerName  string `fako:"full_name"`
+	ReferrerEmail string `fako:"email_address"`
+}
+
+// fakeClients - save n fake pending clients through the store, so they are encrypted and searchable like real
+// ones; each gets its own address at the catch-all domain, keyed by its id so running the seed again adds more
+func fakeClients(clients ClientStore, n int) ([]Client, error) {
+	seeded := make([]Client, 0, n)
+	for i := 0; i < n; i++ {
+		var f fakeClientFields
+		fako.Fill(&f)
+		c := Client{
+			ID:            bson.NewObjectId(),
+			DateCreated:   time.Now(),
+			Status:        StatusPending,
+			ClientName:    f.ClientName,
+			ClientPhone:   f.ClientPhone,
+			ClientDOB:     "07-13-1995",
+			BabyDOB:       "09-13-2017",
+			ClientIncome:  5555555,
+			AgencyName:    f.AgencyName,
+			ReferrerName:  f.ReferrerName,
+			ReferrerEmail: f.ReferrerEmail,
+		}
+		c.ClientEmail = "catch+" + c.ID.Hex() + "@mail.modernbaby.online"
+		c.normalize()
+		err := clients.Save(c)
+		if err != nil {
+			return seeded, err
+		}
+		seeded = append(seeded, c)
+	}
+	return seeded, nil
+}
+
+// runSeed - the `api seed` subcommand for filling a development database
+func runSeed() error {
+	fields, err := loadFieldCipher()
+	if err != nil {
+		return err
+	}
+	conn, err := dialMongo()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	seeded, err := fakeClients(newMongoClientStore(conn, fields), seedClientCount)
+	fmt.Printf("seeded %d clients\n", len(seeded))
+	return err
+}
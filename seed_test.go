@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestFakeClients(t *testing.T) {
+	clients := newMemoryStores().clients
+	seeded, err := fakeClients(clients, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seeded) != 5 {
+		t.Fatalf("seeded %d clients", len(seeded))
+	}
+	emails := map[string]bool{}
+	for _, c := range seeded {
+		if emails[c.ClientEmail] {
+			t.Errorf("two seeded clients share %s", c.ClientEmail)
+		}
+		emails[c.ClientEmail] = true
+		found, err := clients.FindByEmail(c.ClientEmail)
+		if err != nil || found.ID != c.ID || found.Status != StatusPending {
+			t.Errorf("%s finds %+v %v", c.ClientEmail, found, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// stores - every persistence dependency of the server
+type stores struct {
+	clients      ClientStore
+	appointments AppointmentStore
+	auditLog     AuditStore
+	unmatched    UnmatchedStore
+	inbox        InboxStore
+	scheduling   SchedulingStore
+	feeds        CalendarFeedStore
+	templates    TemplateStore
+	messages     MessageStore
+	settings     SettingsStore
+}
+
+func newMongoStores(conn *mongoConn, fields *fieldCipher) stores {
+	return stores{
+		clients:      newMongoClientStore(conn, fields),
+		appointments: newMongoAppointmentStore(conn),
+		auditLog:     newMongoAuditStore(conn),
+		unmatched:    newMongoUnmatchedStore(conn),
+		inbox:        newMongoInboxStore(conn),
+		scheduling:   newMongoSchedulingStore(conn),
+		feeds:        newMongoCalendarFeedStore(conn),
+		templates:    newMongoTemplateStore(conn),
+		messages:     newMongoMessageStore(conn),
+		settings:     newMongoSettingsStore(conn),
+	}
+}
+
+func newMemoryStores() stores {
+	return stores{
+		clients:      newMemoryClientStore(),
+		appointments: newMemoryAppointmentStore(),
+		auditLog:     newMemoryAuditStore(),
+		unmatched:    newMemoryUnmatchedStore(),
+		inbox:        newMemoryInboxStore(),
+		scheduling:   newMemorySchedulingStore(),
+		feeds:        newMemoryCalendarFeedStore(),
+		templates:    newMemoryTemplateStore(),
+		messages:     newMemoryMessageStore(),
+		settings:     newMemorySettingsStore(),
+	}
+}
+
+// ClientStore - persistence for clients
+type ClientStore interface {
+	Save(client Client) error
+	// UpdateStatus - move the client from one status to another, keeping the reason staff gave or clearing it with ""
+	UpdateStatus(id string, from string, to string, reason string) error
+	FindByID(id string) (Client, error)
+	FindByEmail(email string) (Client, error)
+	AddEmailAlias(id string, email string) error
+	// SetEmailIssue - flag a bounce or complaint on the client's address, or clear it with ""
+	SetEmailIssue(id string, issue string, at time.Time) error
+	FindBySIN(sin string) (Client, error)
+	List(q ClientQuery) (ClientPage, error)
+	Search(q SearchQuery) (SearchResults, error)
+}
+
+// AppointmentStore - persistence for appointments
+type AppointmentStore interface {
+	Save(apt Appointment) error
+	// SetAttendance, Cancel, SetReplacedBy and SetReplaces write only their own fields so a reminder marked
+	// after the appointment was read is never overwritten
+	SetAttendance(id bson.ObjectId, attendance string, at time.Time) error
+	Cancel(id bson.ObjectId, reason string, canceler string, at time.Time) error
+	SetReplacedBy(id bson.ObjectId, replacedByID bson.ObjectId) error
+	SetReplaces(id bson.ObjectId, replacesID bson.ObjectId) error
+	FindByID(id string) (Appointment, error)
+	FindByInviteeUUID(uuid string) (Appointment, error)
+	FindByBookingUUIDs(eventUUID string, inviteeUUID string) (Appointment, error)
+	FindByClientID(clientID string) ([]Appointment, error)
+	// FindBetween - appointments starting in [from, to), earliest first
+	FindBetween(from time.Time, to time.Time) ([]Appointment, error)
+	// DueForReminder - active appointments starting in (from, to] that have not had the reminder
+	DueForReminder(reminder string, from time.Time, to time.Time) ([]Appointment, error)
+	// MarkReminded - record the reminders as sent unless the first already was; mgo.ErrNotFound means it was
+	MarkReminded(id bson.ObjectId, reminders []string) error
+	UnmarkReminded(id bson.ObjectId, reminders []string) error
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+var emailTemplatesConnection = "email_templates"
+
+// the emails the api sends
+const (
+	templateApproval = "approval"
+	templateReminder = "reminder"
+)
+
+// where a template version came from; the directory and the api each number their own versions, so a version
+// is only identified by its source and number together
+const (
+	templateFromFile  = "file"
+	templateFromMongo = "mongo"
+)
+
+var templateName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// EmailTemplate - one version of an email; Subject and Text are text templates, HTML is an html/template
+type EmailTemplate struct {
+	ID        bson.ObjectId `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name      string        `json:"name" bson:"name"`
+	Version   int           `json:"version" bson:"version"`
+	Subject   string        `json:"subject" bson:"subject"`
+	HTML      string        `json:"html" bson:"html"`
+	Text      string        `json:"text" bson:"text"`
+	Source    string        `json:"source" bson:"-"`
+	CreatedBy *Actor        `json:"createdBy,omitempty" bson:"createdBy,omitempty"`
+	CreatedAt time.Time     `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+}
+
+// TemplateStore - template versions saved through the api, which take over from the template directory
+type TemplateStore interface {
+	Save(t EmailTemplate) error
+	Latest(name string) (EmailTemplate, error)
+	List() ([]EmailTemplate, error)
+}
+
+// emailData - what a template can refer to
+type emailData struct {
+	Name       string
+	BabyName   string
+	Caseworker string
+	Email      string
+	BookingURL string
+	Agency     string
+	// Status, Reason - the status a lifecycle notification is about and the reason staff gave for it, if any
+	Status string
+	Reason string
+	// Appointment - set on appointment emails, with the time already in the family's time zone
+	Appointment emailAppointment
+
+	clientID      bson.ObjectId
+	appointmentID bson.ObjectId
+}
+
+type emailAppointment struct {
+	Name     string
+	When     string
+	Location string
+}
+
+func clientEmailData(c Client) emailData {
+	return emailData{
+		Name:       c.ClientName,
+		BabyName:   c.BabyName,
+		Caseworker: c.ReferrerName,
+		Agency:     c.AgencyName,
+		Email:      c.ClientEmail,
+		clientID:   c.ID,
+	}
+}
+
+func appointmentEmailData(c Client, apt Appointment) emailData {
+	data := clientEmailData(c)
+	if data.Name == "" {
+		data.Name = apt.InviteeName
+	}
+	loc, err := time.LoadLocation(apt.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	data.Appointment = emailAppointment{
+		Name:     apt.EventTypeName,
+		When:     apt.StartTime.In(loc).Format("3:04pm on Monday, January 2"),
+		Location: apt.Location,
+	}
+	data.clientID = apt.ClientID
+	data.appointmentID = apt.ID
+	return data
+}
+
+// renderedEmail - a template applied to one recipient's data
+type renderedEmail struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// outlookComments - the conditional comments email builders use to target outlook and old IE
+var outlookComments = regexp.MustCompile(`<!--\[if [^\]]*\]>(<!-->)?|(<!--)?<!\[endif\]-->|<!\[if [^\]]*\]>|<!\[endif\]>`)
+
+// keepOutlookComments - html/template drops every comment, so conditional ones are passed through as
+// trusted html instead; the markup between them is still escaped as usual
+func keepOutlookComments(src string) string {
+	return outlookComments.ReplaceAllStringFunc(src, func(c string) string {
+		return `{{outlook ` + strconv.Quote(c) + `}}`
+	})
+}
+
+var templateFuncs = htmltemplate.FuncMap{
+	"outlook": func(c string) htmltemplate.HTML { return htmltemplate.HTML(c) },
+}
+
+// parse - compile every part, so a broken template is caught before it is saved or sent
+func (t EmailTemplate) parse() (*texttemplate.Template, *htmltemplate.Template, *texttemplate.Template, error) {
+	subject, err := texttemplate.New("subject").Parse(t.Subject)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	body, err := htmltemplate.New("html").Funcs(templateFuncs).Parse(keepOutlookComments(t.HTML))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	text, err := texttemplate.New("text").Parse(t.Text)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return subject, body, text, nil
+}
+
+// Validate - a template needs a name, a subject and html that all compile
+func (t EmailTemplate) Validate() error {
+	errs := ValidationErrors{}
+	if !templateName.MatchString(t.Name) {
+		errs["name"] = "must be lowercase letters, digits, - or _"
+	}
+	if strings.TrimSpace(t.Subject) == "" {
+		errs["subject"] = "is required"
+	}
+	if strings.TrimSpace(t.HTML) == "" {
+		errs["html"] = "is required"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	_, _, _, err := t.parse()
+	if err != nil {
+		errs["template"] = err.Error()
+		return errs
+	}
+	return nil
+}
+
+func (t EmailTemplate) render(data emailData) (renderedEmail, error) {
+	subject, body, text, err := t.parse()
+	if err != nil {
+		return renderedEmail{}, err
+	}
+	var r renderedEmail
+	var buf bytes.Buffer
+	err = subject.Execute(&buf, data)
+	if err != nil {
+		return r, err
+	}
+	// a subject is one line however the template was saved
+	r.Subject = strings.Join(strings.Fields(buf.String()), " ")
+	buf.Reset()
+	err = body.Execute(&buf, data)
+	if err != nil {
+		return r, err
+	}
+	r.HTML = buf.String()
+	buf.Reset()
+	err = text.Execute(&buf, data)
+	if err != nil {
+		return r, err
+	}
+	r.Text = buf.String()
+	return r, nil
+}
+
+func templateDir() string {
+	viper.AutomaticEnv()
+	viper.SetDefault("email_template_dir", "templates")
+	return cast.ToString(viper.Get("email_template_dir"))
+}
+
+// dirTemplateVersions - the versions of a template in the directory, each as <version>.subject, <version>.html
+// and an optional <version>.txt
+func dirTemplateVersions(dir string, name string) ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, name, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]int, 0)
+	for _, p := range paths {
+		v, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(p), ".html"))
+		if err == nil && v > 0 {
+			versions = append(versions, v)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+func readDirTemplate(dir string, name string, version int) (EmailTemplate, error) {
+	base := filepath.Join(dir, name, strconv.Itoa(version))
+	t := EmailTemplate{Name: name, Version: version, Source: templateFromFile}
+	b, err := ioutil.ReadFile(base + ".subject")
+	if err != nil {
+		return t, err
+	}
+	t.Subject = string(b)
+	b, err = ioutil.ReadFile(base + ".html")
+	if err != nil {
+		return t, err
+	}
+	t.HTML = string(b)
+	b, err = ioutil.ReadFile(base + ".txt")
+	if err != nil && !os.IsNotExist(err) {
+		return t, err
+	}
+	t.Text = string(b)
+	return t, nil
+}
+
+// emailTemplate - the newest version of a template, whether saved through the api or in the directory; on a tie
+// the saved version wins, since it was numbered above the directory's newest when it was saved
+func (s *server) emailTemplate(name string) (EmailTemplate, error) {
+	latest, err := s.templates.Latest(name)
+	if err != nil && err != mgo.ErrNotFound {
+		return EmailTemplate{}, err
+	}
+	latest.Source = templateFromMongo
+	versions, err := dirTemplateVersions(templateDir(), name)
+	if err != nil {
+		return EmailTemplate{}, err
+	}
+	if len(versions) > 0 && versions[len(versions)-1] > latest.Version {
+		return readDirTemplate(templateDir(), name, versions[len(versions)-1])
+	}
+	if latest.Version == 0 {
+		return EmailTemplate{}, mgo.ErrNotFound
+	}
+	return latest, nil
+}
+
+// emailTemplates - the newest version of every template
+func (s *server) emailTemplates(ctx echo.Context) error {
+	if !hasRole(ctx, RoleAdmin) {
+		m := echo.Map{}
+		m["error"] = "only admins can manage email templates"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	stored, err := s.templates.List()
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	names := map[string]bool{}
+	for _, t := range stored {
+		names[t.Name] = true
+	}
+	dirs, _ := filepath.Glob(filepath.Join(templateDir(), "*"))
+	for _, d := range dirs {
+		names[filepath.Base(d)] = true
+	}
+	templates := make([]EmailTemplate, 0)
+	for name := range names {
+		t, err := s.emailTemplate(name)
+		if err == nil {
+			templates = append(templates, t)
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return ctx.JSON(http.StatusOK, templates)
+}
+
+// saveEmailTemplate - store a new version of a template; it is used for every email sent from then on
+func (s *server) saveEmailTemplate(ctx echo.Context) error {
+	if !hasRole(ctx, RoleAdmin) {
+		m := echo.Map{}
+		m["error"] = "only admins can manage email templates"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(ctx.Request().Body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	var t EmailTemplate
+	err = json.Unmarshal(buf.Bytes(), &t)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	t.Name = ctx.Param("name")
+	err = t.Validate()
+	if err != nil {
+		return validationError(ctx, err)
+	}
+	current, err := s.emailTemplate(t.Name)
+	if err != nil && err != mgo.ErrNotFound {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	actor := actorFrom(ctx)
+	t.ID = bson.NewObjectId()
+	t.Version = current.Version + 1
+	t.Source = templateFromMongo
+	t.CreatedBy = &actor
+	t.CreatedAt = time.Now()
+	err = s.templates.Save(t)
+	if mgo.IsDup(err) {
+		m := echo.Map{}
+		m["error"] = "the template was changed at the same time, try again"
+		return ctx.JSON(http.StatusConflict, m)
+	}
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(http.StatusCreated, t)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeDirTemplate - add a version of a template to the directory
+func writeDirTemplate(t *testing.T, dir string, name string, version int, subject string) {
+	t.Helper()
+	base := filepath.Join(dir, name, strconv.Itoa(version))
+	err := os.MkdirAll(filepath.Dir(base), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(base+".subject", []byte(subject), 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(base+".html", []byte("<p>Hi {{.Name}}</p>"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	tmpl := EmailTemplate{
+		Subject: "Hello\n  {{.Name}}",
+		HTML:    `<!--[if mso]><table><![endif]--><p>{{.Name}}</p>`,
+		Text:    "Hi {{.Name}}",
+	}
+	r, err := tmpl.render(emailData{Name: "<Ann>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Subject != "Hello <Ann>" || r.Text != "Hi <Ann>" {
+		t.Errorf("unexpected text parts %+v", r)
+	}
+	// outlook's conditional comments survive while the data is still escaped
+	if r.HTML != `<!--[if mso]><table><![endif]--><p>&lt;Ann&gt;</p>` {
+		t.Errorf("unexpected html %s", r.HTML)
+	}
+
+	err = EmailTemplate{Name: "Bad Name", Subject: "{{.Name", HTML: ""}.Validate()
+	errs, ok := err.(ValidationErrors)
+	if !ok || errs["name"] == "" || errs["html"] == "" {
+		t.Errorf("expected name and html errors, got %v", err)
+	}
+}
+
+func TestTemplateVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	api := newTestAPI()
+	// created while the real templates are in use, since the referrer is emailed about it
+	c := api.createClient(t, "Ann Smith", "ann@example.com")
+	os.Setenv("EMAIL_TEMPLATE_DIR", dir)
+	defer os.Unsetenv("EMAIL_TEMPLATE_DIR")
+	writeDirTemplate(t, dir, "hello", 1, "from the directory")
+	writeDirTemplate(t, dir, "hello", 2, "from the directory again")
+
+	rec := api.call("POST", "/email_templates/hello", `{"subject":"saved","html":"<p>{{.Name}}</p>"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("save: %d %s", rec.Code, rec.Body)
+	}
+	var saved EmailTemplate
+	decode(t, rec, &saved)
+	if saved.Version != 3 || saved.Source != templateFromMongo {
+		t.Fatalf("a saved version should follow the directory's, got %d from %s", saved.Version, saved.Source)
+	}
+
+	// a deploy adding the same number leaves the saved version in use
+	writeDirTemplate(t, dir, "hello", 3, "deployed")
+	current, err := api.emailTemplate("hello")
+	if err != nil || current.Source != templateFromMongo || current.Subject != "saved" {
+		t.Errorf("tie: got %+v %v", current, err)
+	}
+
+	writeDirTemplate(t, dir, "hello", 4, "deployed later")
+	err = api.queueEmail("hello", c.ClientEmail, clientEmailData(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := api.messages.FindByClientID(c.ID.Hex())
+	var msg Message
+	for _, m := range messages {
+		if m.Template == "hello" {
+			msg = m
+		}
+	}
+	if msg.Version != 4 || msg.Source != templateFromFile || !strings.Contains(msg.Subject, "deployed later") {
+		t.Errorf("the message should record the directory's version 4, got %+v", msg)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/labstack/echo"
+	"github.com/spf13/cast"
+)
+
+var unmatchedConnection = "unmatched_appointments"
+
+// unmatched booking states
+const (
+	UnmatchedPending  = "pending"
+	UnmatchedAttached = "attached"
+	UnmatchedCanceled = "canceled"
+)
+
+// UnmatchedBooking - a booking whose invitee email matched no client, kept for staff to review
+type UnmatchedBooking struct {
+	ID            bson.ObjectId          `json:"_id" bson:"_id"`
+	Status        string                 `json:"status" bson:"status"`
+	Provider      string                 `json:"provider" bson:"provider"`
+	InviteeEmail  string                 `json:"inviteeEmail" bson:"inviteeEmail"`
+	InviteeName   string                 `json:"inviteeName" bson:"inviteeName"`
+	EventUUID     string                 `json:"eventUUID" bson:"eventUUID"`
+	InviteeUUID   string                 `json:"inviteeUUID" bson:"inviteeUUID"`
+	StartTime     string                 `json:"startTime" bson:"startTime"`
+	ReceivedAt    time.Time              `json:"receivedAt" bson:"receivedAt"`
+	ClientID      bson.ObjectId          `json:"clientID,omitempty" bson:"clientID,omitempty"`
+	AppointmentID bson.ObjectId          `json:"appointmentID,omitempty" bson:"appointmentID,omitempty"`
+	ResolvedBy    *Actor                 `json:"resolvedBy,omitempty" bson:"resolvedBy,omitempty"`
+	ResolvedAt    time.Time              `json:"resolvedAt,omitempty" bson:"resolvedAt,omitempty"`
+	Delivery      map[string]interface{} `json:"delivery" bson:"delivery"`
+}
+
+// UnmatchedStore - persistence for the unmatched booking review queue
+type UnmatchedStore interface {
+	Save(b UnmatchedBooking) error
+	Update(b UnmatchedBooking) error
+	FindByID(id string) (UnmatchedBooking, error)
+	FindByInviteeUUID(uuid string) (UnmatchedBooking, error)
+	FindByStatus(status string) ([]UnmatchedBooking, error)
+}
+
+// queueUnmatched - park a created booking nobody could be matched to
+func (s *server) queueUnmatched(provider string, body []byte, ev bookingEvent) error {
+	var delivery map[string]interface{}
+	err := json.Unmarshal(body, &delivery)
+	if err != nil {
+		return err
+	}
+	b := UnmatchedBooking{
+		ID:           bson.NewObjectId(),
+		Status:       UnmatchedPending,
+		Provider:     provider,
+		InviteeEmail: ev.Appointment.InviteeEmail,
+		InviteeName:  ev.Appointment.InviteeName,
+		EventUUID:    ev.Appointment.EventUUID,
+		InviteeUUID:  ev.Appointment.InviteeUUID,
+		StartTime:    ev.Appointment.StartTime.Format(time.RFC3339),
+		ReceivedAt:   time.Now(),
+		Delivery:     delivery,
+	}
+	err = s.unmatched.Save(b)
+	if mgo.IsDup(err) {
+		// a retried delivery of a booking already in the queue
+		return nil
+	}
+	return err
+}
+
+// cancelUnmatched - a canceled booking that was still waiting in the queue no longer needs review
+func (s *server) cancelUnmatched(actor Actor, inviteeUUID string) error {
+	b, err := s.unmatched.FindByInviteeUUID(inviteeUUID)
+	if err != nil {
+		return err
+	}
+	if b.Status != UnmatchedPending {
+		return nil
+	}
+	b.Status = UnmatchedCanceled
+	b.ResolvedAt = time.Now()
+	b.ResolvedBy = &actor
+	return s.unmatched.Update(b)
+}
+
+func (s *server) unmatchedAppointments(ctx echo.Context) error {
+	// bookings carry the invitee's contact details and answers
+	if !policyFor(ctx).sensitive() {
+		m := echo.Map{}
+		m["error"] = "unmatched appointments are only available to caseworkers and admins"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	status := ctx.QueryParam("status")
+	if status == "" {
+		status = UnmatchedPending
+	}
+	bookings, err := s.unmatched.FindByStatus(status)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(http.StatusOK, bookings)
+}
+
+// attachUnmatchedAppointment - turn a queued booking into an appointment for the chosen client,
+// optionally remembering the booking email as an alias so the next booking matches on its own
+func (s *server) attachUnmatchedAppointment(ctx echo.Context) error {
+	if !policyFor(ctx).sensitive() {
+		m := echo.Map{}
+		m["error"] = "unmatched appointments are only available to caseworkers and admins"
+		return ctx.JSON(http.StatusForbidden, m)
+	}
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(ctx.Request().Body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	var body echo.Map
+	err = json.Unmarshal(buf.Bytes(), &body)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	clientID := cast.ToString(body["clientID"])
+	addAlias := cast.ToBool(body["addAlias"])
+	if !govalidator.IsMongoID(clientID) {
+		return validationError(ctx, ValidationErrors{"clientID": "is not a valid mongo ID"})
+	}
+
+	b, err := s.unmatched.FindByID(ctx.Param("id"))
+	if err == mgo.ErrNotFound {
+		m := echo.Map{}
+		m["error"] = "unmatched appointment not found"
+		return ctx.JSON(404, m)
+	}
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(400, m)
+	}
+	if b.Status != UnmatchedPending {
+		m := echo.Map{}
+		m["error"] = "unmatched appointment is already " + b.Status
+		return ctx.JSON(http.StatusConflict, m)
+	}
+	client, err := s.clients.FindByID(clientID)
+	if err == mgo.ErrNotFound {
+		return validationError(ctx, ValidationErrors{"clientID": "no client with this id"})
+	}
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+
+	actor := actorFrom(ctx)
+	if addAlias && b.InviteeEmail != client.ClientEmail {
+		other, err := s.clients.FindByEmail(b.InviteeEmail)
+		if err == nil && other.ID != client.ID {
+			m := echo.Map{}
+			m["error"] = "email " + b.InviteeEmail + " already belongs to another client"
+			return ctx.JSON(http.StatusConflict, m)
+		}
+		// without the lookup we cannot tell whether the alias would take another family's email
+		if err != nil && err != mgo.ErrNotFound {
+			m := echo.Map{}
+			m["error"] = err.Error()
+			return ctx.JSON(500, m)
+		}
+		err = s.clients.AddEmailAlias(clientID, b.InviteeEmail)
+		if err != nil {
+			m := echo.Map{}
+			m["error"] = err.Error()
+			return ctx.JSON(500, m)
+		}
+		before := client
+		client.EmailAliases = append(client.EmailAliases, b.InviteeEmail)
+		s.audit(actor, "client.alias", client.ID, before, client)
+	}
+
+	data, err := json.Marshal(b.Delivery)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	// bookings queued before there were other providers all came from calendly
+	provider := schedulingProviders[providerCalendly]
+	if p, ok := schedulingProviders[b.Provider]; ok {
+		provider = p
+	}
+	ev, err := provider.Parse(data)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	apt, err := s.createAppointment(actor, ev, client)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+
+	b.Status = UnmatchedAttached
+	b.ClientID = client.ID
+	b.AppointmentID = apt.ID
+	b.ResolvedBy = &actor
+	b.ResolvedAt = time.Now()
+	err = s.unmatched.Update(b)
+	if err != nil {
+		m := echo.Map{}
+		m["error"] = err.Error()
+		return ctx.JSON(500, m)
+	}
+	return ctx.JSON(http.StatusOK, b)
+}
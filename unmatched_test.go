@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// strangerBooking - the fixture booked with an email no client has
+func strangerBooking(t *testing.T) []byte {
+	t.Helper()
+	body, err := ioutil.ReadFile("webhook_fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(strings.Replace(string(body), "bevan@bevanhunt.com", "bev.hunt@example.com", -1))
+}
+
+func TestUnmatchedBookingAttach(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Bevan Hunt", "bevan@bevanhunt.com")
+	c, err := api.transition(Actor{}, c, StatusApproved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = api.processBooking(calendlyProvider{}, strangerBooking(t))
+		if err != nil {
+			t.Fatalf("delivery %d: %v", i+1, err)
+		}
+	}
+
+	rec := api.call("GET", "/unmatched_appointments", "", RoleVolunteer)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("volunteer list: got %d", rec.Code)
+	}
+	rec = api.call("GET", "/unmatched_appointments", "", RoleCaseworker)
+	var queued []UnmatchedBooking
+	decode(t, rec, &queued)
+	if len(queued) != 1 || queued[0].InviteeEmail != "bev.hunt@example.com" {
+		t.Fatalf("expected the booking queued once, got %s", rec.Body)
+	}
+
+	rec = api.call("POST", "/unmatched_appointments/"+queued[0].ID.Hex()+"/attach",
+		`{"clientID":"`+c.ID.Hex()+`","addAlias":true}`, RoleCaseworker)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("attach: %d %s", rec.Code, rec.Body)
+	}
+	apts, _ := api.appointments.FindByClientID(c.ID.Hex())
+	saved, _ := api.clients.FindByID(c.ID.Hex())
+	if len(apts) != 1 || saved.Status != StatusScheduled {
+		t.Errorf("attach should book the client: %d appointments, status %s", len(apts), saved.Status)
+	}
+	if len(saved.EmailAliases) != 1 || saved.EmailAliases[0] != "bev.hunt@example.com" {
+		t.Errorf("alias not saved: %v", saved.EmailAliases)
+	}
+	rec = api.call("POST", "/unmatched_appointments/"+queued[0].ID.Hex()+"/attach",
+		`{"clientID":"`+c.ID.Hex()+`"}`, RoleCaseworker)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("attaching twice: got %d", rec.Code)
+	}
+
+	// the alias matches the next booking without staff
+	matched, err := api.clients.FindByEmail("bev.hunt@example.com")
+	if err != nil || matched.ID != c.ID {
+		t.Errorf("alias lookup: %+v %v", matched, err)
+	}
+}
+
+func TestUnmatchedBookingCanceled(t *testing.T) {
+	api := newTestAPI()
+	err := api.processBooking(calendlyProvider{}, strangerBooking(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.processBooking(calendlyProvider{}, calendlyCancel(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := api.unmatched.FindByInviteeUUID("FGFXPRFA7FRJR3SQ")
+	if err != nil || b.Status != UnmatchedCanceled || b.ResolvedBy == nil {
+		t.Errorf("a canceled booking should leave the queue: %+v %v", b, err)
+	}
+}
+
+// unreachableEmailLookup - a client store whose email lookups fail the way a lost mongo connection does
+type unreachableEmailLookup struct {
+	ClientStore
+}
+
+func (unreachableEmailLookup) FindByEmail(email string) (Client, error) {
+	return Client{}, errors.New("no reachable servers")
+}
+
+func TestUnmatchedAttachFailsWhenAliasLookupFails(t *testing.T) {
+	api := newTestAPI()
+	c := api.createClient(t, "Bevan Hunt", "bevan@bevanhunt.com")
+	c, err := api.transition(Actor{}, c, StatusApproved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.processBooking(calendlyProvider{}, strangerBooking(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, _ := api.unmatched.FindByStatus(UnmatchedPending)
+	if len(queued) != 1 {
+		t.Fatalf("expected the booking queued, got %v", queued)
+	}
+
+	api.clients = unreachableEmailLookup{api.clients}
+	rec := api.call("POST", "/unmatched_appointments/"+queued[0].ID.Hex()+"/attach",
+		`{"clientID":"`+c.ID.Hex()+`","addAlias":true}`, RoleCaseworker)
+	if rec.Code != 500 {
+		t.Errorf("attach: got %d %s", rec.Code, rec.Body)
+	}
+	saved, _ := api.clients.FindByID(c.ID.Hex())
+	if len(saved.EmailAliases) != 0 {
+		t.Errorf("alias added without checking who owns the email: %v", saved.EmailAliases)
+	}
+}
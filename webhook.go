@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+const calendlySignatureHeader = "Calendly-Webhook-Signature"
+
+// verifyCalendlySignature - check a "t=<unix>,v1=<hex hmac>" header against HMAC-SHA256("<t>.<body>")
+// and reject deliveries whose timestamp is outside the replay tolerance
+func verifyCalendlySignature(header string, body []byte, key string, tolerance time.Duration, now time.Time) error {
+	if key == "" {
+		return errors.New("calendly signing key is not configured")
+	}
+	if header == "" {
+		return errors.New("missing " + calendlySignatureHeader + " header")
+	}
+	var timestamp string
+	signatures := make([]string, 0)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return errors.New("malformed " + calendlySignatureHeader + " header")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature timestamp")
+	}
+	age := now.Sub(time.Unix(unix, 0))
+	if age > tolerance || age < -tolerance {
+		return errors.New("signature timestamp outside tolerance, possible replay")
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+	for _, sig := range signatures {
+		given, err := hex.DecodeString(sig)
+		if err == nil && hmac.Equal(given, expected) {
+			return nil
+		}
+	}
+	return errors.New("signature does not match")
+}
+
+// calendlyWebhookConfig - the signing key and replay tolerance for calendly deliveries
+func calendlyWebhookConfig() (string, time.Duration) {
+	viper.AutomaticEnv()
+	viper.SetDefault("calendly_webhook_tolerance", "3m")
+	return cast.ToString(viper.Get("calendly_signing_key")), cast.ToDuration(viper.Get("calendly_webhook_tolerance"))
+}
+
+const calcomSignatureHeader = "X-Cal-Signature-256"
+
+// verifyCalcomSignature - check the hex HMAC-SHA256 of the body; cal.com signs no timestamp, so replays
+// are left to the inbox, where processing the same booking twice changes nothing
+func verifyCalcomSignature(header string, body []byte, secret string) error {
+	if secret == "" {
+		return errors.New("cal.com webhook secret is not configured")
+	}
+	if header == "" {
+		return errors.New("missing " + calcomSignatureHeader + " header")
+	}
+	given, err := hex.DecodeString(strings.TrimSpace(header))
+	if err != nil {
+		return errors.New("malformed " + calcomSignatureHeader + " header")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// calcomWebhookConfig - the secret set on the cal.com webhook subscription
+func calcomWebhookConfig() string {
+	viper.AutomaticEnv()
+	return cast.ToString(viper.Get("calcom_webhook_secret"))
+}
+
+// verifyMailgunSignature - check the signature block mailgun puts in each event: a hex HMAC-SHA256 of
+// timestamp+token keyed by the webhook signing key, with a timestamp inside the replay tolerance
+func verifyMailgunSignature(timestamp string, token string, signature string, key string, tolerance time.Duration, now time.Time) error {
+	if key == "" {
+		return errors.New("mailgun webhook signing key is not configured")
+	}
+	if timestamp == "" || token == "" || signature == "" {
+		return errors.New("missing mailgun signature")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature timestamp")
+	}
+	age := now.Sub(time.Unix(unix, 0))
+	if age > tolerance || age < -tolerance {
+		return errors.New("signature timestamp outside tolerance, possible replay")
+	}
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("malformed mailgun signature")
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// mailgunWebhookConfig - the webhook signing key from the mailgun dashboard and the replay tolerance
+func mailgunWebhookConfig() (string, time.Duration) {
+	viper.AutomaticEnv()
+	viper.SetDefault("mailgun_webhook_tolerance", "5m")
+	return cast.ToString(viper.Get("mailgun_webhook_signing_key")), cast.ToDuration(viper.Get("mailgun_webhook_tolerance"))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func hmacHex(key string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	for _, p := range parts {
+		mac.Write([]byte(p))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// calendlySignature - the Calendly-Webhook-Signature header calendly would send for the body at the time
+func calendlySignature(key string, at time.Time, body string) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + ts + ",v1=" + hmacHex(key, ts, ".", body)
+}
+
+func TestVerifyCalendlySignature(t *testing.T) {
+	now := time.Unix(1550000000, 0)
+	body := `{"event":"invitee.created"}`
+	good := calendlySignature("secret", now, body)
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	cases := []struct {
+		name   string
+		header string
+		body   string
+		key    string
+		ok     bool
+	}{
+		{"valid", good, body, "secret", true},
+		{"valid with a rotated second signature", "t=" + ts + ",v1=00ff,v1=" + hmacHex("secret", ts, ".", body), body, "secret", true},
+		{"body changed", good, body + " ", "secret", false},
+		{"wrong key", good, body, "other", false},
+		{"no key configured", good, body, "", false},
+		{"no header", "", body, "secret", false},
+		{"no signature", "t=" + ts, body, "secret", false},
+		{"bad timestamp", "t=soon,v1=00", body, "secret", false},
+		{"stale", calendlySignature("secret", now.Add(-4*time.Minute), body), body, "secret", false},
+		{"from the future", calendlySignature("secret", now.Add(4*time.Minute), body), body, "secret", false},
+		{"just inside tolerance", calendlySignature("secret", now.Add(-2*time.Minute), body), body, "secret", true},
+	}
+	for _, tc := range cases {
+		err := verifyCalendlySignature(tc.header, []byte(tc.body), tc.key, 3*time.Minute, now)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
+
+func TestCalendlyWebhookRejectsUnsignedDeliveries(t *testing.T) {
+	viper.Set("calendly_signing_key", "secret")
+	defer viper.Set("calendly_signing_key", "")
+	api := newTestAPI()
+	body := `{"event":"invitee.created","payload":{"invitee":{"uuid":"abc"}}}`
+
+	post := func(signature string) int {
+		req := httptest.NewRequest("POST", "/appointment_webhook", strings.NewReader(body))
+		req.Header.Set(calendlySignatureHeader, signature)
+		rec := httptest.NewRecorder()
+		api.app.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := post(calendlySignature("forged", time.Now(), body)); code != http.StatusUnauthorized {
+		t.Errorf("forged signature: got %d", code)
+	}
+	deliveries, _ := api.inbox.FindByStatus(DeliveryPending)
+	if len(deliveries) != 0 {
+		t.Errorf("a rejected delivery was stored: %+v", deliveries)
+	}
+	if code := post(calendlySignature("secret", time.Now(), body)); code != http.StatusOK {
+		t.Errorf("signed delivery: got %d", code)
+	}
+}
+
+func TestVerifyCalcomSignature(t *testing.T) {
+	body := `{"triggerEvent":"BOOKING_CREATED"}`
+	good := hmacHex("secret", body)
+	cases := []struct {
+		name   string
+		header string
+		body   string
+		secret string
+		ok     bool
+	}{
+		{"valid", good, body, "secret", true},
+		{"valid with whitespace", " " + good + "\n", body, "secret", true},
+		{"body changed", good, body + " ", "secret", false},
+		{"wrong secret", good, body, "other", false},
+		{"no secret configured", good, body, "", false},
+		{"no header", "", body, "secret", false},
+		{"not hex", "zz", body, "secret", false},
+	}
+	for _, tc := range cases {
+		err := verifyCalcomSignature(tc.header, []byte(tc.body), tc.secret)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}